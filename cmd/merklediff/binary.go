@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	ibinary "github.com/BryceDouglasJames/merklediff/internal/binary"
+	"github.com/BryceDouglasJames/merklediff/pkg/tree"
+)
+
+var binaryCmd = &cobra.Command{
+	Use:   "binary <file-a> <file-b>",
+	Short: "Compare two binary files and report the byte ranges that differ",
+	Long: `Split two files of any format into chunks, build a Merkle tree of each,
+and report the byte ranges that differ with their offsets, lengths and a hex
+preview of each side.
+
+Content-defined chunking (the default) cuts chunks where the bytes say to,
+so an insert or delete only changes the chunks around it. Fixed chunking
+cuts every --chunk-size bytes and suits files edited in place. Exits 1 if
+the files differ.
+
+Examples:
+  merklediff binary model-v1.bin model-v2.bin
+  merklediff binary --chunking fixed --chunk-size 4096 disk-a.img disk-b.img
+  merklediff binary --json --limit 0 a.parquet b.parquet`,
+	Args: cobra.ExactArgs(2),
+	RunE: runBinary,
+}
+
+// BinaryResult represents the output of a binary comparison
+type BinaryResult struct {
+	FileA     string         `json:"file_a"`
+	FileB     string         `json:"file_b"`
+	SizeA     int64          `json:"size_a"`
+	SizeB     int64          `json:"size_b"`
+	ChunksA   int            `json:"chunks_a"`
+	ChunksB   int            `json:"chunks_b"`
+	Chunking  string         `json:"chunking"`
+	RootA     string         `json:"root_a"`
+	RootB     string         `json:"root_b"`
+	Identical bool           `json:"identical"`
+	Regions   []BinaryRegion `json:"regions,omitempty"`
+	Summary   BinarySummary  `json:"summary"`
+}
+
+// BinaryRegion is a byte range that differs, with its position in each file.
+// Type is "added" or "removed" when the range is empty in one file.
+type BinaryRegion struct {
+	Type     string `json:"type"` // "added", "removed", "changed"
+	OffsetA  int64  `json:"offset_a"`
+	LengthA  int64  `json:"length_a"`
+	OffsetB  int64  `json:"offset_b"`
+	LengthB  int64  `json:"length_b"`
+	PreviewA string `json:"preview_a,omitempty"`
+	PreviewB string `json:"preview_b,omitempty"`
+}
+
+type BinarySummary struct {
+	Regions int   `json:"regions"`
+	BytesA  int64 `json:"bytes_a"`
+	BytesB  int64 `json:"bytes_b"`
+}
+
+// chunkedFile is an open file with its chunk hashes and the root-only tree
+// built from them. Its bytes are read again only where they are needed.
+type chunkedFile struct {
+	file   *os.File
+	size   int64
+	tree   *tree.MerkleTree
+	chunks []ibinary.ChunkHash
+}
+
+func runBinary(cmd *cobra.Command, args []string) error {
+	splitter, err := newSplitter()
+	if err != nil {
+		return err
+	}
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
+	}
+
+	files := make([]chunkedFile, len(args))
+	for i, path := range args {
+		if files[i], err = chunkFile(path, splitter, treeConfig); err != nil {
+			return err
+		}
+		defer files[i].file.Close()
+	}
+	a, b := files[0], files[1]
+
+	result := BinaryResult{
+		FileA:    args[0],
+		FileB:    args[1],
+		SizeA:    a.size,
+		SizeB:    b.size,
+		ChunksA:  len(a.chunks),
+		ChunksB:  len(b.chunks),
+		Chunking: chunking,
+		RootA:    rootHex(a.tree),
+		RootB:    rootHex(b.tree),
+	}
+
+	// Equal roots mean equal files; otherwise the regions come from a flat
+	// diff of the chunk hashes, which resynchronizes after an insert
+	result.Identical = result.RootA == result.RootB
+	if !result.Identical {
+		for _, r := range ibinary.DiffChunks(a.chunks, b.chunks) {
+			r, err = r.Trim(a.file, b.file)
+			if err != nil {
+				return fmt.Errorf("failed to compare %s and %s: %w", args[0], args[1], err)
+			}
+			if r.LengthA == 0 && r.LengthB == 0 {
+				// Reordered chunks can still spell out the same bytes
+				continue
+			}
+			region := BinaryRegion{
+				Type:    "changed",
+				OffsetA: r.OffsetA,
+				LengthA: r.LengthA,
+				OffsetB: r.OffsetB,
+				LengthB: r.LengthB,
+			}
+			if region.PreviewA, err = hexPreview(a.file, r.OffsetA, r.LengthA); err != nil {
+				return fmt.Errorf("failed to read %s: %w", args[0], err)
+			}
+			if region.PreviewB, err = hexPreview(b.file, r.OffsetB, r.LengthB); err != nil {
+				return fmt.Errorf("failed to read %s: %w", args[1], err)
+			}
+			switch {
+			case r.LengthA == 0:
+				region.Type = "added"
+			case r.LengthB == 0:
+				region.Type = "removed"
+			}
+			result.Regions = append(result.Regions, region)
+			result.Summary.BytesA += r.LengthA
+			result.Summary.BytesB += r.LengthB
+		}
+		result.Summary.Regions = len(result.Regions)
+	}
+
+	out := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if outputJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		outputBinaryAsText(out, result)
+	}
+
+	if !result.Identical && !exitZero {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// newSplitter returns the chunker selected by --chunking and --chunk-size.
+// Content-defined chunks range from a quarter to eight times the average.
+func newSplitter() (ibinary.Splitter, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+	}
+	switch chunking {
+	case "fixed":
+		return ibinary.NewChunker(chunkSize), nil
+	case "content":
+		c, err := ibinary.NewContentChunkerWithConfig(ibinary.ChunkerConfig{
+			MinSize: max(1, chunkSize/4),
+			AvgSize: chunkSize,
+			MaxSize: chunkSize * 8,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unknown chunking %q (want fixed or content)", chunking)
+	}
+}
+
+// chunkFile opens path and splits it as it is read, hashing each chunk into
+// its tree. Only one chunk is held at a time; the caller closes the file.
+func chunkFile(path string, splitter ibinary.Splitter, config tree.TreeConfig) (chunkedFile, error) {
+	b, err := tree.NewChunkTreeBuilder(config)
+	if err != nil {
+		return chunkedFile{}, fmt.Errorf("failed to build tree for %s: %w", path, err)
+	}
+	b.SetPruneLevel(tree.PruneAll)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return chunkedFile{}, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	cf := chunkedFile{file: f}
+	r := ibinary.NewChunkReader(f, splitter)
+	for {
+		chunk, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return chunkedFile{}, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		// Leaf hashes depend only on the chunk's bytes, not its position
+		cf.chunks = append(cf.chunks, ibinary.ChunkHash{Hash: b.Add(chunk), Length: len(chunk)})
+		cf.size += int64(len(chunk))
+	}
+	cf.tree = b.Build()
+	return cf, nil
+}
+
+func rootHex(mt *tree.MerkleTree) string {
+	if mt.GetRoot() == nil {
+		return ""
+	}
+	return hex.EncodeToString(mt.GetRoot().GetHash())
+}
+
+// hexPreview reads the first --preview bytes of a range and returns them in
+// hex.
+func hexPreview(r io.ReaderAt, offset, length int64) (string, error) {
+	buf := make([]byte, min(length, int64(previewBytes)))
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return "", err
+	}
+	preview := hex.EncodeToString(buf)
+	if int64(len(buf)) < length {
+		preview += "..."
+	}
+	return preview, nil
+}
+
+func outputBinaryAsText(out *os.File, result BinaryResult) {
+	summary := fmt.Sprintf("%d differing regions, %d bytes in A, %d bytes in B",
+		result.Summary.Regions, result.Summary.BytesA, result.Summary.BytesB)
+	if quiet {
+		if result.Identical {
+			summary = "identical"
+		}
+		fmt.Fprintln(out, summary)
+		return
+	}
+
+	fmt.Fprintf(out, "\n  File A: %s (%d bytes, %d chunks)\n", result.FileA, result.SizeA, result.ChunksA)
+	fmt.Fprintf(out, "  File B: %s (%d bytes, %d chunks)\n", result.FileB, result.SizeB, result.ChunksB)
+	fmt.Fprintf(out, "  Chunking: %s\n", result.Chunking)
+
+	fmt.Fprintln(out, "\n─────────────")
+	fmt.Fprintln(out, "  Regions")
+	fmt.Fprintln(out, "─────────────")
+
+	if result.Identical {
+		fmt.Fprintln(out, "\n Files are identical :)")
+	}
+
+	showCount := len(result.Regions)
+	if limit > 0 && showCount > limit {
+		showCount = limit
+	}
+	for i, r := range result.Regions[:showCount] {
+		fmt.Fprintf(out, "\n| Region: %d | %s", i+1, strings.ToUpper(r.Type))
+		switch r.Type {
+		case "added":
+			fmt.Fprintf(out, " %d bytes at B offset %d\n", r.LengthB, r.OffsetB)
+		case "removed":
+			fmt.Fprintf(out, " %d bytes at A offset %d\n", r.LengthA, r.OffsetA)
+		default:
+			fmt.Fprintf(out, " A offset %d (%d bytes) --> B offset %d (%d bytes)\n",
+				r.OffsetA, r.LengthA, r.OffsetB, r.LengthB)
+		}
+		if r.PreviewA != "" {
+			fmt.Fprintf(out, "      A: %s\n", r.PreviewA)
+		}
+		if r.PreviewB != "" {
+			fmt.Fprintf(out, "      B: %s\n", r.PreviewB)
+		}
+	}
+	if showCount < len(result.Regions) {
+		fmt.Fprintf(out, "\n  ... and %d more regions (use --output to write all to file)\n",
+			len(result.Regions)-showCount)
+	}
+
+	fmt.Fprintln(out, "\n───────────────────────────────────────────────────────────────")
+	fmt.Fprintf(out, "  Summary: %s\n", summary)
+	fmt.Fprintln(out, "───────────────────────────────────────────────────────────────")
+
+	if outputFile != "" {
+		fmt.Printf("Results written to: %s\n", outputFile)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	ibinary "github.com/BryceDouglasJames/merklediff/internal/binary"
+)
+
+var deltaCmd = &cobra.Command{
+	Use:   "delta <base> <target>",
+	Short: "Write a compact patch that rebuilds target from base",
+	Long: `Chunk two files the same way 'merklediff binary' does and write a delta
+that rebuilds the target from the base: chunks of the target found in the
+base become copy instructions, and the rest is stored as literal bytes.
+Send the delta to a machine that already has the base and run
+'merklediff patch' there.
+
+The delta records the SHA-256 of both files, so it can only be applied to
+the right base and the rebuilt file is verified.
+
+Examples:
+  merklediff delta reference-v1.parquet reference-v2.parquet
+  merklediff delta --chunk-size 16384 -o v2.mddelta model-v1.bin model-v2.bin`,
+	Args: cobra.ExactArgs(2),
+	RunE: runDelta,
+}
+
+var patchCmd = &cobra.Command{
+	Use:   "patch <base> <delta>",
+	Short: "Rebuild a file from its base and a delta",
+	Long: `Apply a delta written by 'merklediff delta' to its base and write the
+rebuilt target to --output. The base and the result are both checked
+against the SHA-256 digests in the delta, and nothing is written unless the
+result matches.
+
+Examples:
+  merklediff patch -o reference-v2.parquet reference-v1.parquet reference-v2.mddelta`,
+	Args: cobra.ExactArgs(2),
+	RunE: runPatch,
+}
+
+func runDelta(cmd *cobra.Command, args []string) error {
+	path := outputFile
+	if path == "" {
+		path = args[1] + ".mddelta"
+	}
+
+	splitter, err := newSplitter()
+	if err != nil {
+		return err
+	}
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
+	}
+	base, err := chunkFile(args[0], splitter, treeConfig)
+	if err != nil {
+		return err
+	}
+	defer base.file.Close()
+	target, err := chunkFile(args[1], splitter, treeConfig)
+	if err != nil {
+		return err
+	}
+	defer target.file.Close()
+
+	delta, err := ibinary.NewDelta(base.file, target.file, base.chunks, target.chunks)
+	if err != nil {
+		return fmt.Errorf("failed to build delta: %w", err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create delta file: %w", err)
+	}
+	n, err := delta.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write delta: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write delta: %w", err)
+	}
+
+	copies, copied, inserts, inserted := delta.Stats()
+	fmt.Printf("Wrote %d-byte delta to %s\n", n, path)
+	fmt.Printf("  %d copies (%d bytes from base), %d inserts (%d new bytes)\n", copies, copied, inserts, inserted)
+	if target.size > 0 {
+		fmt.Printf("  %.1f%% of the target's %d bytes\n", 100*float64(n)/float64(target.size), target.size)
+	}
+	return nil
+}
+
+func runPatch(cmd *cobra.Command, args []string) error {
+	f, err := os.Open(args[1])
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", args[1], err)
+	}
+	delta, err := ibinary.ReadDelta(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to load delta %s: %w", args[1], err)
+	}
+	base, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", args[0], err)
+	}
+	defer base.Close()
+
+	// Write next to the destination and rename, so a failed or unverified
+	// patch never leaves a file at the output path
+	tmp, err := os.CreateTemp(filepath.Dir(outputFile), filepath.Base(outputFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	if err := delta.Apply(base, w); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to patch %s: %w", args[0], err)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", outputFile, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", outputFile, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outputFile, err)
+	}
+	if err := os.Rename(tmp.Name(), outputFile); err != nil {
+		return fmt.Errorf("failed to write %s: %w", outputFile, err)
+	}
+
+	fmt.Printf("Rebuilt %s (%d bytes)\n", outputFile, delta.TargetSize)
+	fmt.Printf("  SHA-256: %s\n", hex.EncodeToString(delta.TargetHash[:]))
+	return nil
+}
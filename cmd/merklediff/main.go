@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 
 	"github.com/spf13/cobra"
 
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
 	"github.com/BryceDouglasJames/merklediff/pkg/reader"
 	"github.com/BryceDouglasJames/merklediff/pkg/tree"
 )
@@ -29,6 +38,36 @@ var (
 	verbose    bool
 	exitZero   bool
 	limit      int
+	treeShape  string
+	hashName   string
+	hashKey    string
+	fanout     int
+	workers    int
+	explainKey string
+
+	// Snapshot flags
+	pruneLevel int
+
+	// Inspect flags
+	inspectFormat string
+	inspectDepth  int
+
+	// Range hash flags
+	rangeStart string
+	rangeEnd   string
+
+	// Sketch flags
+	maxDiff int
+
+	// Binary flags
+	chunking     string
+	chunkSize    int
+	previewBytes int
+
+	// Sort flags
+	sortInput  bool
+	sortMemory int
+	tempDir    string
 
 	// Postgres flags
 	pgDSN      string
@@ -42,7 +81,12 @@ var (
 )
 
 func main() {
-	if err := rootCmd.Execute(); err != nil {
+	// Interrupting stops a comparison in progress rather than killing it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		stop()
 		os.Exit(1)
 	}
 }
@@ -59,6 +103,7 @@ Examples:
   merklediff data_v1.csv data_v2.csv
   merklediff --key 0 users.csv users_updated.csv
   merklediff --key 0,1 --json sales.csv sales_new.csv
+  merklediff --sort unordered_a.csv unordered_b.csv
   merklediff --output diff.txt a.csv b.csv
   merklediff --limit 100 large_a.csv large_b.csv`,
 	Args: cobra.ExactArgs(2),
@@ -72,10 +117,25 @@ func init() {
 	rootCmd.Flags().IntVarP(&limit, "limit", "l", 20, "Limit number of changes shown (0 = no limit)")
 	rootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only output summary line (for scripts/pipelines)")
 	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Show detailed tree info")
+	rootCmd.Flags().StringVar(&explainKey, "explain", "", "Show traversal stats and the path taken through both trees for this key")
 	rootCmd.Flags().BoolVar(&exitZero, "exit-zero", false, "Always exit 0 (use for Airflow/pipelines)")
+	addTreeFlags(rootCmd)
+	rootCmd.Flags().BoolVar(&sortInput, "sort", false, "Sort rows by key before building trees (for unsorted files)")
+	rootCmd.Flags().IntVar(&sortMemory, "sort-memory", 64, "Memory budget in MiB before sorted runs spill to disk")
+	rootCmd.Flags().StringVar(&tempDir, "temp-dir", "", "Directory for sort spill files (default: system temp)")
 
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(postgresCmd)
+	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(inspectCmd)
+	rootCmd.AddCommand(rangeHashCmd)
+	rootCmd.AddCommand(mergeCmd)
+	rootCmd.AddCommand(replicasCmd)
+	rootCmd.AddCommand(sketchCmd)
+	rootCmd.AddCommand(reconcileCmd)
+	rootCmd.AddCommand(binaryCmd)
+	rootCmd.AddCommand(deltaCmd)
+	rootCmd.AddCommand(patchCmd)
 
 	// Postgres command flags
 	postgresCmd.Flags().StringVar(&pgDSN, "dsn", "", "PostgreSQL connection string (required)")
@@ -91,10 +151,128 @@ func init() {
 	postgresCmd.Flags().IntVarP(&limit, "limit", "l", 20, "Limit changes shown (0 = no limit)")
 	postgresCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only output summary line")
 	postgresCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Show detailed tree info")
+	postgresCmd.Flags().StringVar(&explainKey, "explain", "", "Show traversal stats and the path taken through both trees for this key")
 	postgresCmd.Flags().BoolVar(&exitZero, "exit-zero", false, "Always exit 0")
+	addTreeFlags(postgresCmd)
 
 	_ = postgresCmd.MarkFlagRequired("dsn")
 	_ = postgresCmd.MarkFlagRequired("key")
+
+	// Snapshot command flags
+	snapshotCmd.Flags().IntSliceVarP(&keyColumns, "key", "k", []int{0}, "Column indices for primary key (0-indexed)")
+	snapshotCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Snapshot file to write (default: <file>.mdt)")
+	addTreeFlags(snapshotCmd)
+	snapshotCmd.Flags().IntVar(&pruneLevel, "prune-level", 0, "Stream sorted rows and drop tree nodes at and below this level (0 = keep all)")
+	snapshotCmd.Flags().BoolVar(&sortInput, "sort", false, "Sort rows by key before building the tree (for unsorted files)")
+	snapshotCmd.Flags().IntVar(&sortMemory, "sort-memory", 64, "Memory budget in MiB before sorted runs spill to disk")
+	snapshotCmd.Flags().StringVar(&tempDir, "temp-dir", "", "Directory for sort spill files (default: system temp)")
+
+	// Inspect command flags
+	inspectCmd.Flags().StringVar(&inspectFormat, "format", "dot", "Output format: dot or json")
+	inspectCmd.Flags().IntVar(&inspectDepth, "depth", 6, "Levels below the root to export (0 = no limit)")
+	inspectCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write the export to file instead of stdout")
+	inspectCmd.Flags().IntSliceVarP(&keyColumns, "key", "k", []int{0}, "Column indices for primary key (0-indexed)")
+	addTreeFlags(inspectCmd)
+	inspectCmd.Flags().BoolVar(&sortInput, "sort", false, "Sort rows by key before building trees (for unsorted files)")
+	inspectCmd.Flags().IntVar(&sortMemory, "sort-memory", 64, "Memory budget in MiB before sorted runs spill to disk")
+	inspectCmd.Flags().StringVar(&tempDir, "temp-dir", "", "Directory for sort spill files (default: system temp)")
+
+	// Range hash command flags
+	rangeHashCmd.Flags().StringVar(&rangeStart, "start", "", "First key of the range (required)")
+	rangeHashCmd.Flags().StringVar(&rangeEnd, "end", "", "Last key of the range (required)")
+	rangeHashCmd.Flags().BoolVarP(&outputJSON, "json", "j", false, "Output as JSON")
+	rangeHashCmd.Flags().BoolVar(&exitZero, "exit-zero", false, "Always exit 0, even if the ranges differ")
+	rangeHashCmd.Flags().IntSliceVarP(&keyColumns, "key", "k", []int{0}, "Column indices for primary key (0-indexed)")
+	addTreeFlags(rangeHashCmd)
+	rangeHashCmd.Flags().BoolVar(&sortInput, "sort", false, "Sort rows by key before building trees (for unsorted files)")
+	rangeHashCmd.Flags().IntVar(&sortMemory, "sort-memory", 64, "Memory budget in MiB before sorted runs spill to disk")
+	rangeHashCmd.Flags().StringVar(&tempDir, "temp-dir", "", "Directory for sort spill files (default: system temp)")
+	_ = rangeHashCmd.MarkFlagRequired("start")
+	_ = rangeHashCmd.MarkFlagRequired("end")
+
+	// Merge command flags
+	mergeCmd.Flags().IntSliceVarP(&keyColumns, "key", "k", []int{0}, "Column indices for primary key (0-indexed)")
+	mergeCmd.Flags().BoolVarP(&outputJSON, "json", "j", false, "Output as JSON")
+	mergeCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write results to file instead of stdout")
+	mergeCmd.Flags().IntVarP(&limit, "limit", "l", 20, "Limit number of changes shown (0 = no limit)")
+	mergeCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only output summary line")
+	mergeCmd.Flags().BoolVar(&exitZero, "exit-zero", false, "Always exit 0, even if there are conflicts")
+	addTreeFlags(mergeCmd)
+	mergeCmd.Flags().BoolVar(&sortInput, "sort", false, "Sort rows by key before building trees (for unsorted files)")
+	mergeCmd.Flags().IntVar(&sortMemory, "sort-memory", 64, "Memory budget in MiB before sorted runs spill to disk")
+	mergeCmd.Flags().StringVar(&tempDir, "temp-dir", "", "Directory for sort spill files (default: system temp)")
+
+	// Replicas command flags
+	replicasCmd.Flags().IntSliceVarP(&keyColumns, "key", "k", []int{0}, "Column indices for primary key (0-indexed)")
+	replicasCmd.Flags().BoolVarP(&outputJSON, "json", "j", false, "Output as JSON")
+	replicasCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write results to file instead of stdout")
+	replicasCmd.Flags().IntVarP(&limit, "limit", "l", 20, "Limit number of keys shown (0 = no limit)")
+	replicasCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only output summary line")
+	replicasCmd.Flags().BoolVar(&exitZero, "exit-zero", false, "Always exit 0, even if copies disagree")
+	addTreeFlags(replicasCmd)
+	replicasCmd.Flags().BoolVar(&sortInput, "sort", false, "Sort rows by key before building trees (for unsorted files)")
+	replicasCmd.Flags().IntVar(&sortMemory, "sort-memory", 64, "Memory budget in MiB before sorted runs spill to disk")
+	replicasCmd.Flags().StringVar(&tempDir, "temp-dir", "", "Directory for sort spill files (default: system temp)")
+
+	// Sketch command flags
+	sketchCmd.Flags().IntVar(&maxDiff, "max-diff", 1000, "Number of differing keys the sketch must be able to recover")
+	sketchCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Sketch file to write (default: <file>.mdsk)")
+	sketchCmd.Flags().IntSliceVarP(&keyColumns, "key", "k", []int{0}, "Column indices for primary key (0-indexed)")
+	addHashFlags(sketchCmd)
+
+	// Reconcile command flags
+	reconcileCmd.Flags().IntVar(&maxDiff, "max-diff", 1000, "Differing keys to allow for when neither side is a sketch")
+	reconcileCmd.Flags().IntSliceVarP(&keyColumns, "key", "k", []int{0}, "Column indices for primary key (0-indexed)")
+	reconcileCmd.Flags().BoolVarP(&outputJSON, "json", "j", false, "Output as JSON")
+	reconcileCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write results to file instead of stdout")
+	reconcileCmd.Flags().IntVarP(&limit, "limit", "l", 20, "Limit number of changes shown (0 = no limit)")
+	reconcileCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only output summary line")
+	reconcileCmd.Flags().BoolVar(&exitZero, "exit-zero", false, "Always exit 0, even if keys differ")
+	addHashFlags(reconcileCmd)
+	reconcileCmd.Flags().Lookup("hash").Usage += " (overrides a sketch's)"
+
+	// Binary command flags
+	binaryCmd.Flags().StringVar(&chunking, "chunking", "content", "Chunking: content (insert-stable) or fixed")
+	binaryCmd.Flags().IntVar(&chunkSize, "chunk-size", 8<<10, "Chunk size in bytes (the average for content chunking)")
+	binaryCmd.Flags().IntVar(&previewBytes, "preview", 16, "Bytes of each differing range to show in hex")
+	binaryCmd.Flags().BoolVarP(&outputJSON, "json", "j", false, "Output as JSON")
+	binaryCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Write results to file instead of stdout")
+	binaryCmd.Flags().IntVarP(&limit, "limit", "l", 20, "Limit number of regions shown (0 = no limit)")
+	binaryCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "Only output summary line")
+	binaryCmd.Flags().BoolVar(&exitZero, "exit-zero", false, "Always exit 0, even if the files differ")
+	addHashFlags(binaryCmd)
+	addFanoutFlag(binaryCmd)
+
+	// Delta command flags
+	deltaCmd.Flags().StringVarP(&outputFile, "output", "o", "", "Delta file to write (default: <target>.mddelta)")
+	deltaCmd.Flags().StringVar(&chunking, "chunking", "content", "Chunking: content (insert-stable) or fixed")
+	deltaCmd.Flags().IntVar(&chunkSize, "chunk-size", 8<<10, "Chunk size in bytes (the average for content chunking)")
+	addHashFlags(deltaCmd)
+
+	// Patch command flags
+	patchCmd.Flags().StringVarP(&outputFile, "output", "o", "", "File to write the rebuilt target to (required)")
+	_ = patchCmd.MarkFlagRequired("output")
+}
+
+// addTreeFlags registers the flags buildTreeConfig reads: --shape, --hash,
+// --hash-key, --fanout and --workers.
+func addTreeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&treeShape, "shape", "positional", "Tree shape: positional or content (insert-stable)")
+	addHashFlags(cmd)
+	addFanoutFlag(cmd)
+}
+
+// addHashFlags registers --hash, --hash-key and --workers, for commands
+// whose trees have a fixed shape.
+func addHashFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&hashName, "hash", hasher.NameSHA256, "Hash function: sha256, sha512-256, fnv128a, hmac-sha256")
+	cmd.Flags().StringVar(&hashKey, "hash-key", "", "Key for hmac-sha256 (default: $MERKLEDIFF_HASH_KEY)")
+	cmd.Flags().IntVar(&workers, "workers", runtime.NumCPU(), "Goroutines used to build and compare trees")
+}
+
+// addFanoutFlag registers --fanout.
+func addFanoutFlag(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&fanout, "fanout", tree.MinFanout, "Children per node for positional trees (2-256)")
 }
 
 var versionCmd = &cobra.Command{
@@ -131,6 +309,65 @@ Examples:
 	RunE: runPostgresDiff,
 }
 
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot <file>",
+	Short: "Save the Merkle tree of a CSV file",
+	Long: `Build the Merkle tree of a CSV file and save it as a snapshot.
+
+The snapshot records every node hash plus the hash function, tree shape,
+fan-out, row count and schema, but not the rows themselves. Use the same
+tree flags when building the tree it will be compared against.
+
+Examples:
+  merklediff snapshot users.csv
+  merklediff snapshot --key 0,1 --output sales-2024-06-01.mdt sales.csv
+  merklediff snapshot --shape content --sort events.csv
+  merklediff snapshot --sort --prune-level 10 huge.csv
+
+By default the whole tree is built in memory. With --prune-level the rows
+are streamed, which requires them to be sorted by key (add --sort if they
+are not), and only nodes above that level are kept, so a snapshot of n rows
+holds about n/fanout^level nodes. Pruned subtrees still diff as a single
+range.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runSnapshot,
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <file> [<other-file>]",
+	Short: "Export a Merkle tree, or the differing region of two, as DOT or JSON",
+	Long: `Export the Merkle tree of a CSV file or snapshot for visualization.
+
+Given two files, export only the region of both trees a diff explores:
+changed nodes are expanded and highlighted, and the identical subtrees
+beneath them are shown but not expanded. Render DOT output with Graphviz.
+
+Examples:
+  merklediff inspect users.csv | dot -Tsvg > users.svg
+  merklediff inspect --depth 0 users_v1.csv users_v2.csv | dot -Tsvg > diff.svg
+  merklediff inspect --format json users.mdt users.csv`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: runInspect,
+}
+
+var rangeHashCmd = &cobra.Command{
+	Use:   "range-hash <file> [<other-file>...]",
+	Short: "Print a digest of the rows in a key range",
+	Long: `Print a digest of exactly the rows with keys from --start to --end,
+inclusive, for each CSV file or snapshot.
+
+The digest depends only on the rows in the range and the hash function, not
+on the tree shape or on rows outside the range, so sources holding different
+data can confirm that one partition matches without a full diff. Given
+several files, it exits 1 if their digests differ.
+
+Examples:
+  merklediff range-hash --start 2024-01-01 --end 2024-03-31 events.csv
+  merklediff range-hash --start 2024-01-01 --end 2024-03-31 events.mdt replica.csv`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runRangeHash,
+}
+
 // DiffResult represents the output for JSON mode
 type DiffResult struct {
 	FileA     string       `json:"file_a"`
@@ -141,6 +378,22 @@ type DiffResult struct {
 	Identical bool         `json:"identical"`
 	Changes   []Change     `json:"changes,omitempty"`
 	Summary   DiffSummary  `json:"summary"`
+
+	// Set with --verbose or --explain
+	Stats   *tree.DiffStats `json:"stats,omitempty"`
+	Explain []ExplainStep   `json:"explain,omitempty"`
+}
+
+// ExplainStep is one level of the path the diff took towards --explain's key.
+type ExplainStep struct {
+	Depth     int    `json:"depth"`
+	HashA     string `json:"hash_a,omitempty"`
+	HashB     string `json:"hash_b,omitempty"`
+	StartKey  string `json:"start_key"`
+	EndKey    string `json:"end_key"`
+	Identical bool   `json:"identical"`
+	// AbsentIn is "A" or "B" when that tree has no node at this depth
+	AbsentIn string `json:"absent_in,omitempty"`
 }
 
 type ColumnInfo struct {
@@ -148,11 +401,24 @@ type ColumnInfo struct {
 	Type string `json:"type"`
 }
 
+// Change is one added, removed or changed row. When a side was loaded from a
+// snapshot its values are unknown: a changed row then carries the new Values
+// instead of Fields, and a change that could not be narrowed to single rows
+// covers the keys Key through EndKey.
 type Change struct {
 	Type   string           `json:"type"` // "added", "removed", "changed"
 	Key    string           `json:"key"`
+	EndKey string           `json:"end_key,omitempty"`
 	Fields map[string]Field `json:"fields,omitempty"`
 	Values []any            `json:"values,omitempty"`
+
+	// Rows counts the rows on each side of a range-level change
+	Rows *RangeRows `json:"rows,omitempty"`
+}
+
+type RangeRows struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
 }
 
 type Field struct {
@@ -170,49 +436,50 @@ type DiffSummary struct {
 func runDiff(cmd *cobra.Command, args []string) error {
 	fileA, fileB := args[0], args[1]
 
-	config := reader.CSVReaderConfig{
-		KeyColumns: keyColumns,
-		HasHeader:  true,
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
 	}
 
-	// Read files
-	readerA, err := reader.NewCSVReaderFromPathWithConfig(fileA, config)
+	// Load snapshots first: a CSV compared against one must be built the
+	// same way, so the snapshot's tree settings and key columns win
+	snapA, err := loadSnapshot(fileA, treeConfig)
 	if err != nil {
-		return fmt.Errorf("failed to open %s: %w", fileA, err)
+		return err
 	}
-	defer readerA.Close()
-
-	readerB, err := reader.NewCSVReaderFromPathWithConfig(fileB, config)
+	snapB, err := loadSnapshot(fileB, treeConfig)
 	if err != nil {
-		return fmt.Errorf("failed to open %s: %w", fileB, err)
+		return err
 	}
-	defer readerB.Close()
-
-	rowsA, err := reader.CollectRows(readerA)
+	treeConfig, err = applySnapshotConfig(cmd, treeConfig, snapA, snapB)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %w", fileA, err)
+		return err
 	}
 
-	rowsB, err := reader.CollectRows(readerB)
+	sideA, err := loadDiffSide(fileA, snapA, treeConfig)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %w", fileB, err)
+		return err
 	}
+	sideB, err := loadDiffSide(fileB, snapB, treeConfig)
+	if err != nil {
+		return err
+	}
+	treeA, treeB := sideA.tree, sideB.tree
 
-	// Get schema after reading rows (types are inferred during iteration)
-	schemaA := readerA.Schema()
-
-	// Build trees
-	treeA := tree.NewMerkleTreeFromRows(toTreeRows(rowsA))
-	treeB := tree.NewMerkleTreeFromRows(toTreeRows(rowsB))
+	schemaA := sideA.schema
+	if len(schemaA.Columns) == 0 {
+		schemaA = sideB.schema
+	}
 
 	// Compare
 	diff := tree.NewDiff(treeA, treeB)
-	diff.Compare()
+	diff.SetConcurrency(workers)
+	if err := diff.Compare(cmd.Context()); err != nil {
+		return fmt.Errorf("failed to compare: %w", err)
+	}
 
 	// Build result
-	rowMapA := buildRowMap(rowsA)
-	rowMapB := buildRowMap(rowsB)
-	changes := collectChanges(diff.GetRanges(), rowMapA, rowMapB, schemaA)
+	changes := collectChanges(diff.GetRanges(), treeA, treeB, sideA.rowMap(), sideB.rowMap(), schemaA)
 
 	// Build schema info from detected types
 	schemaInfo := make([]ColumnInfo, len(schemaA.Columns))
@@ -223,13 +490,14 @@ func runDiff(cmd *cobra.Command, args []string) error {
 	result := DiffResult{
 		FileA:     fileA,
 		FileB:     fileB,
-		RowCountA: len(rowsA),
-		RowCountB: len(rowsB),
+		RowCountA: treeA.GetRowCount(),
+		RowCountB: treeB.GetRowCount(),
 		Schema:    schemaInfo,
 		Identical: len(changes) == 0,
 		Changes:   changes,
 		Summary:   summarize(changes),
 	}
+	addExplain(&result, diff)
 
 	// Determine output destination
 	var out *os.File
@@ -247,7 +515,138 @@ func runDiff(cmd *cobra.Command, args []string) error {
 	if outputJSON {
 		return outputAsJSON(out, result)
 	}
-	return outputAsText(out, result, treeA, treeB)
+	return outputAsText(out, result, diff)
+}
+
+// diffSide is one input to a diff. Sides loaded from a snapshot have a tree
+// but no rows.
+type diffSide struct {
+	tree         *tree.MerkleTree
+	rows         []reader.Row
+	schema       reader.Schema
+	fromSnapshot bool
+}
+
+// rowMap returns the side's rows by key, or nil if the rows are not available.
+func (s diffSide) rowMap() map[string]reader.Row {
+	if s.fromSnapshot {
+		return nil
+	}
+	return buildRowMap(s.rows)
+}
+
+// loadSnapshot reads path as a tree snapshot. It returns nil if path is not
+// a snapshot.
+func loadSnapshot(path string, config tree.TreeConfig) (*tree.MerkleTree, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(tree.SnapshotMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != tree.SnapshotMagic {
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	// Keyed hashers cannot be looked up by name, so pass the configured one
+	var h hasher.Hasher
+	if _, ok := config.Hasher.(*hasher.HMACHasher); ok {
+		h = config.Hasher
+	}
+	mt, err := tree.ReadTreeWithHasher(f, h)
+	var mismatch *tree.MismatchError
+	switch {
+	case errors.Is(err, hasher.ErrKeyRequired):
+		return nil, fmt.Errorf("snapshot %s was built with %s, so it needs --hash %s and its key in --hash-key or $MERKLEDIFF_HASH_KEY",
+			path, hasher.NameHMACSHA256, hasher.NameHMACSHA256)
+	case errors.As(err, &mismatch) && strings.HasPrefix(mismatch.A, hasher.NameHMACSHA256+":") && h != nil:
+		return nil, fmt.Errorf("snapshot %s was built with a different %s key than the one given", path, hasher.NameHMACSHA256)
+	case err != nil:
+		return nil, fmt.Errorf("failed to load snapshot %s: %w", path, err)
+	}
+	return mt, nil
+}
+
+// applySnapshotConfig returns the tree settings of any loaded snapshot,
+// so CSV sides are built the same way, and its key columns unless --key was
+// given. An explicit --shape, --fanout or --hash that disagrees with a
+// snapshot is an error rather than silently overridden, as are snapshots
+// built with different settings.
+func applySnapshotConfig(cmd *cobra.Command, config tree.TreeConfig, snaps ...*tree.MerkleTree) (tree.TreeConfig, error) {
+	flags := cmd.Flags()
+	var first *tree.MerkleTree
+	for _, snap := range snaps {
+		if snap == nil {
+			continue
+		}
+		snapConfig := snap.GetConfig()
+		switch {
+		case flags.Changed("shape") && snapConfig.Shape != config.Shape:
+			return config, fmt.Errorf("--shape %s conflicts with a snapshot built with shape %s", config.Shape, snapConfig.Shape)
+		case flags.Changed("fanout") && snapConfig.Fanout != config.Fanout:
+			return config, fmt.Errorf("--fanout %d conflicts with a snapshot built with fanout %d", config.Fanout, snapConfig.Fanout)
+		case flags.Changed("hash") && snapConfig.Hasher.Name() != config.Hasher.Name():
+			return config, fmt.Errorf("--hash %s conflicts with a snapshot built with %s", hashName, snapConfig.Hasher.Name())
+		}
+		if first == nil {
+			first = snap
+		} else if firstConfig := first.GetConfig(); snapConfig.Shape != firstConfig.Shape ||
+			snapConfig.Fanout != firstConfig.Fanout || snapConfig.Format != firstConfig.Format ||
+			snapConfig.Hasher.Name() != firstConfig.Hasher.Name() {
+			return config, fmt.Errorf("snapshots were built with different settings: %s and %s",
+				describeConfig(firstConfig), describeConfig(snapConfig))
+		}
+
+		config = snapConfig
+		config.Workers = workers
+		if !flags.Changed("key") && len(snap.GetSchema().KeyColumns) > 0 {
+			keyColumns = snap.GetSchema().KeyColumns
+		}
+	}
+	return config, nil
+}
+
+// describeConfig summarizes the settings that decide a tree's hashes.
+func describeConfig(config tree.TreeConfig) string {
+	return fmt.Sprintf("%s shape, fanout %d, %s, format %s",
+		config.Shape, config.Fanout, config.Hasher.Name(), config.Format)
+}
+
+// loadDiffSide reads a CSV file and builds its tree, or wraps an already
+// loaded snapshot.
+func loadDiffSide(path string, snap *tree.MerkleTree, config tree.TreeConfig) (diffSide, error) {
+	if snap != nil {
+		return diffSide{tree: snap, schema: snap.GetSchema(), fromSnapshot: true}, nil
+	}
+
+	csv, err := reader.NewCSVReaderFromPathWithConfig(path, reader.CSVReaderConfig{
+		KeyColumns: keyColumns,
+		HasHeader:  true,
+	})
+	if err != nil {
+		return diffSide{}, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	r := withSort(csv)
+	defer r.Close()
+
+	rows, err := reader.CollectRows(r)
+	if err != nil {
+		return diffSide{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	// Get schema after reading rows (types are inferred during iteration)
+	schema := r.Schema()
+
+	mt, err := tree.NewMerkleTreeFromRowsWithConfig(toTreeRows(rows), config)
+	if err != nil {
+		return diffSide{}, fmt.Errorf("failed to build tree for %s: %w", path, err)
+	}
+	mt.SetSchema(schema)
+	return diffSide{tree: mt, rows: rows, schema: schema}, nil
 }
 
 func runPostgresDiff(cmd *cobra.Command, args []string) error {
@@ -305,17 +704,30 @@ func runPostgresDiff(cmd *cobra.Command, args []string) error {
 	}
 
 	// Build trees
-	treeA := tree.NewMerkleTreeFromRows(toTreeRows(rowsA))
-	treeB := tree.NewMerkleTreeFromRows(toTreeRows(rowsB))
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
+	}
+	treeA, err := tree.NewMerkleTreeFromRowsWithConfig(toTreeRows(rowsA), treeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to build source tree: %w", err)
+	}
+	treeB, err := tree.NewMerkleTreeFromRowsWithConfig(toTreeRows(rowsB), treeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to build target tree: %w", err)
+	}
 
 	// Compare
 	diff := tree.NewDiff(treeA, treeB)
-	diff.Compare()
+	diff.SetConcurrency(workers)
+	if err := diff.Compare(cmd.Context()); err != nil {
+		return fmt.Errorf("failed to compare: %w", err)
+	}
 
 	// Build result
 	rowMapA := buildRowMap(rowsA)
 	rowMapB := buildRowMap(rowsB)
-	changes := collectChanges(diff.GetRanges(), rowMapA, rowMapB, schemaA)
+	changes := collectChanges(diff.GetRanges(), treeA, treeB, rowMapA, rowMapB, schemaA)
 
 	// Build schema info
 	schemaInfo := make([]ColumnInfo, len(schemaA.Columns))
@@ -343,6 +755,7 @@ func runPostgresDiff(cmd *cobra.Command, args []string) error {
 		Changes:   changes,
 		Summary:   summarize(changes),
 	}
+	addExplain(&result, diff)
 
 	// Determine output destination
 	var out *os.File
@@ -360,10 +773,221 @@ func runPostgresDiff(cmd *cobra.Command, args []string) error {
 	if outputJSON {
 		return outputAsJSON(out, result)
 	}
-	return outputAsText(out, result, treeA, treeB)
+	return outputAsText(out, result, diff)
 }
 
-func collectChanges(ranges []tree.KeyRange, mapA, mapB map[string]reader.Row, schema reader.Schema) []Change {
+func runSnapshot(cmd *cobra.Command, args []string) error {
+	file := args[0]
+	path := outputFile
+	if path == "" {
+		path = strings.TrimSuffix(file, filepath.Ext(file)) + ".mdt"
+	}
+
+	csv, err := reader.NewCSVReaderFromPathWithConfig(file, reader.CSVReaderConfig{
+		KeyColumns: keyColumns,
+		HasHeader:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	r := withSort(csv)
+	defer r.Close()
+
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
+	}
+	var mt *tree.MerkleTree
+	if pruneLevel > 0 {
+		mt, err = streamTree(r, treeConfig)
+	} else {
+		mt, err = tree.BuildTreeFromReaderWithConfig(r, treeConfig)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build tree for %s: %w", file, err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	if _, err := mt.WriteTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	fmt.Printf("Saved %d rows to %s\n", mt.GetRowCount(), path)
+	fmt.Printf("  Fingerprint: %s\n", mt.Fingerprint())
+	return nil
+}
+
+// streamTree builds the tree of r in bounded memory, dropping the nodes at
+// and below --prune-level as it goes. Rows must be sorted by key.
+func streamTree(r reader.RowReader, config tree.TreeConfig) (*tree.MerkleTree, error) {
+	b, err := tree.NewStreamingTreeBuilderWithConfig(0, config)
+	if err != nil {
+		return nil, err
+	}
+	b.SetPruneLevel(pruneLevel)
+	if err := b.Consume(r); err != nil {
+		if errors.Is(err, tree.ErrUnsortedInput) {
+			return nil, fmt.Errorf("%w (--prune-level needs sorted rows; add --sort)", err)
+		}
+		return nil, err
+	}
+	return b.Build()
+}
+
+func runInspect(cmd *cobra.Command, args []string) error {
+	if inspectFormat != "dot" && inspectFormat != "json" {
+		return fmt.Errorf("unknown format %q (want dot or json)", inspectFormat)
+	}
+
+	trees, err := loadTrees(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	var exported []tree.ExportedTree
+	if len(trees) == 1 {
+		exported = []tree.ExportedTree{{Name: args[0], Root: tree.ExportTree(trees[0], inspectDepth)}}
+	} else {
+		a, b, err := tree.NewDiff(trees[0], trees[1]).Export(inspectDepth)
+		if err != nil {
+			return err
+		}
+		exported = []tree.ExportedTree{{Name: args[0], Root: a}, {Name: args[1], Root: b}}
+	}
+
+	out := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if inspectFormat == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exported)
+	}
+	return tree.WriteDOT(out, exported...)
+}
+
+// RangeHashResult is the digest of a key range in one file.
+type RangeHashResult struct {
+	File   string `json:"file"`
+	Digest string `json:"digest"`
+	Rows   int    `json:"rows"`
+}
+
+func runRangeHash(cmd *cobra.Command, args []string) error {
+	trees, err := loadTrees(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	results := make([]RangeHashResult, len(trees))
+	for i, mt := range trees {
+		start, end := []byte(rangeStart), []byte(rangeEnd)
+		digest, err := mt.RangeHash(start, end)
+		if err != nil {
+			return fmt.Errorf("failed to hash range of %s: %w", args[i], err)
+		}
+		rows, err := mt.CountRange(start, end)
+		if err != nil {
+			return fmt.Errorf("failed to count rows of %s: %w", args[i], err)
+		}
+		results[i] = RangeHashResult{File: args[i], Digest: hex.EncodeToString(digest), Rows: rows}
+	}
+
+	match := true
+	for _, r := range results[1:] {
+		match = match && r.Digest == results[0].Digest
+	}
+
+	if outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			digest := r.Digest
+			if digest == "" {
+				digest = "(empty)"
+			}
+			fmt.Printf("%s  %s  (%d rows)\n", digest, r.File, r.Rows)
+		}
+		if len(results) > 1 {
+			if match {
+				fmt.Println("\n Ranges match :)")
+			} else {
+				fmt.Println("\n Ranges differ")
+			}
+		}
+	}
+
+	if !match && !exitZero {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// loadTrees loads each path as a snapshot, or builds its tree from CSV with
+// the tree flags, adjusted to match any snapshots among them.
+func loadTrees(cmd *cobra.Command, paths []string) ([]*tree.MerkleTree, error) {
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]*tree.MerkleTree, len(paths))
+	for i, path := range paths {
+		if snaps[i], err = loadSnapshot(path, treeConfig); err != nil {
+			return nil, err
+		}
+	}
+	treeConfig, err = applySnapshotConfig(cmd, treeConfig, snaps...)
+	if err != nil {
+		return nil, err
+	}
+
+	trees := make([]*tree.MerkleTree, len(paths))
+	for i, path := range paths {
+		if trees[i] = snaps[i]; trees[i] != nil {
+			continue
+		}
+		csv, err := reader.NewCSVReaderFromPathWithConfig(path, reader.CSVReaderConfig{
+			KeyColumns: keyColumns,
+			HasHeader:  true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		r := withSort(csv)
+		trees[i], err = tree.BuildTreeFromReaderWithConfig(r, treeConfig)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build tree for %s: %w", path, err)
+		}
+	}
+	return trees, nil
+}
+
+// collectChanges turns diff ranges into row-level changes. mapA or mapB is
+// nil when that side was loaded from a snapshot; see collectLeafChanges.
+func collectChanges(ranges []tree.KeyRange, treeA, treeB *tree.MerkleTree, mapA, mapB map[string]reader.Row, schema reader.Schema) []Change {
+	if mapA == nil || mapB == nil {
+		return collectLeafChanges(ranges, treeA, treeB, mapA, mapB)
+	}
+
 	processed := make(map[string]bool)
 	var changes []Change
 
@@ -416,6 +1040,103 @@ func collectChanges(ranges []tree.KeyRange, mapA, mapB map[string]reader.Row, sc
 	return changes
 }
 
+// collectLeafChanges is collectChanges for when a side has no rows. Keys are
+// taken from the trees' leaves and compared by leaf hash, so a changed row is
+// reported without field detail and values appear only from sides that have
+// rows. A range that falls in a pruned part of either tree cannot be split
+// into keys and is reported as a single range.
+func collectLeafChanges(ranges []tree.KeyRange, treeA, treeB *tree.MerkleTree, mapA, mapB map[string]reader.Row) []Change {
+	leavesA, prunedA := indexLeaves(treeA.GetRoot())
+	leavesB, prunedB := indexLeaves(treeB.GetRoot())
+	pruned := append(prunedA, prunedB...)
+
+	processed := make(map[string]bool)
+	var changes []Change
+
+	// Process diff ranges
+	for _, r := range ranges {
+		start, end := string(r.Start), string(r.End)
+		if overlapsAny(pruned, start, end) {
+			changes = append(changes, Change{
+				Type:   string(r.Type),
+				Key:    start,
+				EndKey: end,
+				Rows:   &RangeRows{Before: r.RowsA, After: r.RowsB},
+			})
+			continue
+		}
+		for _, key := range keysInRange(start, end, leavesA, leavesB) {
+			if processed[key] {
+				continue
+			}
+			processed[key] = true
+
+			hashA, inA := leavesA[key]
+			hashB, inB := leavesB[key]
+
+			switch {
+			case !inA && inB:
+				changes = append(changes, Change{Type: "added", Key: key, Values: mapB[key].Values})
+			case inA && !inB:
+				changes = append(changes, Change{Type: "removed", Key: key, Values: mapA[key].Values})
+			case inA && inB && !bytes.Equal(hashA, hashB):
+				changes = append(changes, Change{Type: "changed", Key: key, Values: mapB[key].Values})
+			}
+		}
+	}
+
+	// Check for keys on one side only that no range covered
+	for key := range leavesB {
+		if _, inA := leavesA[key]; !inA && !processed[key] && !overlapsAny(pruned, key, key) {
+			changes = append(changes, Change{Type: "added", Key: key, Values: mapB[key].Values})
+		}
+	}
+	for key := range leavesA {
+		if _, inB := leavesB[key]; !inB && !processed[key] && !overlapsAny(pruned, key, key) {
+			changes = append(changes, Change{Type: "removed", Key: key, Values: mapA[key].Values})
+		}
+	}
+
+	// Sort by key
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// indexLeaves maps each row key in a tree to its leaf hash. Pruned subtrees
+// have no leaves and are returned as key ranges instead.
+func indexLeaves(root *tree.MerkleNode) (map[string][]byte, []tree.KeyRange) {
+	leaves := make(map[string][]byte)
+	var pruned []tree.KeyRange
+	if root == nil {
+		return leaves, pruned
+	}
+
+	stack := []*tree.MerkleNode{root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		switch {
+		case !node.IsLeaf():
+			stack = append(stack, node.GetChildren()...)
+		case node.GetLevel() == 0:
+			leaves[string(node.GetStartKey())] = node.GetHash()
+		default:
+			pruned = append(pruned, tree.KeyRange{Start: node.GetStartKey(), End: node.GetEndKey()})
+		}
+	}
+	return leaves, pruned
+}
+
+// overlapsAny reports whether [start, end] overlaps any of the ranges.
+func overlapsAny(ranges []tree.KeyRange, start, end string) bool {
+	for _, r := range ranges {
+		if string(r.Start) <= end && start <= string(r.End) {
+			return true
+		}
+	}
+	return false
+}
+
 func fieldDiff(schema reader.Schema, a, b reader.Row) map[string]Field {
 	fields := make(map[string]Field)
 	for i := 0; i < len(a.Values) && i < len(b.Values); i++ {
@@ -452,7 +1173,55 @@ func outputAsJSON(out *os.File, result DiffResult) error {
 	return enc.Encode(result)
 }
 
-func outputAsText(out *os.File, result DiffResult, treeA, treeB *tree.MerkleTree) error {
+// addExplain records the traversal stats, and the path towards --explain's
+// key, when asked for.
+func addExplain(result *DiffResult, diff *tree.Diff) {
+	if !verbose && explainKey == "" {
+		return
+	}
+	stats := diff.GetStats()
+	result.Stats = &stats
+
+	if explainKey == "" {
+		return
+	}
+	for _, step := range diff.Explain([]byte(explainKey)) {
+		info := ExplainStep{Depth: step.Depth, Identical: step.Identical}
+		for _, n := range []*tree.MerkleNode{step.A, step.B} {
+			if n != nil {
+				info.StartKey = string(n.GetStartKey())
+				info.EndKey = string(n.GetEndKey())
+				break
+			}
+		}
+		switch {
+		case step.A == nil:
+			info.AbsentIn = "A"
+		case step.B == nil:
+			info.AbsentIn = "B"
+		}
+		if step.A != nil {
+			info.HashA = hex.EncodeToString(step.A.GetHash())
+		}
+		if step.B != nil {
+			info.HashB = hex.EncodeToString(step.B.GetHash())
+		}
+		result.Explain = append(result.Explain, info)
+	}
+}
+
+// describeNode summarizes a node as its short hash and key range.
+func describeNode(n *tree.MerkleNode) string {
+	if n == nil {
+		return "(none)"
+	}
+	return fmt.Sprintf("%s... (keys %s --> %s)",
+		hex.EncodeToString(n.GetHash())[:16], string(n.GetStartKey()), string(n.GetEndKey()))
+}
+
+func outputAsText(out *os.File, result DiffResult, diff *tree.Diff) error {
+	treeA, treeB := diff.GetTreeA(), diff.GetTreeB()
+
 	// Quiet mode: only output the summary line
 	if quiet {
 		if result.Identical {
@@ -475,17 +1244,43 @@ func outputAsText(out *os.File, result DiffResult, treeA, treeB *tree.MerkleTree
 		fmt.Fprintf(out, "  %-20s %s\n", col.Name, col.Type)
 	}
 
-	if verbose {
-		rootA, rootB := treeA.GetRoot(), treeB.GetRoot()
+	if verbose || explainKey != "" {
 		fmt.Fprintln(out, "\n────────────────────────")
 		fmt.Fprintln(out, "  Merkle Trees Details")
 		fmt.Fprintln(out, "────────────────────────")
-		fmt.Fprintf(out, "  Tree A: %s... (keys %s --> %s)\n",
-			hex.EncodeToString(rootA.GetHash())[:16],
-			string(rootA.GetStartKey()), string(rootA.GetEndKey()))
-		fmt.Fprintf(out, "  Tree B: %s... (keys %s --> %s)\n",
-			hex.EncodeToString(rootB.GetHash())[:16],
-			string(rootB.GetStartKey()), string(rootB.GetEndKey()))
+		fmt.Fprintf(out, "  Tree A: %s\n", describeNode(treeA.GetRoot()))
+		fmt.Fprintf(out, "  Tree B: %s\n", describeNode(treeB.GetRoot()))
+		fmt.Fprintf(out, "  Format: %s, hash %s, fanout %d\n",
+			treeA.GetConfig().Format, treeA.GetConfig().Hasher.Name(), treeA.GetConfig().Fanout)
+
+		stats := result.Stats
+		fmt.Fprintf(out, "  Visited %d nodes to depth %d, pruned %d identical subtrees\n",
+			stats.NodesVisited, stats.MaxDepth, stats.SubtreesPruned)
+		fmt.Fprintf(out, "  Compared %d leaf pairs, found %d differing ranges\n",
+			stats.LeafComparisons, stats.RangesEmitted)
+	}
+
+	if explainKey != "" {
+		fmt.Fprintln(out, "\n────────────────────────")
+		fmt.Fprintf(out, "  Path to key %q\n", explainKey)
+		fmt.Fprintln(out, "────────────────────────")
+		steps := diff.Explain([]byte(explainKey))
+		for i, step := range steps {
+			verdict := "differs, descending"
+			switch {
+			case step.Identical:
+				verdict = "identical, pruned"
+			case step.A == nil:
+				verdict = "absent in A"
+			case step.B == nil:
+				verdict = "absent in B"
+			case i == len(steps)-1:
+				verdict = "differs"
+			}
+			fmt.Fprintf(out, "  Depth %d: %s\n", step.Depth, verdict)
+			fmt.Fprintf(out, "    A: %s\n", describeNode(step.A))
+			fmt.Fprintf(out, "    B: %s\n", describeNode(step.B))
+		}
 	}
 
 	fmt.Fprintln(out, "\n─────────────")
@@ -504,20 +1299,7 @@ func outputAsText(out *os.File, result DiffResult, treeA, treeB *tree.MerkleTree
 		}
 
 		for i := 0; i < showCount; i++ {
-			c := result.Changes[i]
-			switch c.Type {
-			case "added":
-				fmt.Fprintf(out, "\n| Row: %d | ADDED key %q\n", i+1, c.Key)
-				fmt.Fprintf(out, "      --> %v\n", c.Values)
-			case "removed":
-				fmt.Fprintf(out, "\n| Row: %d | REMOVED key %q\n", i+1, c.Key)
-				fmt.Fprintf(out, "      --> %v\n", c.Values)
-			case "changed":
-				fmt.Fprintf(out, "\n| Row: %d | CHANGED key %q\n", i+1, c.Key)
-				for name, f := range c.Fields {
-					fmt.Fprintf(out, "      --> %s: From %v :: To %v\n", name, f.From, f.To)
-				}
-			}
+			outputChange(out, i, result.Changes[i])
 		}
 
 		if truncated {
@@ -543,7 +1325,57 @@ func outputAsText(out *os.File, result DiffResult, treeA, treeB *tree.MerkleTree
 	return nil
 }
 
+// outputChange writes the i-th change of a text report.
+func outputChange(out *os.File, i int, c Change) {
+	if c.EndKey != "" {
+		fmt.Fprintf(out, "\n| Row: %d | %s range %q --> %q (rows not available)\n",
+			i+1, strings.ToUpper(c.Type), c.Key, c.EndKey)
+		if c.Rows != nil {
+			fmt.Fprintf(out, "      --> %d rows before, %d after\n", c.Rows.Before, c.Rows.After)
+		}
+		return
+	}
+	fmt.Fprintf(out, "\n| Row: %d | %s key %q\n", i+1, strings.ToUpper(c.Type), c.Key)
+	switch {
+	case c.Type == "changed" && c.Fields == nil && c.Values != nil:
+		fmt.Fprintf(out, "      --> now %v (previous values not available)\n", c.Values)
+	case c.Type == "changed":
+		for name, f := range c.Fields {
+			fmt.Fprintf(out, "      --> %s: From %v :: To %v\n", name, f.From, f.To)
+		}
+	case c.Values != nil:
+		fmt.Fprintf(out, "      --> %v\n", c.Values)
+	}
+}
+
 // Helper functions
+func buildTreeConfig() (tree.TreeConfig, error) {
+	config := tree.DefaultTreeConfig()
+
+	shape, err := tree.ParseTreeShape(treeShape)
+	if err != nil {
+		return config, err
+	}
+	config.Shape = shape
+
+	key := hashKey
+	if key == "" {
+		key = os.Getenv("MERKLEDIFF_HASH_KEY")
+	}
+	h, err := hasher.New(hashName, []byte(key))
+	if errors.Is(err, hasher.ErrKeyRequired) {
+		return config, fmt.Errorf("%w (set --hash-key or $MERKLEDIFF_HASH_KEY)", err)
+	}
+	if err != nil {
+		return config, err
+	}
+	config.Hasher = h
+	config.Fanout = fanout
+	config.Workers = workers
+
+	return config, nil
+}
+
 func toTreeRows(rows []reader.Row) []tree.Row {
 	result := make([]tree.Row, len(rows))
 	for i, r := range rows {
@@ -552,6 +1384,17 @@ func toTreeRows(rows []reader.Row) []tree.Row {
 	return result
 }
 
+// withSort wraps r in an external sort when --sort is set.
+func withSort(r reader.RowReader) reader.RowReader {
+	if !sortInput {
+		return r
+	}
+	config := reader.DefaultSortConfig()
+	config.MemoryLimit = int64(sortMemory) << 20
+	config.TempDir = tempDir
+	return reader.NewSortedReader(r, config)
+}
+
 func buildRowMap(rows []reader.Row) map[string]reader.Row {
 	m := make(map[string]reader.Row)
 	for _, r := range rows {
@@ -560,7 +1403,7 @@ func buildRowMap(rows []reader.Row) map[string]reader.Row {
 	return m
 }
 
-func keysInRange(start, end string, mapA, mapB map[string]reader.Row) []string {
+func keysInRange[V any](start, end string, mapA, mapB map[string]V) []string {
 	seen := make(map[string]bool)
 	var keys []string
 	for k := range mapA {
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/reader"
+	"github.com/BryceDouglasJames/merklediff/pkg/tree"
+)
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge <base> <ours> <theirs>",
+	Short: "Three-way compare two edited copies of a file against their base",
+	Long: `Compare two edited copies of a CSV file against the base they were both
+derived from, and classify every changed key as changed in ours, changed in
+theirs, changed identically in both, or conflicting.
+
+For conflicting rows each changed field is listed with its base, ours and
+theirs values, and fields changed differently on both sides are marked as
+conflicts. Exits 1 if there are conflicts.
+
+Examples:
+  merklediff merge base.csv ours.csv theirs.csv
+  merklediff merge --json --key 0,1 base.csv alice.csv bob.csv`,
+	Args: cobra.ExactArgs(3),
+	RunE: runMerge,
+}
+
+// MergeResult represents the output of a three-way merge
+type MergeResult struct {
+	Base    string        `json:"base"`
+	Ours    string        `json:"ours"`
+	Theirs  string        `json:"theirs"`
+	Changes []MergeChange `json:"changes"`
+	Summary MergeSummary  `json:"summary"`
+}
+
+// MergeChange is a key changed on at least one side. Values are nil where
+// the side does not hold the key, which Absent lists, or where the side was
+// loaded from a snapshot.
+type MergeChange struct {
+	Kind   string                `json:"kind"` // "ours", "theirs", "both", "conflict"
+	Key    string                `json:"key"`
+	Absent []string              `json:"absent_from,omitempty"`
+	Base   []any                 `json:"base,omitempty"`
+	Ours   []any                 `json:"ours,omitempty"`
+	Theirs []any                 `json:"theirs,omitempty"`
+	Fields map[string]MergeField `json:"fields,omitempty"`
+}
+
+// MergeField is a field of a conflicting row changed on either side.
+type MergeField struct {
+	Base     any  `json:"base"`
+	Ours     any  `json:"ours"`
+	Theirs   any  `json:"theirs"`
+	Conflict bool `json:"conflict"`
+}
+
+type MergeSummary struct {
+	Ours      int `json:"ours"`
+	Theirs    int `json:"theirs"`
+	Both      int `json:"both"`
+	Conflicts int `json:"conflicts"`
+	Total     int `json:"total"`
+}
+
+func runMerge(cmd *cobra.Command, args []string) error {
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
+	}
+
+	snaps := make([]*tree.MerkleTree, len(args))
+	for i, path := range args {
+		if snaps[i], err = loadSnapshot(path, treeConfig); err != nil {
+			return err
+		}
+	}
+	treeConfig, err = applySnapshotConfig(cmd, treeConfig, snaps...)
+	if err != nil {
+		return err
+	}
+
+	sides := make([]diffSide, len(args))
+	for i, path := range args {
+		if sides[i], err = loadDiffSide(path, snaps[i], treeConfig); err != nil {
+			return err
+		}
+	}
+	schema := sides[0].schema
+	for _, side := range sides[1:] {
+		if len(schema.Columns) == 0 {
+			schema = side.schema
+		}
+	}
+
+	merge := tree.NewMerge(sides[0].tree, sides[1].tree, sides[2].tree)
+	merge.SetConcurrency(workers)
+	if err := merge.Compare(cmd.Context()); err != nil {
+		return fmt.Errorf("failed to compare: %w", err)
+	}
+
+	result := MergeResult{Base: args[0], Ours: args[1], Theirs: args[2], Changes: []MergeChange{}}
+	maps := [3]map[string]reader.Row{sides[0].rowMap(), sides[1].rowMap(), sides[2].rowMap()}
+	for _, c := range merge.GetChanges() {
+		result.Changes = append(result.Changes, describeMergeChange(c, maps, schema))
+	}
+	result.Summary = summarizeMerge(result.Changes)
+
+	out := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if outputJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		outputMergeAsText(out, result)
+	}
+
+	if result.Summary.Conflicts > 0 && !exitZero {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// describeMergeChange adds each side's values to a changed key, and field
+// detail to a conflict between two edited rows.
+func describeMergeChange(c tree.MergeChange, maps [3]map[string]reader.Row, schema reader.Schema) MergeChange {
+	key := string(c.Key)
+	change := MergeChange{Kind: string(c.Kind), Key: key}
+
+	var rows [3]*reader.Row
+	for i, leaf := range []*tree.MerkleNode{c.Base, c.Ours, c.Theirs} {
+		if leaf == nil {
+			change.Absent = append(change.Absent, mergeSides[i])
+		} else if row, ok := maps[i][key]; ok {
+			rows[i] = &row
+		}
+	}
+	if rows[0] != nil {
+		change.Base = rows[0].Values
+	}
+	if rows[1] != nil {
+		change.Ours = rows[1].Values
+	}
+	if rows[2] != nil {
+		change.Theirs = rows[2].Values
+	}
+
+	if c.Kind == tree.MergeConflict && rows[0] != nil && rows[1] != nil && rows[2] != nil {
+		change.Fields = mergeFields(schema, *rows[0], *rows[1], *rows[2])
+	}
+	return change
+}
+
+// mergeFields returns the fields changed on either side. A field is a
+// conflict if both sides changed it to different values.
+func mergeFields(schema reader.Schema, base, ours, theirs reader.Row) map[string]MergeField {
+	fields := make(map[string]MergeField)
+	n := min(len(base.Values), len(ours.Values), len(theirs.Values))
+	for i := range n {
+		b := fmt.Sprintf("%v", base.Values[i])
+		o := fmt.Sprintf("%v", ours.Values[i])
+		t := fmt.Sprintf("%v", theirs.Values[i])
+		if o == b && t == b {
+			continue
+		}
+		name := fmt.Sprintf("col%d", i)
+		if i < len(schema.Columns) {
+			name = schema.Columns[i].Name
+		}
+		fields[name] = MergeField{
+			Base:     base.Values[i],
+			Ours:     ours.Values[i],
+			Theirs:   theirs.Values[i],
+			Conflict: o != b && t != b && o != t,
+		}
+	}
+	return fields
+}
+
+func summarizeMerge(changes []MergeChange) MergeSummary {
+	var s MergeSummary
+	for _, c := range changes {
+		switch tree.MergeKind(c.Kind) {
+		case tree.MergeOurs:
+			s.Ours++
+		case tree.MergeTheirs:
+			s.Theirs++
+		case tree.MergeBoth:
+			s.Both++
+		case tree.MergeConflict:
+			s.Conflicts++
+		}
+	}
+	s.Total = len(changes)
+	return s
+}
+
+func outputMergeAsText(out *os.File, result MergeResult) {
+	summary := fmt.Sprintf("%d ours, %d theirs, %d both, %d conflicts (%d total)",
+		result.Summary.Ours, result.Summary.Theirs, result.Summary.Both, result.Summary.Conflicts, result.Summary.Total)
+	if quiet {
+		fmt.Fprintln(out, summary)
+		return
+	}
+
+	fmt.Fprintf(out, "\n  Base:   %s\n", result.Base)
+	fmt.Fprintf(out, "  Ours:   %s\n", result.Ours)
+	fmt.Fprintf(out, "  Theirs: %s\n", result.Theirs)
+
+	fmt.Fprintln(out, "\n─────────────")
+	fmt.Fprintln(out, "  Changes")
+	fmt.Fprintln(out, "─────────────")
+
+	if len(result.Changes) == 0 {
+		fmt.Fprintln(out, "\n No changes since the base :)")
+	}
+
+	showCount := len(result.Changes)
+	if limit > 0 && showCount > limit {
+		showCount = limit
+	}
+	for i, c := range result.Changes[:showCount] {
+		fmt.Fprintf(out, "\n| Row: %d | %s key %q\n", i+1, strings.ToUpper(c.Kind), c.Key)
+		for j, values := range [][]any{c.Base, c.Ours, c.Theirs} {
+			fmt.Fprintf(out, "      %-6s --> %s\n", mergeSides[j], describeValues(c, mergeSides[j], values))
+		}
+		for name, f := range c.Fields {
+			marker := ""
+			if f.Conflict {
+				marker = "  (conflict)"
+			}
+			fmt.Fprintf(out, "      --> %s: Base %v :: Ours %v :: Theirs %v%s\n", name, f.Base, f.Ours, f.Theirs, marker)
+		}
+	}
+	if showCount < len(result.Changes) {
+		fmt.Fprintf(out, "\n  ... and %d more changes (use --output to write all to file)\n",
+			len(result.Changes)-showCount)
+	}
+
+	fmt.Fprintln(out, "\n───────────────────────────────────────────────────────────────")
+	fmt.Fprintf(out, "  Summary: %s\n", summary)
+	fmt.Fprintln(out, "───────────────────────────────────────────────────────────────")
+
+	if outputFile != "" {
+		fmt.Printf("Results written to: %s\n", outputFile)
+	}
+}
+
+// mergeSides names the inputs of a merge, in order.
+var mergeSides = [3]string{"base", "ours", "theirs"}
+
+// describeValues renders one side's values of a change.
+func describeValues(c MergeChange, side string, values []any) string {
+	switch {
+	case slices.Contains(c.Absent, side):
+		return "(absent)"
+	case values == nil:
+		return "(values not available)"
+	}
+	return fmt.Sprintf("%v", values)
+}
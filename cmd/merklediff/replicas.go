@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/reader"
+	"github.com/BryceDouglasJames/merklediff/pkg/tree"
+)
+
+var replicasCmd = &cobra.Command{
+	Use:   "replicas <file> <file> <file> [<file>...]",
+	Short: "Compare three or more copies of a file to find the ones that diverged",
+	Long: `Compare three or more copies of the same data, such as a source table's
+export and its replicas, at once. For every key on which they disagree,
+report which copies agree with the majority and which are outliers, so a
+broken replica can be found in one run. Exits 1 if any copies disagree.
+
+Examples:
+  merklediff replicas source.csv replica1.csv replica2.csv replica3.csv
+  merklediff replicas --json --sort primary.mdt east.csv west.csv`,
+	Args: cobra.MinimumNArgs(3),
+	RunE: runReplicas,
+}
+
+// ReplicaResult represents the output of a replica comparison
+type ReplicaResult struct {
+	Sources    []ReplicaSource `json:"sources"`
+	Keys       []DivergentKey  `json:"keys"`
+	NoMajority int             `json:"no_majority"`
+}
+
+// ReplicaSource is one input, with the number of keys on which it is an
+// outlier.
+type ReplicaSource struct {
+	File     string `json:"file"`
+	Rows     int    `json:"rows"`
+	Outliers int    `json:"outliers"`
+}
+
+// DivergentKey is a key the sources disagree on. Groups[0] is the majority
+// version when Majority is set.
+type DivergentKey struct {
+	Key      string         `json:"key"`
+	Majority bool           `json:"majority"`
+	Outliers []string       `json:"outliers,omitempty"`
+	Groups   []ReplicaGroup `json:"groups"`
+}
+
+// ReplicaGroup is a set of sources holding the same version of a row.
+// Values are nil if the sources do not hold the key, or were all loaded
+// from snapshots.
+type ReplicaGroup struct {
+	Sources []string `json:"sources"`
+	Absent  bool     `json:"absent,omitempty"`
+	Values  []any    `json:"values,omitempty"`
+}
+
+func runReplicas(cmd *cobra.Command, args []string) error {
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
+	}
+
+	snaps := make([]*tree.MerkleTree, len(args))
+	for i, path := range args {
+		if snaps[i], err = loadSnapshot(path, treeConfig); err != nil {
+			return err
+		}
+	}
+	treeConfig, err = applySnapshotConfig(cmd, treeConfig, snaps...)
+	if err != nil {
+		return err
+	}
+
+	sides := make([]diffSide, len(args))
+	trees := make([]*tree.MerkleTree, len(args))
+	maps := make([]map[string]reader.Row, len(args))
+	for i, path := range args {
+		if sides[i], err = loadDiffSide(path, snaps[i], treeConfig); err != nil {
+			return err
+		}
+		trees[i], maps[i] = sides[i].tree, sides[i].rowMap()
+	}
+
+	multi := tree.NewMultiDiff(trees...)
+	multi.SetConcurrency(workers)
+	if err := multi.Compare(cmd.Context()); err != nil {
+		return fmt.Errorf("failed to compare: %w", err)
+	}
+
+	result := ReplicaResult{Keys: []DivergentKey{}}
+	for i, path := range args {
+		result.Sources = append(result.Sources, ReplicaSource{File: path, Rows: trees[i].GetRowCount()})
+	}
+	for _, d := range multi.GetDivergences() {
+		key := DivergentKey{Key: string(d.Key), Majority: d.Majority}
+		for _, i := range d.Outliers {
+			key.Outliers = append(key.Outliers, args[i])
+			result.Sources[i].Outliers++
+		}
+		if !d.Majority {
+			result.NoMajority++
+		}
+		for _, g := range d.Groups {
+			key.Groups = append(key.Groups, replicaGroup(g, key.Key, args, maps))
+		}
+		result.Keys = append(result.Keys, key)
+	}
+
+	out := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if outputJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		outputReplicasAsText(out, result)
+	}
+
+	if len(result.Keys) > 0 && !exitZero {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// replicaGroup names a group's sources and takes its values from the first
+// of them with rows.
+func replicaGroup(g tree.VersionGroup, key string, args []string, maps []map[string]reader.Row) ReplicaGroup {
+	group := ReplicaGroup{Absent: g.Leaf == nil}
+	for _, i := range g.Trees {
+		group.Sources = append(group.Sources, args[i])
+		if row, ok := maps[i][key]; ok && group.Values == nil && !group.Absent {
+			group.Values = row.Values
+		}
+	}
+	return group
+}
+
+func outputReplicasAsText(out *os.File, result ReplicaResult) {
+	var worst []string
+	for _, s := range result.Sources {
+		if s.Outliers > 0 {
+			worst = append(worst, fmt.Sprintf("%s on %d", s.File, s.Outliers))
+		}
+	}
+	summary := fmt.Sprintf("%d divergent keys, %d without a majority", len(result.Keys), result.NoMajority)
+	if len(worst) > 0 {
+		summary += "; outliers: " + strings.Join(worst, ", ")
+	}
+	if quiet {
+		fmt.Fprintln(out, summary)
+		return
+	}
+
+	fmt.Fprintln(out)
+	for i, s := range result.Sources {
+		fmt.Fprintf(out, "  [%d] %s (%d rows, outlier on %d keys)\n", i+1, s.File, s.Rows, s.Outliers)
+	}
+
+	fmt.Fprintln(out, "\n──────────────────")
+	fmt.Fprintln(out, "  Divergent Keys")
+	fmt.Fprintln(out, "──────────────────")
+
+	if len(result.Keys) == 0 {
+		fmt.Fprintln(out, "\n All copies are identical :)")
+	}
+
+	showCount := len(result.Keys)
+	if limit > 0 && showCount > limit {
+		showCount = limit
+	}
+	for _, k := range result.Keys[:showCount] {
+		verdict := "no majority"
+		if k.Majority {
+			verdict = "outliers: " + strings.Join(k.Outliers, ", ")
+		}
+		fmt.Fprintf(out, "\n| Key %q | %s\n", k.Key, verdict)
+		for j, g := range k.Groups {
+			label := "      "
+			if j == 0 && k.Majority {
+				label = "    * "
+			}
+			values := fmt.Sprintf("%v", g.Values)
+			switch {
+			case g.Absent:
+				values = "(absent)"
+			case g.Values == nil:
+				values = "(values not available)"
+			}
+			fmt.Fprintf(out, "%s%s --> %s\n", label, strings.Join(g.Sources, ", "), values)
+		}
+	}
+	if showCount < len(result.Keys) {
+		fmt.Fprintf(out, "\n  ... and %d more keys (use --output to write all to file)\n",
+			len(result.Keys)-showCount)
+	}
+
+	fmt.Fprintln(out, "\n───────────────────────────────────────────────────────────────")
+	fmt.Fprintf(out, "  Summary: %s\n", summary)
+	fmt.Fprintln(out, "───────────────────────────────────────────────────────────────")
+
+	if outputFile != "" {
+		fmt.Printf("Results written to: %s\n", outputFile)
+	}
+}
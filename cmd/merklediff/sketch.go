@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/reader"
+	"github.com/BryceDouglasJames/merklediff/pkg/tree"
+)
+
+var sketchCmd = &cobra.Command{
+	Use:   "sketch <file>",
+	Short: "Save a compact sketch of a file for reconciling with a remote copy",
+	Long: `Build an invertible Bloom lookup table of a CSV file or snapshot's rows
+and save it. The sketch's size depends on --max-diff, the number of keys
+expected to differ, rather than on the number of rows, so it can be sent
+to the holder of another copy, who recovers the differing keys with
+'merklediff reconcile' in a single exchange.
+
+Examples:
+  merklediff sketch users.csv
+  merklediff sketch --max-diff 5000 --output users-east.mdsk users.csv`,
+	Args: cobra.ExactArgs(1),
+	RunE: runSketch,
+}
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile <file-a> <file-b>",
+	Short: "Recover the keys that differ between two sketches or files",
+	Long: `Recover the keys whose rows differ between two copies of a dataset, each
+given as a sketch or as a CSV file or snapshot, which is sketched to match
+the other side. A sketch's hash function is used unless --hash is given.
+
+Reconciling fails if more keys differ than the sketches have room for;
+sketch again with a larger --max-diff. Exits 1 if any keys differ.
+
+Examples:
+  merklediff reconcile users-east.mdsk users.csv
+  merklediff reconcile --json east.mdsk west.mdsk`,
+	Args: cobra.ExactArgs(2),
+	RunE: runReconcile,
+}
+
+// ReconcileResult represents the output of reconciling two sketches
+type ReconcileResult struct {
+	FileA     string      `json:"file_a"`
+	FileB     string      `json:"file_b"`
+	RowCountA int         `json:"rows_a"`
+	RowCountB int         `json:"rows_b"`
+	Cells     int         `json:"cells"`
+	Identical bool        `json:"identical"`
+	Changes   []Change    `json:"changes,omitempty"`
+	Summary   DiffSummary `json:"summary"`
+}
+
+func runSketch(cmd *cobra.Command, args []string) error {
+	file := args[0]
+	path := outputFile
+	if path == "" {
+		path = strings.TrimSuffix(file, filepath.Ext(file)) + ".mdsk"
+	}
+
+	trees, err := loadTrees(cmd, args)
+	if err != nil {
+		return err
+	}
+	sketch, err := tree.NewSketch(trees[0], tree.SketchCells(maxDiff))
+	if err != nil {
+		return fmt.Errorf("failed to sketch %s: %w", file, err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create sketch file: %w", err)
+	}
+	n, err := sketch.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write sketch: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write sketch: %w", err)
+	}
+
+	fmt.Printf("Sketched %d rows to %s\n", sketch.Rows(), path)
+	fmt.Printf("  %d cells, %d bytes, recovers up to about %d differing keys\n", sketch.Cells(), n, maxDiff)
+	return nil
+}
+
+func runReconcile(cmd *cobra.Command, args []string) error {
+	var err error
+	sketches := make([]*tree.Sketch, len(args))
+	for i, path := range args {
+		if sketches[i], err = loadSketch(path); err != nil {
+			return err
+		}
+	}
+
+	// Files are sketched to match the other side's sketch, if there is one
+	cells := tree.SketchCells(maxDiff)
+	for _, s := range sketches {
+		if s != nil {
+			cells = s.Cells()
+			if !cmd.Flags().Changed("hash") {
+				hashName = s.Hasher()
+			}
+		}
+	}
+
+	treeConfig, err := buildTreeConfig()
+	if err != nil {
+		return err
+	}
+	snaps := make([]*tree.MerkleTree, len(args))
+	for i, path := range args {
+		if sketches[i] != nil {
+			continue
+		}
+		if snaps[i], err = loadSnapshot(path, treeConfig); err != nil {
+			return err
+		}
+	}
+	treeConfig, err = applySnapshotConfig(cmd, treeConfig, snaps...)
+	if err != nil {
+		return err
+	}
+
+	sides := make([]diffSide, len(args))
+	maps := make([]map[string]reader.Row, len(args))
+	for i, path := range args {
+		if sketches[i] != nil {
+			continue
+		}
+		if sides[i], err = loadDiffSide(path, snaps[i], treeConfig); err != nil {
+			return err
+		}
+		if sketches[i], err = tree.NewSketch(sides[i].tree, cells); err != nil {
+			return fmt.Errorf("failed to sketch %s: %w", path, err)
+		}
+		maps[i] = sides[i].rowMap()
+	}
+	schema := sides[0].schema
+	if len(schema.Columns) == 0 {
+		schema = sides[1].schema
+	}
+
+	ranges, err := sketches[0].Reconcile(sketches[1])
+	if errors.Is(err, tree.ErrSketchOverflow) {
+		return fmt.Errorf("failed to reconcile: %w (sketch again with a larger --max-diff)", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reconcile: %w", err)
+	}
+
+	result := ReconcileResult{
+		FileA:     args[0],
+		FileB:     args[1],
+		RowCountA: sketches[0].Rows(),
+		RowCountB: sketches[1].Rows(),
+		Cells:     sketches[0].Cells(),
+		Identical: len(ranges) == 0,
+	}
+	for _, r := range ranges {
+		result.Changes = append(result.Changes, reconciledChange(r, maps[0], maps[1], schema))
+	}
+	result.Summary = summarize(result.Changes)
+
+	out := os.Stdout
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if outputJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		outputReconcileAsText(out, result)
+	}
+
+	if !result.Identical && !exitZero {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// loadSketch reads path as a sketch. It returns nil if path is not a sketch.
+func loadSketch(path string) (*tree.Sketch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(tree.SketchMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != tree.SketchMagic {
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	s, err := tree.ReadSketch(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load sketch %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// reconciledChange turns a recovered key into a change, with values from
+// whichever sides were read from CSV.
+func reconciledChange(r tree.KeyRange, mapA, mapB map[string]reader.Row, schema reader.Schema) Change {
+	key := string(r.Start)
+	change := Change{Type: string(r.Type), Key: key}
+	rowA, okA := mapA[key]
+	rowB, okB := mapB[key]
+	switch {
+	case okA && okB:
+		change.Fields = fieldDiff(schema, rowA, rowB)
+	case okB:
+		change.Values = rowB.Values
+	case okA && r.Type == tree.DiffTypeRemoved:
+		change.Values = rowA.Values
+	}
+	return change
+}
+
+func outputReconcileAsText(out *os.File, result ReconcileResult) {
+	summary := fmt.Sprintf("%d added, %d removed, %d changed (%d total)",
+		result.Summary.Added, result.Summary.Removed, result.Summary.Changed, result.Summary.Total)
+	if quiet {
+		if result.Identical {
+			summary = "identical"
+		}
+		fmt.Fprintln(out, summary)
+		return
+	}
+
+	fmt.Fprintf(out, "\n  File A: %s (%d rows)\n", result.FileA, result.RowCountA)
+	fmt.Fprintf(out, "  File B: %s (%d rows)\n", result.FileB, result.RowCountB)
+	fmt.Fprintf(out, "  Sketch: %d cells\n", result.Cells)
+
+	fmt.Fprintln(out, "\n─────────────")
+	fmt.Fprintln(out, "  Changes")
+	fmt.Fprintln(out, "─────────────")
+
+	if result.Identical {
+		fmt.Fprintln(out, "\n Files are identical :)")
+	}
+
+	showCount := len(result.Changes)
+	if limit > 0 && showCount > limit {
+		showCount = limit
+	}
+	for i, c := range result.Changes[:showCount] {
+		outputChange(out, i, c)
+	}
+	if showCount < len(result.Changes) {
+		fmt.Fprintf(out, "\n  ... and %d more changes (use --output to write all to file)\n",
+			len(result.Changes)-showCount)
+	}
+
+	fmt.Fprintln(out, "\n───────────────────────────────────────────────────────────────")
+	fmt.Fprintf(out, "  Summary: %s\n", summary)
+	fmt.Fprintln(out, "───────────────────────────────────────────────────────────────")
+
+	if outputFile != "" {
+		fmt.Printf("Results written to: %s\n", outputFile)
+	}
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// ContentChunker splits data at content-defined boundaries using a Gear
+// rolling hash with FastCDC's normalized chunking. A boundary depends only on
+// the 64 bytes before it, so inserting or deleting bytes changes the chunks
+// around the edit and leaves the rest of the file's chunks as they were.
+type ContentChunker struct {
+	config ChunkerConfig
+
+	// maskSmall is checked before the average size and has more bits set,
+	// making early cuts rarer; maskLarge is checked after it and makes cuts
+	// likelier, pulling chunk sizes towards the average.
+	maskSmall uint64
+	maskLarge uint64
+}
+
+// ChunkerConfig sets the chunk sizes of a ContentChunker, in bytes.
+type ChunkerConfig struct {
+	// MinSize is the smallest chunk cut, except for the last one.
+	MinSize int
+
+	// AvgSize is the chunk size aimed for, rounded down to a power of two.
+	AvgSize int
+
+	// MaxSize is the largest chunk; data without a boundary is cut here.
+	MaxSize int
+}
+
+// DefaultChunkerConfig returns 2 KiB minimum, 8 KiB average and 64 KiB
+// maximum chunk sizes.
+func DefaultChunkerConfig() ChunkerConfig {
+	return ChunkerConfig{MinSize: 2 << 10, AvgSize: 8 << 10, MaxSize: 64 << 10}
+}
+
+// Validate reports whether the sizes can be used to chunk data.
+func (c ChunkerConfig) Validate() error {
+	if c.MinSize <= 0 || c.MinSize > c.AvgSize || c.AvgSize > c.MaxSize {
+		return fmt.Errorf("chunk sizes must satisfy 0 < min <= avg <= max, got %d, %d, %d",
+			c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	if c.AvgSize < 4 {
+		return fmt.Errorf("average chunk size %d too small", c.AvgSize)
+	}
+	return nil
+}
+
+// NewContentChunker returns a content-defined chunker with the default sizes.
+func NewContentChunker() *ContentChunker {
+	c, _ := NewContentChunkerWithConfig(DefaultChunkerConfig())
+	return c
+}
+
+// NewContentChunkerWithConfig returns a content-defined chunker with the
+// given sizes.
+func NewContentChunkerWithConfig(config ChunkerConfig) (*ContentChunker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	// The hash shifts left, so its high bits depend on the most bytes
+	avgBits := bits.Len(uint(config.AvgSize)) - 1
+	return &ContentChunker{
+		config:    config,
+		maskSmall: ^uint64(0) << (64 - (avgBits + 1)),
+		maskLarge: ^uint64(0) << (64 - (avgBits - 1)),
+	}, nil
+}
+
+// Config returns the chunker's sizes.
+func (c *ContentChunker) Config() ChunkerConfig {
+	return c.config
+}
+
+// Chunk splits data into content-defined chunks. The chunks are subslices
+// of data, in order.
+func (c *ContentChunker) Chunk(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := c.Cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// MaxChunkSize returns the chunker's MaxSize.
+func (c *ContentChunker) MaxChunkSize() int {
+	return c.config.MaxSize
+}
+
+// Cut returns the length of the first chunk of data. It is less than
+// len(data) only at a boundary, so a caller reading a stream can cut chunks
+// as long as it holds at least MaxSize bytes or has reached the end.
+func (c *ContentChunker) Cut(data []byte) int {
+	n := len(data)
+	if n <= c.config.MinSize {
+		return n
+	}
+	n = min(n, c.config.MaxSize)
+	normal := min(n, c.config.AvgSize)
+
+	// Bytes before MinSize cannot end a chunk, so they are not hashed
+	var hash uint64
+	i := c.config.MinSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if hash&c.maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gear maps each byte to a random 64-bit value. It is generated with
+// SplitMix64 from a fixed seed rather than math/rand, whose sequence may
+// change between Go releases and would move every boundary.
+var gear = func() (table [256]uint64) {
+	state := uint64(0x6d65726b6c656469) // "merkledi"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
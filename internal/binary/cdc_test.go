@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+)
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	r := rand.New(rand.NewPCG(7, 11))
+	for i := range data {
+		data[i] = byte(r.Uint32())
+	}
+	return data
+}
+
+func TestContentChunker_Reassembles(t *testing.T) {
+	data := randomData(1 << 20)
+	c := NewContentChunker()
+	config := c.Config()
+
+	chunks := c.Chunk(data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("expected chunks to concatenate to the original data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > config.MaxSize || (len(chunk) < config.MinSize && i < len(chunks)-1) {
+			t.Fatalf("chunk %d has size %d outside [%d, %d]", i, len(chunk), config.MinSize, config.MaxSize)
+		}
+	}
+
+	// Normalized chunking keeps the average near AvgSize
+	avg := len(data) / len(chunks)
+	if avg < config.AvgSize/2 || avg > config.AvgSize*2 {
+		t.Fatalf("expected an average chunk size near %d, got %d", config.AvgSize, avg)
+	}
+}
+
+func TestContentChunker_EmptyData(t *testing.T) {
+	if chunks := NewContentChunker().Chunk(nil); chunks != nil {
+		t.Fatalf("expected nil for empty data, got %v", chunks)
+	}
+}
+
+func TestContentChunker_InsertIsLocal(t *testing.T) {
+	data := randomData(1 << 20)
+	edited := append([]byte{0x42}, data...)
+	c := NewContentChunker()
+
+	before := make(map[string]bool)
+	for _, chunk := range c.Chunk(data) {
+		before[string(chunk)] = true
+	}
+	after := c.Chunk(edited)
+	changed := 0
+	for _, chunk := range after {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("expected a one-byte insert to change at most 2 of %d chunks, changed %d", len(after), changed)
+	}
+
+	// Fixed-size chunks all shift
+	fixed := NewChunker(8 << 10)
+	before = make(map[string]bool)
+	for _, chunk := range fixed.Chunk(data) {
+		before[string(chunk)] = true
+	}
+	for _, chunk := range fixed.Chunk(edited) {
+		if before[string(chunk)] {
+			t.Fatal("expected no fixed-size chunk to survive a one-byte insert")
+		}
+	}
+}
+
+func TestContentChunker_NoBoundary(t *testing.T) {
+	c, err := NewContentChunkerWithConfig(ChunkerConfig{MinSize: 64, AvgSize: 256, MaxSize: 1024})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if n := c.Cut(make([]byte, 5000)); n > 1024 {
+		t.Fatalf("expected a cut at most 1024 bytes in, got %d", n)
+	}
+	if n := c.Cut(make([]byte, 50)); n != 50 {
+		t.Fatalf("expected data below MinSize to be one chunk, got %d", n)
+	}
+}
+
+func TestContentChunker_InvalidConfig(t *testing.T) {
+	for _, config := range []ChunkerConfig{
+		{MinSize: 0, AvgSize: 8, MaxSize: 16},
+		{MinSize: 16, AvgSize: 8, MaxSize: 32},
+		{MinSize: 4, AvgSize: 64, MaxSize: 32},
+		{MinSize: 1, AvgSize: 2, MaxSize: 8},
+	} {
+		if _, err := NewContentChunkerWithConfig(config); err == nil {
+			t.Fatalf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	for _, s := range []Splitter{NewChunker(100), NewContentChunker()} {
+		if chunks := s.Chunk([]byte("abc")); len(chunks) != 1 {
+			t.Fatalf("%T: expected 1 chunk, got %d", s, len(chunks))
+		}
+	}
+}
@@ -1,5 +1,23 @@
 package internal
 
+import "io"
+
+// Splitter splits data into chunks that concatenate back to it. Chunker cuts
+// at fixed offsets; ContentChunker cuts where the content says to, so an
+// edit only changes the chunks around it.
+type Splitter interface {
+	Chunk(data []byte) [][]byte
+
+	// Cut returns the length of the first chunk of data. A caller reading a
+	// stream can cut as long as it holds MaxChunkSize bytes or has reached
+	// the end.
+	Cut(data []byte) int
+
+	// MaxChunkSize is the largest chunk Cut returns, or 0 if there is none.
+	MaxChunkSize() int
+}
+
+// Chunker splits data into fixed-size chunks.
 type Chunker struct {
 	chunkSize int
 }
@@ -22,9 +40,81 @@ func (c *Chunker) Chunk(data []byte) [][]byte {
 	chunks := make([][]byte, chunkCount)
 
 	for i := range chunks {
-		start := min(i * c.chunkSize, len(data))
-		end := min(start + c.chunkSize, len(data))
+		start := min(i*c.chunkSize, len(data))
+		end := min(start+c.chunkSize, len(data))
 		chunks[i] = data[start:end]
 	}
 	return chunks
 }
+
+func (c *Chunker) Cut(data []byte) int {
+	if c.chunkSize <= 0 {
+		return len(data)
+	}
+	return min(c.chunkSize, len(data))
+}
+
+func (c *Chunker) MaxChunkSize() int {
+	return max(c.chunkSize, 0)
+}
+
+// ChunkReader splits a stream into the chunks its Splitter would cut from the
+// whole of it, holding at most two chunks' worth of bytes at a time.
+type ChunkReader struct {
+	r        io.Reader
+	splitter Splitter
+	buf      []byte
+	start    int
+	end      int
+	err      error
+}
+
+// NewChunkReader returns a ChunkReader that reads r. A splitter without a
+// maximum chunk size needs the whole stream, which is read at once.
+func NewChunkReader(r io.Reader, splitter Splitter) *ChunkReader {
+	return &ChunkReader{r: r, splitter: splitter, buf: make([]byte, 2*splitter.MaxChunkSize())}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// only valid until the next call.
+func (c *ChunkReader) Next() ([]byte, error) {
+	c.fill()
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.splitter.Cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// fill tops up the buffer once it holds less than a full chunk. Reaching the
+// end of the stream sets err to io.EOF.
+func (c *ChunkReader) fill() {
+	window := c.splitter.MaxChunkSize()
+	if c.err != nil || (window > 0 && c.end-c.start >= window) {
+		return
+	}
+	if window <= 0 {
+		if c.buf, c.err = io.ReadAll(c.r); c.err == nil {
+			c.err = io.EOF
+		}
+		c.end = len(c.buf)
+		return
+	}
+
+	// Move the unread bytes to the front, then read as much as fits
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		c.err = io.EOF
+	default:
+		c.err = err
+	}
+}
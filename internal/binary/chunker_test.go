@@ -2,7 +2,10 @@ package internal
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestChunker_EmptyData(t *testing.T) {
@@ -70,3 +73,47 @@ func TestChunker_WithRemainder(t *testing.T) {
 		}
 	}
 }
+
+// readChunks copies every chunk a ChunkReader returns.
+func readChunks(r *ChunkReader) ([][]byte, error) {
+	var chunks [][]byte
+	for {
+		chunk, err := r.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkReader_MatchesChunk(t *testing.T) {
+	data := randomData(300 << 10)
+	for _, s := range []Splitter{NewChunker(1000), NewChunker(0), NewContentChunker()} {
+		for _, n := range []int{0, 1, 999, 1000, 1001, len(data)} {
+			want := s.Chunk(data[:n])
+			got, err := readChunks(NewChunkReader(iotest.HalfReader(bytes.NewReader(data[:n])), s))
+			if err != nil {
+				t.Fatalf("%T, %d bytes: %v", s, n, err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%T, %d bytes: expected %d chunks, got %d", s, n, len(want), len(got))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Fatalf("%T, %d bytes: chunk %d differs", s, n, i)
+				}
+			}
+		}
+	}
+}
+
+func TestChunkReader_ReadError(t *testing.T) {
+	boom := errors.New("boom")
+	r := io.MultiReader(bytes.NewReader(randomData(5000)), iotest.ErrReader(boom))
+	if _, err := readChunks(NewChunkReader(r, NewChunker(1000))); !errors.Is(err, boom) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/BryceDouglasJames/merklediff/internal/codec"
+)
+
+// A Delta rebuilds a target file from a base file with a list of
+// instructions: copy a range of the base, or insert literal bytes. Chunks of
+// the target that also occur in the base become copies, so a delta between
+// similar files holds little more than the bytes that changed.
+//
+// The base and target are identified by their size and SHA-256 digest.
+// Apply refuses a base other than the one the delta was made from, and
+// checks that what it rebuilt is the target.
+
+// Delta layout (integers are unsigned varints unless noted):
+//
+//	magic             "MDDL"
+//	version           uint16, big-endian
+//	base size, base SHA-256 (32 bytes)
+//	target size, target SHA-256 (32 bytes)
+//	op count
+//	ops               0x00, base offset, length          (copy)
+//	                  0x01, length, bytes                (insert)
+//	checksum          CRC-32 (IEEE) of everything above, uint32 big-endian
+
+// DeltaMagic starts every delta file.
+const DeltaMagic = "MDDL"
+
+const deltaVersion = 1
+
+var (
+	// ErrBaseMismatch is returned by Apply when the base is not the file
+	// the delta was made from.
+	ErrBaseMismatch = errors.New("base does not match the delta")
+
+	// ErrInvalidDelta is returned when a delta cannot be read or applied:
+	// it is not a delta, fails its integrity checks, or does not rebuild
+	// its target.
+	ErrInvalidDelta = errors.New("invalid delta")
+)
+
+// OpKind is the kind of a delta instruction.
+type OpKind byte
+
+const (
+	// OpCopy copies Length bytes of the base from Offset.
+	OpCopy OpKind = 0
+
+	// OpInsert inserts Data.
+	OpInsert OpKind = 1
+)
+
+// Op is one delta instruction.
+type Op struct {
+	Kind   OpKind
+	Offset int64
+	Length int64
+	Data   []byte
+}
+
+// Delta rebuilds a target file from a base file.
+type Delta struct {
+	BaseSize   int64
+	BaseHash   [sha256.Size]byte
+	TargetSize int64
+	TargetHash [sha256.Size]byte
+	Ops        []Op
+}
+
+// NewDelta returns the delta from base to target, given each file's chunk
+// hashes as produced by the same Splitter. Each target chunk whose hash
+// matches a base chunk is copied from the first such chunk, after checking
+// the lengths and bytes agree, so a hash collision is never trusted; other
+// chunks are inserted. Adjacent copies of
+// consecutive base ranges, and adjacent inserts, are merged.
+//
+// The files are read a chunk at a time, so only the inserted bytes are
+// held in memory.
+func NewDelta(base, target io.ReaderAt, baseChunks, targetChunks []ChunkHash) (*Delta, error) {
+	d := &Delta{}
+
+	spans := make(map[string]baseSpan, len(baseChunks))
+	for _, c := range baseChunks {
+		if _, ok := spans[string(c.Hash)]; !ok {
+			spans[string(c.Hash)] = baseSpan{offset: d.BaseSize, length: c.Length}
+		}
+		d.BaseSize += int64(c.Length)
+	}
+	baseHash := sha256.New()
+	if _, err := io.CopyN(baseHash, io.NewSectionReader(base, 0, d.BaseSize), d.BaseSize); err != nil {
+		return nil, fmt.Errorf("read base: %w", err)
+	}
+	baseHash.Sum(d.BaseHash[:0])
+
+	targetHash := sha256.New()
+	var chunk, match []byte
+	for _, c := range targetChunks {
+		chunk = slices.Grow(chunk[:0], c.Length)[:c.Length]
+		if err := readAt(target, chunk, d.TargetSize); err != nil {
+			return nil, fmt.Errorf("read target: %w", err)
+		}
+		targetHash.Write(chunk)
+		d.TargetSize += int64(c.Length)
+
+		if from, ok := spans[string(c.Hash)]; ok && from.length == c.Length {
+			match = slices.Grow(match[:0], c.Length)[:c.Length]
+			if err := readAt(base, match, from.offset); err != nil {
+				return nil, fmt.Errorf("read base: %w", err)
+			}
+			if bytes.Equal(match, chunk) {
+				d.addCopy(from.offset, int64(c.Length))
+				continue
+			}
+		}
+		d.addInsert(chunk)
+	}
+	targetHash.Sum(d.TargetHash[:0])
+	return d, nil
+}
+
+// baseSpan is where a chunk of the base starts and how long it is.
+type baseSpan struct {
+	offset int64
+	length int
+}
+
+// addCopy appends a copy of the base, extending the last copy if it ends
+// where this one starts.
+func (d *Delta) addCopy(offset, length int64) {
+	if n := len(d.Ops); n > 0 {
+		last := &d.Ops[n-1]
+		if last.Kind == OpCopy && last.Offset+last.Length == offset {
+			last.Length += length
+			return
+		}
+	}
+	d.Ops = append(d.Ops, Op{Kind: OpCopy, Offset: offset, Length: length})
+}
+
+// addInsert appends literal bytes, extending the last insert if there is one.
+func (d *Delta) addInsert(data []byte) {
+	if n := len(d.Ops); n > 0 && d.Ops[n-1].Kind == OpInsert {
+		last := &d.Ops[n-1]
+		last.Data = append(last.Data, data...)
+		last.Length = int64(len(last.Data))
+		return
+	}
+	d.Ops = append(d.Ops, Op{Kind: OpInsert, Length: int64(len(data)), Data: bytes.Clone(data)})
+}
+
+// Stats returns the number of copy and insert instructions and the bytes
+// each accounts for in the target.
+func (d *Delta) Stats() (copies int, copied int64, inserts int, inserted int64) {
+	for _, op := range d.Ops {
+		if op.Kind == OpCopy {
+			copies++
+			copied += op.Length
+		} else {
+			inserts++
+			inserted += op.Length
+		}
+	}
+	return copies, copied, inserts, inserted
+}
+
+// Apply writes the target rebuilt from base to w. It returns
+// ErrBaseMismatch if base is not the delta's base, and ErrInvalidDelta if an
+// instruction is out of range or the result is not the delta's target.
+//
+// Copies are read from base as they are written, so the target is never
+// held in memory. The target hash can only be checked at the end, so on
+// error w may already hold a partial or wrong result; write to a temporary
+// file and keep it only if Apply succeeds.
+func (d *Delta) Apply(base io.ReaderAt, w io.Writer) error {
+	baseHash := sha256.New()
+	if _, err := io.CopyN(baseHash, io.NewSectionReader(base, 0, d.BaseSize), d.BaseSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return ErrBaseMismatch
+		}
+		return fmt.Errorf("read base: %w", err)
+	}
+	if n, _ := base.ReadAt(make([]byte, 1), d.BaseSize); n != 0 || !bytes.Equal(baseHash.Sum(nil), d.BaseHash[:]) {
+		return ErrBaseMismatch
+	}
+
+	// Check every op before writing anything
+	var size int64
+	for i, op := range d.Ops {
+		switch op.Kind {
+		case OpCopy:
+			if op.Offset < 0 || op.Length < 0 || op.Length > d.BaseSize-op.Offset {
+				return fmt.Errorf("%w: op %d copies %d bytes at %d of a %d-byte base",
+					ErrInvalidDelta, i, op.Length, op.Offset, d.BaseSize)
+			}
+			size += op.Length
+		case OpInsert:
+			size += int64(len(op.Data))
+		default:
+			return fmt.Errorf("%w: op %d has unknown kind %d", ErrInvalidDelta, i, op.Kind)
+		}
+		if size > d.TargetSize {
+			return fmt.Errorf("%w: target exceeds %d bytes", ErrInvalidDelta, d.TargetSize)
+		}
+	}
+
+	targetHash := sha256.New()
+	out := io.MultiWriter(w, targetHash)
+	for _, op := range d.Ops {
+		var err error
+		if op.Kind == OpCopy {
+			_, err = io.CopyN(out, io.NewSectionReader(base, op.Offset, op.Length), op.Length)
+		} else {
+			_, err = out.Write(op.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if size != d.TargetSize || !bytes.Equal(targetHash.Sum(nil), d.TargetHash[:]) {
+		return fmt.Errorf("%w: rebuilt file does not match the target hash", ErrInvalidDelta)
+	}
+	return nil
+}
+
+// WriteTo writes the delta to w. It implements io.WriterTo.
+func (d *Delta) WriteTo(w io.Writer) (int64, error) {
+	e := codec.NewEncoder(w)
+
+	e.Raw([]byte(DeltaMagic))
+	e.Raw(binary.BigEndian.AppendUint16(nil, deltaVersion))
+	e.Uvarint(uint64(d.BaseSize))
+	e.Raw(d.BaseHash[:])
+	e.Uvarint(uint64(d.TargetSize))
+	e.Raw(d.TargetHash[:])
+	e.Uvarint(uint64(len(d.Ops)))
+	for _, op := range d.Ops {
+		e.Raw([]byte{byte(op.Kind)})
+		if op.Kind == OpCopy {
+			e.Uvarint(uint64(op.Offset))
+			e.Uvarint(uint64(op.Length))
+		} else {
+			e.Bytes(op.Data)
+		}
+	}
+
+	return e.Finish()
+}
+
+// ReadDelta reads a delta written by Delta.WriteTo.
+func ReadDelta(r io.Reader) (*Delta, error) {
+	dec := codec.NewDecoder(r, ErrInvalidDelta)
+
+	magic := dec.Raw(len(DeltaMagic))
+	if dec.Err() == nil && string(magic) != DeltaMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrInvalidDelta, magic)
+	}
+	version := binary.BigEndian.Uint16(dec.Raw(2))
+	if dec.Err() == nil && version != deltaVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidDelta, version)
+	}
+
+	d := &Delta{BaseSize: int64(dec.Uvarint())}
+	copy(d.BaseHash[:], dec.Raw(sha256.Size))
+	d.TargetSize = int64(dec.Uvarint())
+	copy(d.TargetHash[:], dec.Raw(sha256.Size))
+
+	// Every op holds at least one target byte, which bounds the count
+	n := dec.Uvarint()
+	if dec.Err() == nil && (d.BaseSize < 0 || d.TargetSize < 0 || n > uint64(d.TargetSize)) {
+		return nil, fmt.Errorf("%w: %d ops for a %d-byte target", ErrInvalidDelta, n, d.TargetSize)
+	}
+	for i := uint64(0); i < n && dec.Err() == nil; i++ {
+		op := Op{Kind: OpKind(dec.Raw(1)[0])}
+		switch op.Kind {
+		case OpCopy:
+			op.Offset = int64(dec.Uvarint())
+			op.Length = int64(dec.Uvarint())
+		case OpInsert:
+			length := dec.Uvarint()
+			if dec.Err() == nil && length > uint64(d.TargetSize) {
+				return nil, fmt.Errorf("%w: %d-byte insert for a %d-byte target", ErrInvalidDelta, length, d.TargetSize)
+			}
+			op.Data = dec.Data(int64(length))
+			op.Length = int64(len(op.Data))
+		default:
+			if dec.Err() == nil {
+				return nil, fmt.Errorf("%w: op %d has unknown kind %d", ErrInvalidDelta, i, op.Kind)
+			}
+		}
+		d.Ops = append(d.Ops, op)
+	}
+
+	if err := dec.VerifyChecksum(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// newDelta builds the delta between two in-memory files.
+func newDelta(t *testing.T, base, target []byte, baseChunks, targetChunks []ChunkHash) *Delta {
+	t.Helper()
+	d, err := NewDelta(bytes.NewReader(base), bytes.NewReader(target), baseChunks, targetChunks)
+	if err != nil {
+		t.Fatalf("new delta: %v", err)
+	}
+	return d
+}
+
+// apply applies d to an in-memory base.
+func apply(d *Delta, base []byte) ([]byte, error) {
+	var out bytes.Buffer
+	err := d.Apply(bytes.NewReader(base), &out)
+	return out.Bytes(), err
+}
+
+// sha256Chunks chunks data and describes each chunk by its SHA-256.
+func sha256Chunks(s Splitter, data []byte) []ChunkHash {
+	var out []ChunkHash
+	for _, c := range s.Chunk(data) {
+		sum := sha256.Sum256(c)
+		out = append(out, ChunkHash{Hash: sum[:], Length: len(c)})
+	}
+	return out
+}
+
+func TestDelta_RoundTrip(t *testing.T) {
+	base := randomData(1 << 20)
+	target := append([]byte("prefix"), base[:300_000]...)
+	target = append(target, base[400_000:]...)
+	copy(target[700_000:], "overwritten")
+
+	c := NewContentChunker()
+	d := newDelta(t, base, target, sha256Chunks(c, base), sha256Chunks(c, target))
+
+	copies, copied, inserts, inserted := d.Stats()
+	if copied+inserted != int64(len(target)) {
+		t.Fatalf("expected ops to cover %d bytes, got %d", len(target), copied+inserted)
+	}
+	if copies == 0 || inserts == 0 || inserted > 64<<10 {
+		t.Fatalf("expected mostly copies, got %d copies and %d inserts of %d bytes", copies, inserts, inserted)
+	}
+
+	var buf bytes.Buffer
+	if _, err := d.WriteTo(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if buf.Len() > 100<<10 {
+		t.Fatalf("expected a small delta, got %d bytes", buf.Len())
+	}
+	read, err := ReadDelta(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	got, err := apply(read, base)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !bytes.Equal(got, target) {
+		t.Fatal("expected the patched file to equal the target")
+	}
+}
+
+func TestDelta_Empty(t *testing.T) {
+	c := NewChunker(4)
+	for _, tc := range []struct{ base, target []byte }{
+		{nil, []byte("new file")},
+		{[]byte("old file"), nil},
+		{nil, nil},
+	} {
+		d := newDelta(t, tc.base, tc.target, sha256Chunks(c, tc.base), sha256Chunks(c, tc.target))
+		got, err := apply(d, tc.base)
+		if err != nil || !bytes.Equal(got, tc.target) {
+			t.Fatalf("expected %q, got %q, %v", tc.target, got, err)
+		}
+	}
+}
+
+func TestDelta_HashCollision(t *testing.T) {
+	// Weak hashes can collide, so a matching hash alone never makes a copy
+	collide := func(data []byte) []ChunkHash {
+		return []ChunkHash{{Hash: []byte{0x42}, Length: len(data)}}
+	}
+	base := []byte("short base")
+	for _, target := range [][]byte{
+		[]byte("a target chunk longer than the base"),
+		[]byte("same size!"),
+	} {
+		d := newDelta(t, base, target, collide(base), collide(target))
+		if copies, _, _, _ := d.Stats(); copies != 0 {
+			t.Fatalf("%q: expected a colliding chunk to be inserted, got %d copies", target, copies)
+		}
+		got, err := apply(d, base)
+		if err != nil || !bytes.Equal(got, target) {
+			t.Fatalf("expected %q, got %q, %v", target, got, err)
+		}
+	}
+}
+
+func TestDelta_WrongBase(t *testing.T) {
+	base := []byte("the quick brown fox")
+	target := []byte("the quick red fox")
+	c := NewChunker(4)
+	d := newDelta(t, base, target, sha256Chunks(c, base), sha256Chunks(c, target))
+
+	for _, wrong := range []string{"the quick brown cat", "the quick brown fox!", "the quick"} {
+		if _, err := apply(d, []byte(wrong)); !errors.Is(err, ErrBaseMismatch) {
+			t.Fatalf("%q: expected ErrBaseMismatch, got %v", wrong, err)
+		}
+	}
+
+	// A tampered op is caught by the target hash
+	for i := range d.Ops {
+		if d.Ops[i].Kind == OpInsert {
+			d.Ops[i].Data[0] ^= 0xff
+		}
+	}
+	if _, err := apply(d, base); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("expected ErrInvalidDelta, got %v", err)
+	}
+
+	d.Ops = append(d.Ops, Op{Kind: OpCopy, Offset: 1 << 62, Length: 1 << 62})
+	if _, err := apply(d, base); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("expected ErrInvalidDelta for an out-of-range copy, got %v", err)
+	}
+}
+
+func TestReadDelta_Corrupt(t *testing.T) {
+	base := randomData(10_000)
+	target := append(bytes.Clone(base), "appended"...)
+	c := NewChunker(1024)
+	var buf bytes.Buffer
+	newDelta(t, base, target, sha256Chunks(c, base), sha256Chunks(c, target)).WriteTo(&buf)
+	encoded := buf.Bytes()
+
+	corrupt := bytes.Clone(encoded)
+	corrupt[len(corrupt)-6] ^= 0xff
+	if _, err := ReadDelta(bytes.NewReader(corrupt)); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("expected ErrInvalidDelta for a corrupt delta, got %v", err)
+	}
+	if _, err := ReadDelta(bytes.NewReader(encoded[:len(encoded)-3])); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("expected ErrInvalidDelta for a truncated delta, got %v", err)
+	}
+	if _, err := ReadDelta(bytes.NewReader([]byte("MDSK\x00\x01"))); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatalf("expected ErrInvalidDelta for another format, got %v", err)
+	}
+}
+
+func TestNewDelta_ShortFile(t *testing.T) {
+	// Chunk lengths that run past the end of a file are an error
+	base := []byte("base")
+	chunks := []ChunkHash{{Hash: []byte{1}, Length: 10}}
+	if _, err := NewDelta(bytes.NewReader(base), bytes.NewReader(base), chunks, nil); err == nil {
+		t.Fatal("expected an error for a short base")
+	}
+	if _, err := NewDelta(bytes.NewReader(base), bytes.NewReader(base), nil, chunks); err == nil {
+		t.Fatal("expected an error for a short target")
+	}
+}
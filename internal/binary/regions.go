@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+)
+
+// ChunkHash identifies a chunk of a file by its hash and length. A file is
+// described by its chunk hashes in order.
+type ChunkHash struct {
+	Hash   []byte
+	Length int
+}
+
+// Region is a span where two files differ, as a byte offset and length in
+// each. A region holding bytes only in B has LengthA 0, and one holding
+// bytes only in A has LengthB 0.
+type Region struct {
+	OffsetA, LengthA int64
+	OffsetB, LengthB int64
+}
+
+// DiffChunks returns the regions where two chunked files differ, in order.
+// Chunks are compared by hash: a run of chunks that appear only in one file
+// is a region, and chunks found in both files are where the comparison
+// resynchronizes after an insert or delete. Adjacent differing chunks are
+// merged into one region.
+func DiffChunks(a, b []ChunkHash) []Region {
+	inA := hashSet(a)
+	inB := hashSet(b)
+
+	var regions []Region
+	var cur *Region
+	var offA, offB int64
+	i, j := 0, 0
+
+	// takeA and takeB add the next chunk of a file to the current region,
+	// opening one at the current offsets if needed
+	open := func() {
+		if cur == nil {
+			cur = &Region{OffsetA: offA, OffsetB: offB}
+		}
+	}
+	takeA := func() {
+		open()
+		cur.LengthA += int64(a[i].Length)
+		offA += int64(a[i].Length)
+		i++
+	}
+	takeB := func() {
+		open()
+		cur.LengthB += int64(b[j].Length)
+		offB += int64(b[j].Length)
+		j++
+	}
+
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && bytes.Equal(a[i].Hash, b[j].Hash) {
+			if cur != nil {
+				regions = append(regions, *cur)
+				cur = nil
+			}
+			offA += int64(a[i].Length)
+			offB += int64(b[j].Length)
+			i, j = i+1, j+1
+			continue
+		}
+
+		progress := false
+		for i < len(a) && !inB[string(a[i].Hash)] {
+			takeA()
+			progress = true
+		}
+		for j < len(b) && !inA[string(b[j].Hash)] {
+			takeB()
+			progress = true
+		}
+
+		// Both next chunks exist somewhere in the other file, out of place
+		if !progress && !(i < len(a) && j < len(b) && bytes.Equal(a[i].Hash, b[j].Hash)) {
+			if i < len(a) {
+				takeA()
+			}
+			if j < len(b) {
+				takeB()
+			}
+		}
+	}
+	if cur != nil {
+		regions = append(regions, *cur)
+	}
+	return regions
+}
+
+func hashSet(chunks []ChunkHash) map[string]bool {
+	set := make(map[string]bool, len(chunks))
+	for _, c := range chunks {
+		set[string(c.Hash)] = true
+	}
+	return set
+}
+
+// trimBlock is how many bytes of each side Trim compares at a time.
+const trimBlock = 32 << 10
+
+// Trim narrows a region of files a and b to the bytes that differ by
+// dropping the prefix and suffix both sides share, since chunk boundaries
+// rarely fall exactly at an edit. The sides are read a block at a time, so a
+// large region is never held in memory.
+func (r Region) Trim(a, b io.ReaderAt) (Region, error) {
+	bufA := make([]byte, min(r.LengthA, trimBlock))
+	bufB := make([]byte, min(r.LengthB, trimBlock))
+
+	// readBlocks reads n bytes of each side, from offA in a and offB in b
+	readBlocks := func(offA, offB, n int64) ([]byte, []byte, error) {
+		sideA, sideB := bufA[:n], bufB[:n]
+		if err := readAt(a, sideA, offA); err != nil {
+			return nil, nil, err
+		}
+		if err := readAt(b, sideB, offB); err != nil {
+			return nil, nil, err
+		}
+		return sideA, sideB, nil
+	}
+
+	shared := min(r.LengthA, r.LengthB)
+	var prefix int64
+	for prefix < shared {
+		n := min(shared-prefix, trimBlock)
+		sideA, sideB, err := readBlocks(r.OffsetA+prefix, r.OffsetB+prefix, n)
+		if err != nil {
+			return r, err
+		}
+		k := int64(0)
+		for k < n && sideA[k] == sideB[k] {
+			k++
+		}
+		prefix += k
+		if k < n {
+			break
+		}
+	}
+
+	// Repeated bytes are not counted twice
+	shared -= prefix
+	var suffix int64
+	for suffix < shared {
+		n := min(shared-suffix, trimBlock)
+		sideA, sideB, err := readBlocks(r.OffsetA+r.LengthA-suffix-n, r.OffsetB+r.LengthB-suffix-n, n)
+		if err != nil {
+			return r, err
+		}
+		k := int64(0)
+		for k < n && sideA[n-1-k] == sideB[n-1-k] {
+			k++
+		}
+		suffix += k
+		if k < n {
+			break
+		}
+	}
+
+	return Region{
+		OffsetA: r.OffsetA + prefix,
+		LengthA: r.LengthA - prefix - suffix,
+		OffsetB: r.OffsetB + prefix,
+		LengthB: r.LengthB - prefix - suffix,
+	}, nil
+}
+
+// readAt fills p from r at off, failing if r ends first.
+func readAt(r io.ReaderAt, p []byte, off int64) error {
+	_, err := io.ReadFull(io.NewSectionReader(r, off, int64(len(p))), p)
+	return err
+}
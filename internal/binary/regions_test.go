@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// chunkHashes describes chunks by their contents.
+func chunkHashes(chunks ...string) []ChunkHash {
+	out := make([]ChunkHash, len(chunks))
+	for i, c := range chunks {
+		sum := sha256.Sum256([]byte(c))
+		out[i] = ChunkHash{Hash: sum[:], Length: len(c)}
+	}
+	return out
+}
+
+func TestDiffChunks(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b []ChunkHash
+		want []Region
+	}{
+		{
+			name: "identical",
+			a:    chunkHashes("aaa", "bb", "c"),
+			b:    chunkHashes("aaa", "bb", "c"),
+		},
+		{
+			name: "changed",
+			a:    chunkHashes("aaa", "bb", "c"),
+			b:    chunkHashes("aaa", "BBBB", "c"),
+			want: []Region{{OffsetA: 3, LengthA: 2, OffsetB: 3, LengthB: 4}},
+		},
+		{
+			name: "inserted",
+			a:    chunkHashes("aaa", "bb", "c"),
+			b:    chunkHashes("aaa", "xy", "bb", "c"),
+			want: []Region{{OffsetA: 3, OffsetB: 3, LengthB: 2}},
+		},
+		{
+			name: "deleted and appended",
+			a:    chunkHashes("aaa", "bb", "c"),
+			b:    chunkHashes("bb", "c", "dddd"),
+			want: []Region{{LengthA: 3}, {OffsetA: 6, OffsetB: 3, LengthB: 4}},
+		},
+		{
+			name: "swapped",
+			a:    chunkHashes("aaa", "bb", "c"),
+			b:    chunkHashes("bb", "aaa", "c"),
+			want: []Region{{LengthA: 5, LengthB: 5}},
+		},
+		{
+			name: "empty",
+			a:    nil,
+			b:    chunkHashes("aaa"),
+			want: []Region{{LengthB: 3}},
+		},
+	} {
+		got := DiffChunks(tc.a, tc.b)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: expected %d regions, got %+v", tc.name, len(tc.want), got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("%s: region %d: expected %+v, got %+v", tc.name, i, tc.want[i], got[i])
+			}
+		}
+	}
+}
+
+func TestRegion_Trim(t *testing.T) {
+	a := []byte("header:abcdef:footer")
+	b := []byte("header:abXYZdef:footer")
+	r := Region{OffsetA: 7, LengthA: 6, OffsetB: 7, LengthB: 8}
+
+	got, err := r.Trim(bytes.NewReader(a), bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("trim: %v", err)
+	}
+	want := Region{OffsetA: 9, LengthA: 1, OffsetB: 9, LengthB: 3}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if string(b[got.OffsetB:got.OffsetB+got.LengthB]) != "XYZ" {
+		t.Fatalf("expected the trimmed region to hold the new bytes, got %q", b[got.OffsetB:got.OffsetB+got.LengthB])
+	}
+
+	// Repeated bytes are not counted twice
+	got, _ = Region{LengthA: 2, LengthB: 3}.Trim(bytes.NewReader([]byte("aa")), bytes.NewReader([]byte("aaa")))
+	if got.LengthA != 0 || got.LengthB != 1 {
+		t.Fatalf("expected one inserted byte, got %+v", got)
+	}
+}
+
+func TestRegion_TrimAcrossBlocks(t *testing.T) {
+	a := randomData(3*trimBlock + 100)
+	b := bytes.Clone(a)
+	b[2*trimBlock+7] ^= 0xff
+	r := Region{LengthA: int64(len(a)), LengthB: int64(len(b))}
+
+	got, err := r.Trim(bytes.NewReader(a), bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("trim: %v", err)
+	}
+	want := Region{OffsetA: 2*trimBlock + 7, LengthA: 1, OffsetB: 2*trimBlock + 7, LengthB: 1}
+	if got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+
+	// A region past the end of a file cannot be read
+	if _, err := r.Trim(bytes.NewReader(a[:10]), bytes.NewReader(b)); err == nil {
+		t.Fatal("expected an error for a truncated file")
+	}
+}
@@ -0,0 +1,177 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Snapshots, sketches and deltas share one framing: fields written as raw
+// bytes or unsigned varints, followed by a CRC-32 (IEEE) of everything
+// before it as a big-endian uint32. Encoder and Decoder handle the framing
+// and keep the first error, so a format reads or writes its fields in
+// order and checks for an error once at the end.
+
+// Encoder writes fields, tracking the byte count, the running checksum and
+// the first error.
+type Encoder struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	n   int64
+	err error
+	buf []byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+}
+
+func (e *Encoder) Raw(b []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc.Write(b)
+	n, err := e.w.Write(b)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *Encoder) Uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf[:0], v)
+	e.Raw(e.buf)
+}
+
+// Bytes writes b prefixed with its length.
+func (e *Encoder) Bytes(b []byte) {
+	e.Uvarint(uint64(len(b)))
+	e.Raw(b)
+}
+
+// Finish writes the checksum and flushes. It returns the number of bytes
+// written and the first error.
+func (e *Encoder) Finish() (int64, error) {
+	if e.err == nil {
+		sum := binary.BigEndian.AppendUint32(nil, e.crc.Sum32())
+		n, err := e.w.Write(sum)
+		e.n += int64(n)
+		e.err = err
+	}
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.n, e.err
+}
+
+// Decoder reads fields, keeping the running checksum and the first error.
+// After an error every read returns zero values.
+type Decoder struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	err error
+
+	// invalid is the error wrapped by integrity failures, such as
+	// ErrInvalidSnapshot
+	invalid error
+}
+
+// NewDecoder returns a Decoder whose integrity failures wrap invalid.
+func NewDecoder(r io.Reader, invalid error) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), crc: crc32.NewIEEE(), invalid: invalid}
+}
+
+// Err returns the first error, treating a short read as a truncated input.
+func (d *Decoder) Err() error {
+	if errors.Is(d.err, io.EOF) || errors.Is(d.err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", d.invalid)
+	}
+	return d.err
+}
+
+// Fail records err unless an error is already recorded.
+func (d *Decoder) Fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// ReadByte implements io.ByteReader for binary.ReadUvarint.
+func (d *Decoder) ReadByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == nil {
+		d.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// Raw reads n bytes. Callers bound n first.
+func (d *Decoder) Raw(n int) []byte {
+	buf := make([]byte, n)
+	if d.err != nil {
+		return buf
+	}
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		d.err = err
+		return buf
+	}
+	d.crc.Write(buf)
+	return buf
+}
+
+func (d *Decoder) Uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d)
+	if err != nil {
+		d.err = err
+	}
+	return v
+}
+
+// Count reads a length and checks it against limit.
+func (d *Decoder) Count(limit uint64) int {
+	n := d.Uvarint()
+	if n > limit {
+		d.Fail(fmt.Errorf("%w: length %d too large", d.invalid, n))
+		return 0
+	}
+	return int(n)
+}
+
+// Data reads n bytes, growing the buffer as they arrive so a corrupt length
+// cannot force a large allocation.
+func (d *Decoder) Data(n int64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, n); err != nil {
+		d.err = err
+		return nil
+	}
+	d.crc.Write(buf.Bytes())
+	return buf.Bytes()
+}
+
+// VerifyChecksum reads the trailing checksum and compares it with the
+// checksum of everything read so far. It returns Err if a read failed.
+func (d *Decoder) VerifyChecksum() error {
+	if d.err != nil {
+		return d.Err()
+	}
+	want := d.crc.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(d.r, sum[:]); err != nil {
+		d.err = err
+		return d.Err()
+	}
+	if got := binary.BigEndian.Uint32(sum[:]); got != want {
+		return fmt.Errorf("%w: checksum mismatch", d.invalid)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var errInvalid = errors.New("invalid test file")
+
+func encode(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.Raw([]byte("MAGC"))
+	e.Uvarint(300)
+	e.Bytes([]byte("hello"))
+	n, err := e.Finish()
+	if err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("expected %d bytes written, got %d", buf.Len(), n)
+	}
+	return buf.Bytes()
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	d := NewDecoder(bytes.NewReader(encode(t)), errInvalid)
+	if got := string(d.Raw(4)); got != "MAGC" {
+		t.Fatalf("expected MAGC, got %q", got)
+	}
+	if got := d.Uvarint(); got != 300 {
+		t.Fatalf("expected 300, got %d", got)
+	}
+	if got := string(d.Data(int64(d.Count(16)))); got != "hello" {
+		t.Fatalf("expected hello, got %q", got)
+	}
+	if err := d.VerifyChecksum(); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestCodec_Invalid(t *testing.T) {
+	encoded := encode(t)
+
+	corrupt := bytes.Clone(encoded)
+	corrupt[5] ^= 0xff
+	d := NewDecoder(bytes.NewReader(corrupt), errInvalid)
+	d.Raw(4)
+	d.Uvarint()
+	d.Data(int64(d.Count(16)))
+	if err := d.VerifyChecksum(); !errors.Is(err, errInvalid) {
+		t.Fatalf("expected a checksum failure, got %v", err)
+	}
+
+	// Reads after a short read return zero values and keep the error
+	d = NewDecoder(bytes.NewReader(encoded[:6]), errInvalid)
+	d.Raw(4)
+	d.Uvarint()
+	if got := d.Data(5); got != nil || !errors.Is(d.Err(), errInvalid) {
+		t.Fatalf("expected a truncated error, got %q, %v", got, d.Err())
+	}
+
+	d = NewDecoder(bytes.NewReader(encoded), errInvalid)
+	d.Raw(4)
+	if n := d.Count(10); n != 0 || !errors.Is(d.Err(), errInvalid) {
+		t.Fatalf("expected a length over the limit to fail, got %d, %v", n, d.Err())
+	}
+}
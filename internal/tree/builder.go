@@ -1,6 +1,16 @@
 package tree
 
-import "github.com/BryceDouglasJames/merklediff/pkg/types"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/types"
+)
+
+// ErrUnsortedInput is returned when rows do not arrive in strictly
+// increasing key order.
+var ErrUnsortedInput = errors.New("rows are not sorted by key")
 
 // RowReader is the iterator interface for data sources.
 type RowReader = types.RowReader
@@ -26,13 +36,15 @@ func (b *NodeBuilder) SerializeRowValues(values []any) []byte {
 	return b.Serializer.SerializeRow(values)
 }
 
-// StreamingBuilder builds a Merkle tree incrementally in batches.
-// Use this for very large datasets where even collecting all leaf nodes
-// doesn't fit in memory.
+// StreamingBuilder serializes rows into fixed-size batches of leaf data.
+// Only the current batch is held in memory; callers drain it with Flush
+// whenever Full reports true.
 type StreamingBuilder struct {
 	serializer *Serializer
 	batchSize  int
 	leaves     []LeafData
+	lastKey    []byte
+	rowCount   int
 }
 
 // LeafData holds the data needed to create a leaf node.
@@ -49,23 +61,52 @@ func NewStreamingBuilder(batchSize int) *StreamingBuilder {
 	return &StreamingBuilder{
 		serializer: NewSerializer(),
 		batchSize:  batchSize,
+		leaves:     make([]LeafData, 0, batchSize),
 	}
 }
 
-// AddRow adds a row to the builder.
-func (b *StreamingBuilder) AddRow(row Row) {
-	serializedValue := b.serializer.SerializeRow(row.Values)
+// AddRow serializes a row into the current batch.
+// Keys must be strictly increasing; an out-of-order or duplicate key
+// returns ErrUnsortedInput and the row is not added.
+func (b *StreamingBuilder) AddRow(row Row) error {
+	if b.rowCount > 0 && bytes.Compare(row.Key, b.lastKey) <= 0 {
+		return fmt.Errorf("%w: key %q after %q", ErrUnsortedInput, row.Key, b.lastKey)
+	}
+
+	// Copy the key: readers may reuse their buffers between rows
+	key := append([]byte(nil), row.Key...)
 	b.leaves = append(b.leaves, LeafData{
-		Key:            row.Key,
-		SerializedData: serializedValue,
+		Key:            key,
+		SerializedData: b.serializer.SerializeRow(row.Values),
 	})
+	b.lastKey = key
+	b.rowCount++
+	return nil
+}
+
+// Full reports whether the current batch has reached the batch size.
+func (b *StreamingBuilder) Full() bool {
+	return len(b.leaves) >= b.batchSize
+}
+
+// Flush returns the current batch and starts a new one.
+// The returned slice is only valid until the next call to AddRow.
+func (b *StreamingBuilder) Flush() []LeafData {
+	batch := b.leaves
+	b.leaves = b.leaves[:0]
+	return batch
 }
 
-// GetLeaves returns all collected leaf data for tree construction.
+// GetLeaves returns the leaf data in the current batch.
 func (b *StreamingBuilder) GetLeaves() []LeafData {
 	return b.leaves
 }
 
+// RowCount returns the number of rows added so far.
+func (b *StreamingBuilder) RowCount() int {
+	return b.rowCount
+}
+
 // GetSerializer returns the serializer used by this builder.
 func (b *StreamingBuilder) GetSerializer() *Serializer {
 	return b.serializer
@@ -8,6 +8,11 @@ import (
 	"time"
 )
 
+// SerializerVersion identifies the value encoding produced by Serializer.
+// It must change whenever the encoding changes, because saved trees hash
+// rows with the encoding they were built with.
+const SerializerVersion = 1
+
 // enc is the byte order used for all serialization.
 // BigEndian ensures consistent hashing across platforms.
 var enc = binary.BigEndian
@@ -114,3 +119,45 @@ func (s *Serializer) writeFloat64(f float64) {
 	enc.PutUint64(buf, math.Float64bits(f))
 	s.buf.Write(buf)
 }
+
+// Domain separation prefixes, as in RFC 6962 section 2.1. Leaf and internal
+// hash inputs start with different bytes, so a crafted row can never hash to
+// the same value as an internal node.
+const (
+	LeafPrefix     byte = 0x00
+	InternalPrefix byte = 0x01
+)
+
+// LeafHashInput returns the bytes hashed for an unkeyed leaf, such as a raw
+// chunk: the leaf prefix followed by data.
+func LeafHashInput(data []byte) []byte {
+	buf := make([]byte, 0, 1+len(data))
+	buf = append(buf, LeafPrefix)
+	return append(buf, data...)
+}
+
+// KeyedLeafHashInput returns the bytes hashed for a row leaf: the leaf
+// prefix, the length-prefixed key, then the serialized values. Binding the
+// key means a row cannot be moved to another key without changing its hash.
+func KeyedLeafHashInput(key []byte, data []byte) []byte {
+	buf := make([]byte, 0, 1+4+len(key)+len(data))
+	buf = append(buf, LeafPrefix)
+	buf = enc.AppendUint32(buf, uint32(len(key)))
+	buf = append(buf, key...)
+	return append(buf, data...)
+}
+
+// InternalHashInput returns the bytes hashed for an internal node: the
+// internal prefix followed by the child hashes in order.
+func InternalHashInput(childHashes ...[]byte) []byte {
+	size := 1
+	for _, h := range childHashes {
+		size += len(h)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, InternalPrefix)
+	for _, h := range childHashes {
+		buf = append(buf, h...)
+	}
+	return buf
+}
@@ -1,14 +1,134 @@
 package hasher
 
-import "crypto/sha256"
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// Hasher names accepted by New.
+const (
+	NameSHA256     = "sha256"
+	NameSHA512_256 = "sha512-256"
+	NameFNV128a    = "fnv128a"
+	NameHMACSHA256 = "hmac-sha256"
+)
+
+// ErrKeyRequired is returned by New when a keyed hasher is given no key.
+var ErrKeyRequired = errors.New("hasher requires a key")
 
 type Hasher interface {
 	Hash(data []byte) []byte
+
+	// Name identifies the hash function. Trees built with hashers of
+	// different names cannot be compared. Keyed hashers append a
+	// fingerprint of their key after a colon, so trees built with
+	// different keys are told apart.
+	Name() string
+}
+
+// New returns the hasher registered under name.
+// key is required by keyed hashers and ignored by the others. name may be
+// the full Name of a keyed hasher, in which case key must match its
+// fingerprint.
+func New(name string, key []byte) (Hasher, error) {
+	name, keyID, keyed := strings.Cut(name, ":")
+	switch name {
+	case NameSHA256:
+		return &SHA256Hasher{}, nil
+	case NameSHA512_256:
+		return &SHA512_256Hasher{}, nil
+	case NameFNV128a:
+		return &FNVHasher{}, nil
+	case NameHMACSHA256:
+		if len(key) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrKeyRequired, name)
+		}
+		h := NewHMACHasher(key)
+		if keyed && keyID != h.keyID {
+			return nil, fmt.Errorf("hasher %s:%s needs a different key than the one given", name, keyID)
+		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("unknown hasher %q (want one of %v)", name, Names())
+	}
+}
+
+// Names returns the names accepted by New.
+func Names() []string {
+	names := []string{NameSHA256, NameSHA512_256, NameFNV128a, NameHMACSHA256}
+	sort.Strings(names)
+	return names
 }
 
+// SHA256Hasher is the default hasher.
 type SHA256Hasher struct{}
 
 func (h *SHA256Hasher) Hash(data []byte) []byte {
 	hash := sha256.Sum256(data)
 	return hash[:]
 }
+
+func (h *SHA256Hasher) Name() string {
+	return NameSHA256
+}
+
+// SHA512_256Hasher uses SHA-512/256, which is faster than SHA-256 on most
+// 64-bit CPUs without SHA extensions.
+type SHA512_256Hasher struct{}
+
+func (h *SHA512_256Hasher) Hash(data []byte) []byte {
+	hash := sha512.Sum512_256(data)
+	return hash[:]
+}
+
+func (h *SHA512_256Hasher) Name() string {
+	return NameSHA512_256
+}
+
+// FNVHasher uses 128-bit FNV-1a. It is fast but not collision resistant:
+// use it only for trusted data where speed matters more than tamper evidence.
+type FNVHasher struct{}
+
+func (h *FNVHasher) Hash(data []byte) []byte {
+	f := fnv.New128a()
+	f.Write(data)
+	return f.Sum(nil)
+}
+
+func (h *FNVHasher) Name() string {
+	return NameFNV128a
+}
+
+// HMACHasher keys SHA-256 with a secret, so only holders of the key can
+// produce or check matching hashes.
+type HMACHasher struct {
+	key   []byte
+	keyID string
+}
+
+// NewHMACHasher creates an HMAC-SHA256 hasher with the given key.
+func NewHMACHasher(key []byte) *HMACHasher {
+	h := &HMACHasher{key: append([]byte(nil), key...)}
+	// Fingerprint the key with the key itself, so the name exposes only
+	// another HMAC and never a plain hash of the key
+	h.keyID = hex.EncodeToString(h.Hash([]byte("merklediff key id"))[:8])
+	return h
+}
+
+func (h *HMACHasher) Hash(data []byte) []byte {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Name returns hmac-sha256 followed by a fingerprint of the key.
+func (h *HMACHasher) Name() string {
+	return NameHMACSHA256 + ":" + h.keyID
+}
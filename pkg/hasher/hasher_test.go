@@ -0,0 +1,64 @@
+package hasher
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNew_KnownNames(t *testing.T) {
+	for _, name := range Names() {
+		h, err := New(name, []byte("secret"))
+		if err != nil {
+			t.Fatalf("New(%q): %v", name, err)
+		}
+		if base, _, _ := strings.Cut(h.Name(), ":"); base != name {
+			t.Fatalf("expected name %q, got %q", name, h.Name())
+		}
+		if !bytes.Equal(h.Hash([]byte("a")), h.Hash([]byte("a"))) {
+			t.Fatalf("%s: hash is not deterministic", name)
+		}
+		if bytes.Equal(h.Hash([]byte("a")), h.Hash([]byte("b"))) {
+			t.Fatalf("%s: different inputs produced the same hash", name)
+		}
+	}
+}
+
+func TestNew_UnknownName(t *testing.T) {
+	if _, err := New("md5", nil); err == nil {
+		t.Fatal("expected error for unknown hasher")
+	}
+}
+
+func TestHMACHasher_RequiresKey(t *testing.T) {
+	if _, err := New(NameHMACSHA256, nil); !errors.Is(err, ErrKeyRequired) {
+		t.Fatalf("expected ErrKeyRequired for missing HMAC key, got %v", err)
+	}
+}
+
+func TestHMACHasher_KeyChangesHash(t *testing.T) {
+	a := NewHMACHasher([]byte("key-a")).Hash([]byte("row"))
+	b := NewHMACHasher([]byte("key-b")).Hash([]byte("row"))
+	if bytes.Equal(a, b) {
+		t.Fatal("expected different keys to produce different hashes")
+	}
+}
+
+func TestHMACHasher_NameIdentifiesKey(t *testing.T) {
+	a := NewHMACHasher([]byte("key-a"))
+	if a.Name() == NewHMACHasher([]byte("key-b")).Name() {
+		t.Fatal("expected different keys to produce different names")
+	}
+	if a.Name() != NewHMACHasher([]byte("key-a")).Name() {
+		t.Fatal("expected the same key to produce the same name")
+	}
+
+	// The full name round-trips only with the matching key
+	if h, err := New(a.Name(), []byte("key-a")); err != nil || h.Name() != a.Name() {
+		t.Fatalf("expected %s to round-trip, got %v", a.Name(), err)
+	}
+	if _, err := New(a.Name(), []byte("key-b")); err == nil {
+		t.Fatal("expected error for a key that does not match the name")
+	}
+}
@@ -1,6 +1,7 @@
 package reader
 
 import (
+	"context"
 	"strings"
 	"testing"
 
@@ -150,7 +151,9 @@ func TestCSVReader_MerkleTreeIntegration(t *testing.T) {
 	rB.Close()
 
 	diff := tree.NewDiff(treeA, treeB)
-	diff.Compare()
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
 
 	if len(diff.GetRanges()) == 0 {
 		t.Fatal("expected differences, got none")
@@ -170,7 +173,9 @@ func TestCSVReader_MerkleTreeFromTestdata(t *testing.T) {
 	treeB := tree.NewMerkleTreeFromRows(toTreeRows(rowsB))
 
 	diff := tree.NewDiff(treeA, treeB)
-	diff.Compare()
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
 
 	ranges := diff.GetRanges()
 	t.Logf("Found %d differences between sample.csv and sample_modified.csv", len(ranges))
@@ -239,7 +239,9 @@ func TestPostgresReader_FullFlow(t *testing.T) {
 		t.Logf("Target root: %x", targetTree.GetRoot().GetHash()[:16])
 
 		diff := tree.NewDiff(sourceTree, targetTree)
-		diff.Compare()
+		if err := diff.Compare(context.Background()); err != nil {
+			t.Fatalf("compare: %v", err)
+		}
 		ranges := diff.GetRanges()
 
 		t.Logf("Diff found %d difference ranges:", len(ranges))
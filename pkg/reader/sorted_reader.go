@@ -0,0 +1,677 @@
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/types"
+)
+
+// SortConfig configures the external merge sort used by SortedReader.
+type SortConfig struct {
+	// MemoryLimit is the approximate number of bytes of rows held in memory
+	// before a sorted run is spilled to disk (default: 64 MiB).
+	MemoryLimit int64
+
+	// TempDir is the directory sorted runs are spilled to
+	// (default: the system temp directory).
+	TempDir string
+
+	// MaxOpenRuns is the most runs merged at once. Larger sorts merge in
+	// several passes (default: 64).
+	MaxOpenRuns int
+}
+
+// DefaultSortConfig returns a default sort configuration.
+func DefaultSortConfig() SortConfig {
+	return SortConfig{
+		MemoryLimit: 64 << 20,
+		TempDir:     "",
+		MaxOpenRuns: 64,
+	}
+}
+
+// SortedReader wraps a RowReader and yields its rows ordered by key.
+//
+// The source is drained on the first call to Next. Rows are buffered up to
+// the memory limit, sorted, and spilled to a temporary file as a sorted run;
+// the runs are then merged. Rows with equal keys keep their source order.
+// Inputs that fit in memory never touch the disk.
+type SortedReader struct {
+	source types.RowReader
+	config SortConfig
+
+	// Sort state
+	started bool
+	buffer  []types.Row
+	bufSize int64
+	runDir  string
+	runs    []string
+	merger  *runMerger
+
+	// Iterator state
+	currentRow types.Row
+	err        error
+	done       bool
+}
+
+// NewSortedReader creates a SortedReader over source.
+// Closing the SortedReader also closes source.
+func NewSortedReader(source types.RowReader, config SortConfig) *SortedReader {
+	defaults := DefaultSortConfig()
+	if config.MemoryLimit <= 0 {
+		config.MemoryLimit = defaults.MemoryLimit
+	}
+	if config.MaxOpenRuns < 2 {
+		config.MaxOpenRuns = defaults.MaxOpenRuns
+	}
+	return &SortedReader{source: source, config: config}
+}
+
+// Schema returns the schema of the source.
+func (r *SortedReader) Schema() types.Schema {
+	return r.source.Schema()
+}
+
+// IsSorted always returns true.
+func (r *SortedReader) IsSorted() bool {
+	return true
+}
+
+// Next advances to the next row in key order.
+func (r *SortedReader) Next() bool {
+	if r.done || r.err != nil {
+		return false
+	}
+
+	if !r.started {
+		r.started = true
+		if err := r.sortInput(); err != nil {
+			r.err = err
+			return false
+		}
+	}
+
+	// Everything fit in memory: serve straight from the buffer
+	if r.merger == nil {
+		if len(r.buffer) == 0 {
+			r.done = true
+			return false
+		}
+		r.currentRow = r.buffer[0]
+		r.buffer = r.buffer[1:]
+		return true
+	}
+
+	row, ok, err := r.merger.next()
+	if err != nil {
+		r.err = err
+		return false
+	}
+	if !ok {
+		r.done = true
+		return false
+	}
+	r.currentRow = row
+	return true
+}
+
+// Row returns the current row.
+func (r *SortedReader) Row() types.Row {
+	return r.currentRow
+}
+
+// Err returns any error encountered while sorting or iterating.
+func (r *SortedReader) Err() error {
+	return r.err
+}
+
+// Close removes any spilled runs and closes the source.
+func (r *SortedReader) Close() error {
+	var errs []error
+	if r.merger != nil {
+		errs = append(errs, r.merger.close())
+	}
+	if r.runDir != "" {
+		errs = append(errs, os.RemoveAll(r.runDir))
+	}
+	errs = append(errs, r.source.Close())
+	return errors.Join(errs...)
+}
+
+// sortInput drains the source into sorted runs and prepares the merge.
+func (r *SortedReader) sortInput() error {
+	for r.source.Next() {
+		row := r.source.Row()
+		// Deep copy the row to avoid iterator reuse issues
+		rowCopy := types.Row{
+			Key:    append([]byte(nil), row.Key...),
+			Values: make([]any, len(row.Values)),
+		}
+		copy(rowCopy.Values, row.Values)
+
+		r.buffer = append(r.buffer, rowCopy)
+		r.bufSize += estimateRowSize(rowCopy)
+
+		if r.bufSize >= r.config.MemoryLimit {
+			if err := r.spill(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.source.Err(); err != nil {
+		return err
+	}
+
+	sortRows(r.buffer)
+	if len(r.runs) == 0 {
+		return nil
+	}
+
+	// Reduce the number of runs until one merge pass can open them all.
+	// The in-memory buffer takes one slot in the final merge.
+	for len(r.runs) > r.config.MaxOpenRuns-1 {
+		if err := r.mergePass(); err != nil {
+			return err
+		}
+	}
+
+	merger, err := newRunMerger(r.runs, r.buffer)
+	if err != nil {
+		return err
+	}
+	r.merger = merger
+	r.buffer = nil
+	return nil
+}
+
+// spill sorts the buffer and writes it to a new run file.
+func (r *SortedReader) spill() error {
+	if r.runDir == "" {
+		dir, err := os.MkdirTemp(r.config.TempDir, "merklediff-sort-")
+		if err != nil {
+			return fmt.Errorf("failed to create sort directory: %w", err)
+		}
+		r.runDir = dir
+	}
+
+	sortRows(r.buffer)
+
+	path, err := r.writeRun(func(w *runWriter) error {
+		for _, row := range r.buffer {
+			if err := w.write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.runs = append(r.runs, path)
+	r.buffer = r.buffer[:0]
+	r.bufSize = 0
+	return nil
+}
+
+// mergePass merges the oldest runs into one, preserving run order so equal
+// keys stay in source order.
+func (r *SortedReader) mergePass() error {
+	n := min(r.config.MaxOpenRuns, len(r.runs))
+	group := r.runs[:n]
+
+	merger, err := newRunMerger(group, nil)
+	if err != nil {
+		return err
+	}
+
+	path, err := r.writeRun(func(w *runWriter) error {
+		for {
+			row, ok, err := merger.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			if err := w.write(row); err != nil {
+				return err
+			}
+		}
+	})
+	if closeErr := merger.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, old := range group {
+		_ = os.Remove(old)
+	}
+	r.runs = append([]string{path}, r.runs[n:]...)
+	return nil
+}
+
+// writeRun creates a run file and fills it using fill.
+func (r *SortedReader) writeRun(fill func(w *runWriter) error) (string, error) {
+	f, err := os.CreateTemp(r.runDir, "run-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create sort run: %w", err)
+	}
+
+	w := &runWriter{w: bufio.NewWriter(f)}
+	if err := fill(w); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to write sort run: %w", err)
+	}
+	if err := w.w.Flush(); err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to write sort run: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write sort run: %w", err)
+	}
+	return filepath.Clean(f.Name()), nil
+}
+
+func sortRows(rows []types.Row) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return bytes.Compare(rows[i].Key, rows[j].Key) < 0
+	})
+}
+
+// estimateRowSize approximates the memory held by a row.
+func estimateRowSize(row types.Row) int64 {
+	size := int64(len(row.Key)) + 64
+	for _, v := range row.Values {
+		size += 16
+		switch val := v.(type) {
+		case string:
+			size += int64(len(val))
+		case []byte:
+			size += int64(len(val))
+		}
+	}
+	return size
+}
+
+// ────────────────────────────────────────────────────────────────────────────
+// Run merging
+// ────────────────────────────────────────────────────────────────────────────
+
+// runMerger performs a k-way merge of sorted runs.
+type runMerger struct {
+	files []*os.File
+	heap  runHeap
+}
+
+// runSource yields rows from one sorted run, either a file or memory.
+type runSource struct {
+	order  int // run position, used to keep equal keys in source order
+	reader *runReader
+	memory []types.Row
+	head   types.Row
+}
+
+func (s *runSource) advance() (bool, error) {
+	if s.reader == nil {
+		if len(s.memory) == 0 {
+			return false, nil
+		}
+		s.head = s.memory[0]
+		s.memory = s.memory[1:]
+		return true, nil
+	}
+
+	row, err := s.reader.read()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.head = row
+	return true, nil
+}
+
+func newRunMerger(paths []string, memory []types.Row) (*runMerger, error) {
+	m := &runMerger{}
+
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			m.close()
+			return nil, fmt.Errorf("failed to open sort run: %w", err)
+		}
+		m.files = append(m.files, f)
+		m.heap = append(m.heap, &runSource{order: i, reader: &runReader{r: bufio.NewReader(f)}})
+	}
+	if len(memory) > 0 {
+		m.heap = append(m.heap, &runSource{order: len(paths), memory: memory})
+	}
+
+	// Prime every source with its first row
+	primed := m.heap[:0]
+	for _, src := range m.heap {
+		ok, err := src.advance()
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		if ok {
+			primed = append(primed, src)
+		}
+	}
+	m.heap = primed
+	heap.Init(&m.heap)
+
+	return m, nil
+}
+
+func (m *runMerger) next() (types.Row, bool, error) {
+	if len(m.heap) == 0 {
+		return types.Row{}, false, nil
+	}
+
+	src := m.heap[0]
+	row := src.head
+
+	ok, err := src.advance()
+	if err != nil {
+		return types.Row{}, false, err
+	}
+	if ok {
+		heap.Fix(&m.heap, 0)
+	} else {
+		heap.Pop(&m.heap)
+	}
+	return row, true, nil
+}
+
+func (m *runMerger) close() error {
+	var errs []error
+	for _, f := range m.files {
+		errs = append(errs, f.Close())
+	}
+	m.files = nil
+	return errors.Join(errs...)
+}
+
+// runHeap orders run sources by their head key, then by run order.
+type runHeap []*runSource
+
+func (h runHeap) Len() int { return len(h) }
+
+func (h runHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].head.Key, h[j].head.Key); c != 0 {
+		return c < 0
+	}
+	return h[i].order < h[j].order
+}
+
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *runHeap) Push(x any) { *h = append(*h, x.(*runSource)) }
+
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// ────────────────────────────────────────────────────────────────────────────
+// Run file encoding
+// ────────────────────────────────────────────────────────────────────────────
+
+// Run files store rows as a length-prefixed key followed by type-tagged
+// values. Unlike the hashing serializer, the encoding is reversible and
+// keeps each value's Go type, so spilled rows hash and compare exactly like
+// the rows the source produced.
+const (
+	tagNil byte = iota
+	tagString
+	tagInt
+	tagInt64
+	tagInt32
+	tagInt16
+	tagInt8
+	tagUint
+	tagUint64
+	tagUint32
+	tagUint16
+	tagUint8
+	tagFloat64
+	tagFloat32
+	tagBool
+	tagBytes
+	tagTime
+)
+
+type runWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *runWriter) write(row types.Row) error {
+	w.writeBytes(row.Key)
+	w.writeUvarint(uint64(len(row.Values)))
+
+	for _, v := range row.Values {
+		switch val := v.(type) {
+		case nil:
+			w.w.WriteByte(tagNil)
+		case string:
+			w.w.WriteByte(tagString)
+			w.writeBytes([]byte(val))
+		case int:
+			w.w.WriteByte(tagInt)
+			w.writeVarint(int64(val))
+		case int64:
+			w.w.WriteByte(tagInt64)
+			w.writeVarint(val)
+		case int32:
+			w.w.WriteByte(tagInt32)
+			w.writeVarint(int64(val))
+		case int16:
+			w.w.WriteByte(tagInt16)
+			w.writeVarint(int64(val))
+		case int8:
+			w.w.WriteByte(tagInt8)
+			w.writeVarint(int64(val))
+		case uint:
+			w.w.WriteByte(tagUint)
+			w.writeUvarint(uint64(val))
+		case uint64:
+			w.w.WriteByte(tagUint64)
+			w.writeUvarint(val)
+		case uint32:
+			w.w.WriteByte(tagUint32)
+			w.writeUvarint(uint64(val))
+		case uint16:
+			w.w.WriteByte(tagUint16)
+			w.writeUvarint(uint64(val))
+		case uint8:
+			w.w.WriteByte(tagUint8)
+			w.writeUvarint(uint64(val))
+		case float64:
+			w.w.WriteByte(tagFloat64)
+			w.writeUvarint(math.Float64bits(val))
+		case float32:
+			w.w.WriteByte(tagFloat32)
+			w.writeUvarint(uint64(math.Float32bits(val)))
+		case bool:
+			w.w.WriteByte(tagBool)
+			if val {
+				w.w.WriteByte(1)
+			} else {
+				w.w.WriteByte(0)
+			}
+		case []byte:
+			w.w.WriteByte(tagBytes)
+			w.writeBytes(val)
+		case time.Time:
+			data, err := val.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			// MarshalBinary keeps the offset but not the zone name
+			name, _ := val.Zone()
+			w.w.WriteByte(tagTime)
+			w.writeBytes(data)
+			w.writeBytes([]byte(name))
+		default:
+			// Fallback: convert to string, as the tree serializer does
+			w.w.WriteByte(tagString)
+			w.writeBytes(fmt.Appendf(nil, "%v", val))
+		}
+	}
+	return nil
+}
+
+func (w *runWriter) writeUvarint(x uint64) {
+	n := binary.PutUvarint(w.buf[:], x)
+	w.w.Write(w.buf[:n])
+}
+
+func (w *runWriter) writeVarint(x int64) {
+	n := binary.PutVarint(w.buf[:], x)
+	w.w.Write(w.buf[:n])
+}
+
+func (w *runWriter) writeBytes(b []byte) {
+	w.writeUvarint(uint64(len(b)))
+	w.w.Write(b)
+}
+
+type runReader struct {
+	r *bufio.Reader
+}
+
+// read decodes the next row. It returns io.EOF at the end of the run.
+func (r *runReader) read() (types.Row, error) {
+	key, err := r.readBytes()
+	if err != nil {
+		// A clean EOF before the key means the run is finished
+		return types.Row{}, err
+	}
+
+	count, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return types.Row{}, unexpectedEOF(err)
+	}
+
+	values := make([]any, count)
+	for i := range values {
+		if values[i], err = r.readValue(); err != nil {
+			return types.Row{}, unexpectedEOF(err)
+		}
+	}
+	return types.Row{Key: key, Values: values}, nil
+}
+
+func (r *runReader) readValue() (any, error) {
+	tag, err := r.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case tagNil:
+		return nil, nil
+	case tagString:
+		b, err := r.readBytes()
+		return string(b), err
+	case tagBytes:
+		return r.readBytes()
+	case tagBool:
+		b, err := r.r.ReadByte()
+		return b == 1, err
+	case tagTime:
+		b, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		var t time.Time
+		if err := t.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		name, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if zone, offset := t.Zone(); len(name) > 0 && string(name) != zone {
+			t = t.In(time.FixedZone(string(name), offset))
+		}
+		return t, nil
+	case tagInt, tagInt64, tagInt32, tagInt16, tagInt8:
+		x, err := binary.ReadVarint(r.r)
+		switch tag {
+		case tagInt:
+			return int(x), err
+		case tagInt32:
+			return int32(x), err
+		case tagInt16:
+			return int16(x), err
+		case tagInt8:
+			return int8(x), err
+		default:
+			return x, err
+		}
+	case tagUint, tagUint64, tagUint32, tagUint16, tagUint8, tagFloat64, tagFloat32:
+		x, err := binary.ReadUvarint(r.r)
+		switch tag {
+		case tagUint:
+			return uint(x), err
+		case tagUint32:
+			return uint32(x), err
+		case tagUint16:
+			return uint16(x), err
+		case tagUint8:
+			return uint8(x), err
+		case tagFloat64:
+			return math.Float64frombits(x), err
+		case tagFloat32:
+			return math.Float32frombits(uint32(x)), err
+		default:
+			return x, err
+		}
+	default:
+		return nil, fmt.Errorf("corrupt sort run: unknown value tag %d", tag)
+	}
+}
+
+func (r *runReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+// unexpectedEOF reports a run that ends in the middle of a row.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Compile-time interface check
+var _ types.RowReader = (*SortedReader)(nil)
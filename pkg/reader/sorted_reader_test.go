@@ -0,0 +1,153 @@
+package reader
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/tree"
+	"github.com/BryceDouglasJames/merklediff/pkg/types"
+)
+
+// memReader is a RowReader over an in-memory slice.
+type memReader struct {
+	rows   []types.Row
+	pos    int
+	closed bool
+}
+
+func (r *memReader) Schema() types.Schema { return types.Schema{} }
+func (r *memReader) IsSorted() bool       { return false }
+func (r *memReader) Next() bool           { r.pos++; return r.pos <= len(r.rows) }
+func (r *memReader) Row() types.Row       { return r.rows[r.pos-1] }
+func (r *memReader) Err() error           { return nil }
+func (r *memReader) Close() error         { r.closed = true; return nil }
+
+func TestSortedReader_InMemory(t *testing.T) {
+	src := &memReader{rows: []types.Row{
+		{Key: []byte("c"), Values: []any{"c"}},
+		{Key: []byte("a"), Values: []any{"a"}},
+		{Key: []byte("b"), Values: []any{"b"}},
+	}}
+
+	r := NewSortedReader(src, DefaultSortConfig())
+	rows, err := CollectRows(r)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	var keys []string
+	for _, row := range rows {
+		keys = append(keys, string(row.Key))
+	}
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Fatalf("expected keys a,b,c, got %v", keys)
+	}
+	if !src.closed {
+		t.Fatal("expected Close to close the source")
+	}
+	if !r.IsSorted() {
+		t.Fatal("expected IsSorted() = true")
+	}
+}
+
+func TestSortedReader_SpillsAndMergesRuns(t *testing.T) {
+	var rows []types.Row
+	for i := 0; i < 500; i++ {
+		// Reverse order with a duplicate key every 50 rows
+		key := fmt.Sprintf("k%04d", (500-i)/2*2)
+		rows = append(rows, types.Row{Key: []byte(key), Values: []any{key, int64(i)}})
+	}
+
+	dir := t.TempDir()
+	config := SortConfig{MemoryLimit: 1024, TempDir: dir, MaxOpenRuns: 3}
+	r := NewSortedReader(&memReader{rows: rows}, config)
+
+	sorted, err := CollectRows(r)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if len(sorted) != len(rows) {
+		t.Fatalf("expected %d rows, got %d", len(rows), len(sorted))
+	}
+
+	for i := 1; i < len(sorted); i++ {
+		prev, cur := sorted[i-1], sorted[i]
+		switch c := bytes.Compare(prev.Key, cur.Key); {
+		case c > 0:
+			t.Fatalf("row %d: key %q after %q", i, cur.Key, prev.Key)
+		case c == 0 && prev.Values[1].(int64) > cur.Values[1].(int64):
+			t.Fatalf("row %d: equal keys lost their source order", i)
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("expected sort runs to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestSortedReader_PreservesValueTypes(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("EST", -5*3600))
+	values := []any{nil, "text", int64(-7), 42, int32(3), float64(1.5), float32(2.5), true, []byte{1, 2}, ts}
+
+	var rows []types.Row
+	for i := 0; i < 20; i++ {
+		rows = append(rows, types.Row{Key: fmt.Appendf(nil, "%02d", 19-i), Values: values})
+	}
+
+	r := NewSortedReader(&memReader{rows: rows}, SortConfig{MemoryLimit: 1, TempDir: t.TempDir()})
+	defer r.Close()
+
+	sorted, err := CollectRows(r)
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	for _, row := range sorted {
+		for i, want := range values {
+			got := row.Values[i]
+			if fmt.Sprintf("%T %v", got, got) != fmt.Sprintf("%T %v", want, want) {
+				t.Fatalf("value %d: expected %T %v, got %T %v", i, want, want, got, got)
+			}
+		}
+	}
+}
+
+func TestSortedReader_OrderIndependentTrees(t *testing.T) {
+	csvA := `id,name
+a1,Alice
+b2,Bob
+c3,Carol`
+
+	csvB := `id,name
+c3,Carol
+a1,Alice
+b2,Bob`
+
+	config := CSVReaderConfig{KeyColumns: []int{0}, HasHeader: true}
+	build := func(data string) *tree.MerkleTree {
+		csv, _ := NewCSVReaderWithConfig(strings.NewReader(data), config)
+		r := NewSortedReader(csv, SortConfig{MemoryLimit: 1, TempDir: t.TempDir()})
+		defer r.Close()
+
+		mt, err := tree.BuildTreeFromReader(r)
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		return mt
+	}
+
+	treeA, treeB := build(csvA), build(csvB)
+	if !bytes.Equal(treeA.GetRoot().GetHash(), treeB.GetRoot().GetHash()) {
+		t.Fatal("expected identical roots for the same rows in a different order")
+	}
+}
@@ -0,0 +1,155 @@
+package tree
+
+import (
+	"fmt"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
+
+// TreeShape selects how internal node boundaries are chosen.
+type TreeShape int
+
+const (
+	// ShapePositional pairs nodes by position. A row inserted near the start
+	// of the input shifts every later pair, so the whole tree changes.
+	ShapePositional TreeShape = iota
+
+	// ShapeContentDefined sorts leaves by key and derives every internal
+	// boundary from the keys themselves, so identical runs of rows always
+	// produce identical subtrees and an insert only rehashes its root path.
+	// Keys must be unique.
+	ShapeContentDefined
+)
+
+func (s TreeShape) String() string {
+	switch s {
+	case ShapePositional:
+		return "positional"
+	case ShapeContentDefined:
+		return "content"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseTreeShape converts a shape name ("positional" or "content") to a TreeShape.
+func ParseTreeShape(name string) (TreeShape, error) {
+	switch name {
+	case "", "positional":
+		return ShapePositional, nil
+	case "content", "content-defined":
+		return ShapeContentDefined, nil
+	default:
+		return 0, fmt.Errorf("unknown tree shape %q (want positional or content)", name)
+	}
+}
+
+// TreeFormat versions how leaves and internal nodes are hashed.
+// Trees built with different formats cannot be compared.
+type TreeFormat int
+
+const (
+	// FormatLegacy hashes leaves as H(values) and internal nodes as
+	// H(left || right) with no domain separation. It is kept so that roots
+	// published before FormatDomainSeparated can still be reproduced.
+	FormatLegacy TreeFormat = 1
+
+	// FormatDomainSeparated prefixes leaf hash inputs with 0x00 and internal
+	// hash inputs with 0x01 (RFC 6962 style) and binds each row's key into
+	// its leaf hash.
+	FormatDomainSeparated TreeFormat = 2
+
+	// CurrentFormat is the format used when none is configured.
+	CurrentFormat = FormatDomainSeparated
+)
+
+func (f TreeFormat) String() string {
+	return fmt.Sprintf("v%d", int(f))
+}
+
+// TreeConfig configures how a Merkle tree is built.
+type TreeConfig struct {
+	// Shape selects positional or content-defined node boundaries.
+	Shape TreeShape
+
+	// Hasher hashes leaves and internal nodes (default: SHA-256).
+	// Trees built with different hashers cannot be compared.
+	Hasher hasher.Hasher
+
+	// Format selects the hashing scheme (default: CurrentFormat).
+	Format TreeFormat
+
+	// Fanout is the number of children per internal node in positional
+	// trees, from MinFanout to MaxFanout (default: 2). Wider trees are
+	// shallower, so a diff visits fewer levels but hashes more siblings at
+	// each one. Content-defined trees are always binary.
+	Fanout int
+
+	// Workers is the number of goroutines that hash leaves and build
+	// subtrees (default: 1). The tree is identical for any number of
+	// workers; Workers only affects how long building takes.
+	Workers int
+}
+
+// Fan-out limits for positional trees.
+const (
+	MinFanout = 2
+	MaxFanout = 256
+)
+
+// DefaultTreeConfig returns the configuration used by the plain constructors.
+func DefaultTreeConfig() TreeConfig {
+	return TreeConfig{
+		Shape:   ShapePositional,
+		Hasher:  &hasher.SHA256Hasher{},
+		Format:  CurrentFormat,
+		Fanout:  MinFanout,
+		Workers: 1,
+	}
+}
+
+// treeHasher returns the node hasher for this configuration.
+func (c TreeConfig) treeHasher() treeHasher {
+	return treeHasher{hasher: c.Hasher, format: c.Format}
+}
+
+// withDefaults fills in unset fields from DefaultTreeConfig.
+func (c TreeConfig) withDefaults() TreeConfig {
+	if c.Hasher == nil {
+		c.Hasher = DefaultTreeConfig().Hasher
+	}
+	if c.Format == 0 {
+		c.Format = CurrentFormat
+	}
+	if c.Fanout == 0 {
+		c.Fanout = MinFanout
+	}
+	if c.Workers == 0 {
+		c.Workers = 1
+	}
+	return c
+}
+
+// Validate reports whether the configuration can be used to build a tree.
+func (c TreeConfig) Validate() error {
+	switch c.Shape {
+	case ShapePositional, ShapeContentDefined:
+	default:
+		return fmt.Errorf("invalid tree shape %d", c.Shape)
+	}
+	switch c.Format {
+	case FormatLegacy, FormatDomainSeparated:
+	default:
+		return fmt.Errorf("unsupported tree format %s", c.Format)
+	}
+	if c.Fanout < MinFanout || c.Fanout > MaxFanout {
+		return fmt.Errorf("fanout %d out of range [%d, %d]", c.Fanout, MinFanout, MaxFanout)
+	}
+	if c.Shape == ShapeContentDefined && c.Fanout != MinFanout {
+		return fmt.Errorf("content-defined trees are binary (fanout %d)", c.Fanout)
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("invalid worker count %d", c.Workers)
+	}
+	return nil
+}
@@ -2,7 +2,14 @@ package tree
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"iter"
+	"strconv"
+	"sync"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
 )
 
 type DiffType string
@@ -17,82 +24,526 @@ type KeyRange struct {
 	Start []byte
 	End   []byte
 	Type  DiffType
+
+	// RowsA and RowsB count the rows each tree holds in the range, taken
+	// from the node counts without visiting the rows.
+	RowsA int
+	RowsB int
 }
 
 type Diff struct {
-	treeA  *MerkleTree
-	treeB  *MerkleTree
-	ranges []KeyRange
+	treeA       *MerkleTree
+	treeB       *MerkleTree
+	hasher      hasher.Hasher
+	ranges      []KeyRange
+	concurrency int
+	stats       diffCounters
+
+	// byKey compares positional trees by key too, so that every key that
+	// differs falls in some range; see Merge
+	byKey bool
+
+	// onIdentical, if set, is called with each pair of subtrees the
+	// comparison skips as identical; see Export
+	onIdentical func(a, b *MerkleNode)
 }
 
 func NewDiff(treeA *MerkleTree, treeB *MerkleTree) *Diff {
 	return &Diff{treeA: treeA, treeB: treeB}
 }
 
+// NewDiffWithHasher creates a diff that only accepts trees built with h.
+func NewDiffWithHasher(treeA *MerkleTree, treeB *MerkleTree, h hasher.Hasher) *Diff {
+	return &Diff{treeA: treeA, treeB: treeB, hasher: h}
+}
+
+var (
+	// ErrHasherMismatch is returned when the trees, or the trees and the
+	// diff, use different hash functions.
+	ErrHasherMismatch = errors.New("hasher mismatch")
+
+	// ErrFormatMismatch is returned when the trees use different formats.
+	ErrFormatMismatch = errors.New("tree format mismatch")
+
+	// ErrFanoutMismatch is returned when positional trees use different
+	// fan-outs.
+	ErrFanoutMismatch = errors.New("fanout mismatch")
+
+	// ErrShapeMismatch is returned when one tree is positional and the
+	// other content-defined.
+	ErrShapeMismatch = errors.New("tree shape mismatch")
+)
+
+// MismatchError reports a setting that differs between two trees, which
+// makes them impossible to compare. It wraps one of ErrHasherMismatch,
+// ErrFormatMismatch, ErrFanoutMismatch or ErrShapeMismatch.
+type MismatchError struct {
+	Err  error
+	A, B string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%v: %s vs %s", e.Err, e.A, e.B)
+}
+
+func (e *MismatchError) Unwrap() error {
+	return e.Err
+}
+
+// SetConcurrency sets the number of goroutines Compare may use to explore
+// differing subtrees of positional trees at once. The default, 1, walks the
+// trees on the calling goroutine. Content-defined trees are matched by key
+// in a single ordered walk, so they are always compared on one goroutine.
+// Ranges are returned in the same order for any concurrency.
+func (d *Diff) SetConcurrency(n int) {
+	d.concurrency = n
+}
+
 // Compare populates the diff ranges between the two Merkle trees.
-func (d *Diff) Compare() {
-	if d.treeA.GetChunkSize() != d.treeB.GetChunkSize() {
-		panic(fmt.Errorf("chunk size mismatch: %d vs %d", d.treeA.GetChunkSize(), d.treeB.GetChunkSize()))
-	}
+// It returns a *MismatchError if the trees cannot be compared, and the
+// context's error if ctx is cancelled before the comparison finishes.
+func (d *Diff) Compare(ctx context.Context) error {
 	var differences []KeyRange
-	d.compareTreesRecursive(d.treeA.GetRoot(), d.treeB.GetRoot(), &differences)
+	err := d.walk(ctx, func(r KeyRange) bool {
+		differences = append(differences, r)
+		return true
+	})
+	if err != nil {
+		return err
+	}
 	d.ranges = differences
+	return nil
+}
+
+// Ranges compares the trees and yields each differing range as soon as it
+// is found, in the order Compare returns them, so callers can start on the
+// first ranges while the rest of the trees are still being compared.
+// Breaking out of the loop stops the comparison. If the trees cannot be
+// compared, or ctx is cancelled, the error is yielded once at the end.
+//
+// Ranges does not populate GetRanges. With a concurrency above 1, ranges
+// found by other goroutines are held back until every earlier range has
+// been yielded.
+func (d *Diff) Ranges(ctx context.Context) iter.Seq2[KeyRange, error] {
+	return func(yield func(KeyRange, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		err := d.walk(ctx, func(r KeyRange) bool {
+			if !yield(r, nil) {
+				// Stop any subtrees still being compared elsewhere
+				cancel()
+				return false
+			}
+			return true
+		})
+		if err != nil && !errors.Is(err, errStopped) {
+			yield(KeyRange{}, err)
+		}
+	}
 }
 
-func (d *Diff) compareTreesRecursive(treeANode *MerkleNode, treeBNode *MerkleNode, differences *[]KeyRange) {
+// emitFunc receives each differing range in order. It returns false to
+// stop the comparison.
+type emitFunc func(KeyRange) bool
+
+// errStopped ends a comparison whose emitFunc returned false.
+var errStopped = errors.New("comparison stopped")
+
+// send passes r to emit, returning errStopped if emit asks to stop.
+func send(emit emitFunc, r KeyRange) error {
+	if !emit(r) {
+		return errStopped
+	}
+	return nil
+}
+
+// walk compares the trees, passing each differing range to emit.
+func (d *Diff) walk(ctx context.Context, emit emitFunc) error {
+	if err := d.checkCompatible(); err != nil {
+		return err
+	}
+	d.stats.reset()
+	counted := func(r KeyRange) bool {
+		d.stats.ranges.Add(1)
+		return emit(r)
+	}
+	if d.usesOrderedCompare() {
+		return d.compareTreesOrdered(ctx, d.treeA.GetRoot(), d.treeB.GetRoot(), counted)
+	}
+
+	var tokens chan struct{}
+	if d.concurrency > 1 {
+		// The calling goroutine is one of the workers
+		tokens = make(chan struct{}, d.concurrency-1)
+	}
+	return d.compareTreesRecursive(ctx, tokens, d.treeA.GetRoot(), d.treeB.GetRoot(), 0, counted)
+}
+
+// checkCompatible reports whether the trees were built in ways that can be
+// compared node by node.
+func (d *Diff) checkCompatible() error {
+	configA, configB := d.treeA.GetConfig(), d.treeB.GetConfig()
+
+	// Hashes from different functions never match, so every node would differ
+	nameA, nameB := configA.Hasher.Name(), configB.Hasher.Name()
+	if nameA != nameB {
+		return &MismatchError{Err: ErrHasherMismatch, A: nameA, B: nameB}
+	}
+	if d.hasher != nil && d.hasher.Name() != nameA {
+		return &MismatchError{Err: ErrHasherMismatch, A: nameA, B: d.hasher.Name()}
+	}
+	// Roots from different formats hash the same data differently
+	if configA.Format != configB.Format {
+		return &MismatchError{Err: ErrFormatMismatch, A: configA.Format.String(), B: configB.Format.String()}
+	}
+	// A positional tree follows input order, which need not be key order,
+	// so it cannot be walked by key alongside a content-defined tree
+	if configA.Shape != configB.Shape {
+		return &MismatchError{Err: ErrShapeMismatch, A: configA.Shape.String(), B: configB.Shape.String()}
+	}
+	// Positional trees with different fan-outs group the same leaves
+	// differently; ordered comparison matches subtrees by key instead
+	if !d.usesOrderedCompare() && configA.Fanout != configB.Fanout {
+		return &MismatchError{Err: ErrFanoutMismatch, A: strconv.Itoa(configA.Fanout), B: strconv.Itoa(configB.Fanout)}
+	}
+	return nil
+}
+
+// usesOrderedCompare reports whether the trees must be compared by key
+// rather than by position. Content-defined trees only line up by key: an
+// insert can move a subtree to a different position without changing it.
+func (d *Diff) usesOrderedCompare() bool {
+	return d.byKey || d.treeA.GetConfig().Shape == ShapeContentDefined ||
+		d.treeB.GetConfig().Shape == ShapeContentDefined
+}
+
+// compareTreesRecursive compares two positional subtrees, pairing children
+// by position. tokens limits the goroutines exploring subtrees at once; a
+// nil tokens compares everything on this goroutine.
+func (d *Diff) compareTreesRecursive(ctx context.Context, tokens chan struct{}, treeANode *MerkleNode, treeBNode *MerkleNode, depth int, emit emitFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if treeANode == nil && treeBNode == nil {
-		return
+		return nil
 	}
+	d.stats.visit(depth, treeANode, treeBNode)
 
 	// only in B (added)
 	if treeANode == nil && treeBNode != nil {
-		*differences = append(*differences, KeyRange{
+		return send(emit, KeyRange{
 			Start: treeBNode.GetStartKey(),
 			End:   treeBNode.GetEndKey(),
 			Type:  DiffTypeAdded,
+			RowsB: treeBNode.GetCount(),
 		})
-		return
 	}
 
 	// only in A (removed)
 	if treeANode != nil && treeBNode == nil {
-		*differences = append(*differences, KeyRange{
+		return send(emit, KeyRange{
 			Start: treeANode.GetStartKey(),
 			End:   treeANode.GetEndKey(),
 			Type:  DiffTypeRemoved,
+			RowsA: treeANode.GetCount(),
 		})
-		return
+	}
+
+	if treeANode.IsLeaf() && treeBNode.IsLeaf() {
+		d.stats.leaves.Add(1)
 	}
 
 	// both non-nil: if hashes equal, subtrees identical
 	if bytes.Equal(treeANode.GetHash(), treeBNode.GetHash()) {
-		return
+		d.stats.pruned.Add(1)
+		d.matched(treeANode, treeBNode)
+		return nil
 	}
 
 	// Both leaves with different hashes = changed
 	if treeANode.IsLeaf() && treeBNode.IsLeaf() {
-		*differences = append(*differences, KeyRange{
+		return send(emit, KeyRange{
 			Start: treeANode.GetStartKey(),
 			End:   treeANode.GetEndKey(),
 			Type:  DiffTypeChanged,
+			RowsA: treeANode.GetCount(),
+			RowsB: treeBNode.GetCount(),
 		})
-		return
 	}
 
 	// Structure mismatch: one is leaf, other isn't
 	// This means trees were built differently - record as changed
 	if treeANode.IsLeaf() != treeBNode.IsLeaf() {
-		*differences = append(*differences, KeyRange{
+		return send(emit, KeyRange{
 			Start: minKey(treeANode.GetStartKey(), treeBNode.GetStartKey()),
 			End:   maxKey(treeANode.GetEndKey(), treeBNode.GetEndKey()),
 			Type:  DiffTypeChanged,
+			RowsA: treeANode.GetCount(),
+			RowsB: treeBNode.GetCount(),
 		})
-		return
 	}
 
-	// otherwise recurse down
-	d.compareTreesRecursive(treeANode.GetLeft(), treeBNode.GetLeft(), differences)
-	d.compareTreesRecursive(treeANode.GetRight(), treeBNode.GetRight(), differences)
+	// otherwise recurse down, pairing children by position
+	childrenA, childrenB := treeANode.GetChildren(), treeBNode.GetChildren()
+	if tokens != nil {
+		return d.compareChildrenConcurrent(ctx, tokens, childrenA, childrenB, depth+1, emit)
+	}
+	for i := 0; i < max(len(childrenA), len(childrenB)); i++ {
+		if err := d.compareTreesRecursive(ctx, tokens, childAt(childrenA, i), childAt(childrenB, i), depth+1, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareChildrenConcurrent compares pairs of children, handing each
+// differing pair to a new goroutine while a token is free and comparing it
+// on this goroutine otherwise. Each pair collects its own ranges, which are
+// passed on in child order so the result does not depend on scheduling.
+func (d *Diff) compareChildrenConcurrent(ctx context.Context, tokens chan struct{}, childrenA, childrenB []*MerkleNode, depth int, emit emitFunc) error {
+	n := max(len(childrenA), len(childrenB))
+	results := make([][]KeyRange, n)
+	errs := make([]error, n)
+	done := make([]chan struct{}, n)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for i := range n {
+		a, b := childAt(childrenA, i), childAt(childrenB, i)
+		collect := func(r KeyRange) bool {
+			results[i] = append(results[i], r)
+			return true
+		}
+
+		// Identical subtrees return at once, so are not worth a goroutine
+		if a == nil || b == nil || !bytes.Equal(a.GetHash(), b.GetHash()) {
+			select {
+			case tokens <- struct{}{}:
+				done[i] = make(chan struct{})
+				wg.Go(func() {
+					defer func() { <-tokens; close(done[i]) }()
+					errs[i] = d.compareTreesRecursive(ctx, tokens, a, b, depth, collect)
+				})
+				continue
+			default:
+			}
+		}
+		errs[i] = d.compareTreesRecursive(ctx, tokens, a, b, depth, collect)
+	}
+
+	// Pass each pair's ranges on as soon as every earlier pair has finished
+	for i := range n {
+		if done[i] != nil {
+			<-done[i]
+		}
+		if errs[i] != nil {
+			return errs[i]
+		}
+		for _, r := range results[i] {
+			if err := send(emit, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matched passes a pair of identical subtrees to onIdentical, if it is set.
+func (d *Diff) matched(a, b *MerkleNode) {
+	if d.onIdentical != nil {
+		d.onIdentical(a, b)
+	}
+}
+
+// childAt returns children[i], or nil if there are fewer children.
+func childAt(children []*MerkleNode, i int) *MerkleNode {
+	if i < len(children) {
+		return children[i]
+	}
+	return nil
+}
+
+// compareTreesOrdered walks both trees in key order, like a merge of two
+// sorted lists whose elements are whole subtrees. Identical subtrees are
+// skipped wherever they sit in their trees; only the higher of two differing
+// subtrees is expanded, so an identical subtree that sits at a different
+// depth on each side is still found and skipped.
+func (d *Diff) compareTreesOrdered(ctx context.Context, rootA *MerkleNode, rootB *MerkleNode, emit emitFunc) error {
+	cursorA := newNodeCursor(rootA)
+	cursorB := newNodeCursor(rootB)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		a, b := cursorA.peek(), cursorB.peek()
+
+		var err error
+		switch {
+		case a == nil && b == nil:
+			return nil
+
+		// only in B (added)
+		case a == nil:
+			err = send(emit, KeyRange{Start: b.GetStartKey(), End: b.GetEndKey(), Type: DiffTypeAdded, RowsB: b.GetCount()})
+			d.stats.visit(cursorB.pop(), nil, b)
+
+		// only in A (removed)
+		case b == nil:
+			err = send(emit, KeyRange{Start: a.GetStartKey(), End: a.GetEndKey(), Type: DiffTypeRemoved, RowsA: a.GetCount()})
+			d.stats.visit(cursorA.pop(), a, nil)
+
+		// same keys and hash: subtrees identical
+		case sameSubtree(a, b):
+			if a.IsLeaf() && b.IsLeaf() {
+				d.stats.leaves.Add(1)
+			}
+			d.stats.pruned.Add(1)
+			d.matched(a, b)
+			d.stats.visit(cursorA.pop(), a, nil)
+			d.stats.visit(cursorB.pop(), nil, b)
+
+		// A's subtree ends before B's begins: none of its keys are in B
+		case bytes.Compare(a.GetEndKey(), b.GetStartKey()) < 0:
+			err = send(emit, KeyRange{Start: a.GetStartKey(), End: a.GetEndKey(), Type: DiffTypeRemoved, RowsA: a.GetCount()})
+			d.stats.visit(cursorA.pop(), a, nil)
+
+		// B's subtree ends before A's begins: none of its keys are in A
+		case bytes.Compare(b.GetEndKey(), a.GetStartKey()) < 0:
+			err = send(emit, KeyRange{Start: b.GetStartKey(), End: b.GetEndKey(), Type: DiffTypeAdded, RowsB: b.GetCount()})
+			d.stats.visit(cursorB.pop(), nil, b)
+
+		// Overlapping leaves share a key, so the row changed
+		case a.IsLeaf() && b.IsLeaf() && a.GetLevel() == 0 && b.GetLevel() == 0:
+			err = send(emit, KeyRange{Start: a.GetStartKey(), End: a.GetEndKey(), Type: DiffTypeChanged, RowsA: a.GetCount(), RowsB: b.GetCount()})
+			d.stats.leaves.Add(1)
+			d.stats.visit(cursorA.pop(), a, nil)
+			d.stats.visit(cursorB.pop(), nil, b)
+
+		// A pruned subtree cannot be expanded, so report everything it overlaps
+		case a.IsLeaf() && b.IsLeaf():
+			d.stats.visit(cursorA.depth(), a, nil)
+			d.stats.visit(cursorB.depth(), nil, b)
+			err = send(emit, coverOverlap(cursorA, cursorB))
+
+		// otherwise expand the higher subtree
+		case b.IsLeaf() || (!a.IsLeaf() && a.GetLevel() >= b.GetLevel()):
+			d.stats.visit(cursorA.expand(), a, nil)
+
+		default:
+			d.stats.visit(cursorB.expand(), nil, b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// coverOverlap pops the top subtrees of both cursors, along with every
+// subtree that overlaps them, and returns one changed range covering all
+// of them. It is used when a pruned subtree has no children to expand.
+func coverOverlap(cursorA, cursorB *nodeCursor) KeyRange {
+	a, b := cursorA.peek(), cursorB.peek()
+	cursorA.pop()
+	cursorB.pop()
+
+	r := KeyRange{
+		Start: minKey(a.GetStartKey(), b.GetStartKey()),
+		End:   maxKey(a.GetEndKey(), b.GetEndKey()),
+		Type:  DiffTypeChanged,
+		RowsA: a.GetCount(),
+		RowsB: b.GetCount(),
+	}
+
+	for extended := true; extended; {
+		extended = false
+		for i, c := range []*nodeCursor{cursorA, cursorB} {
+			rows := &r.RowsA
+			if i == 1 {
+				rows = &r.RowsB
+			}
+			for n := c.peek(); n != nil && bytes.Compare(n.GetStartKey(), r.End) <= 0; n = c.peek() {
+				switch {
+				case bytes.Compare(n.GetEndKey(), r.End) <= 0:
+					*rows += n.GetCount()
+					c.pop()
+				case n.IsLeaf():
+					r.End = n.GetEndKey()
+					extended = true
+					*rows += n.GetCount()
+					c.pop()
+				default:
+					c.expand()
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+// sameSubtree reports whether two nodes cover the same keys with the same hash.
+func sameSubtree(a, b *MerkleNode) bool {
+	return bytes.Equal(a.GetHash(), b.GetHash()) &&
+		bytes.Equal(a.GetStartKey(), b.GetStartKey()) &&
+		bytes.Equal(a.GetEndKey(), b.GetEndKey())
+}
+
+// nodeCursor yields the subtrees of a tree in key order. The top of the
+// stack is the next subtree; expanding it replaces it with its children.
+type nodeCursor struct {
+	stack []cursorEntry
+}
+
+// cursorEntry is a subtree on a cursor's stack, with its depth below the root.
+type cursorEntry struct {
+	node  *MerkleNode
+	depth int
+}
+
+func newNodeCursor(root *MerkleNode) *nodeCursor {
+	c := &nodeCursor{}
+	if root != nil {
+		c.stack = append(c.stack, cursorEntry{node: root})
+	}
+	return c
+}
+
+func (c *nodeCursor) peek() *MerkleNode {
+	if len(c.stack) == 0 {
+		return nil
+	}
+	return c.stack[len(c.stack)-1].node
+}
+
+// depth returns the depth of the subtree on top of the stack.
+func (c *nodeCursor) depth() int {
+	return c.stack[len(c.stack)-1].depth
+}
+
+// pop removes the top subtree and returns its depth.
+func (c *nodeCursor) pop() int {
+	depth := c.depth()
+	c.stack = c.stack[:len(c.stack)-1]
+	return depth
+}
+
+// expand replaces the top subtree with its children and returns its depth.
+func (c *nodeCursor) expand() int {
+	node := c.peek()
+	depth := c.pop()
+	// Push in reverse so the first child is on top
+	children := node.GetChildren()
+	for i := len(children) - 1; i >= 0; i-- {
+		if children[i] != nil {
+			c.stack = append(c.stack, cursorEntry{node: children[i], depth: depth + 1})
+		}
+	}
+	return depth
 }
 
 func minKey(a, b []byte) []byte {
@@ -117,6 +568,14 @@ func (d *Diff) GetTreeB() *MerkleTree {
 	return d.treeB
 }
 
+// GetHasher returns the hasher both trees were built with.
+func (d *Diff) GetHasher() hasher.Hasher {
+	if d.hasher != nil {
+		return d.hasher
+	}
+	return d.treeA.GetConfig().Hasher
+}
+
 func (d *Diff) GetRanges() []KeyRange {
 	return d.ranges
 }
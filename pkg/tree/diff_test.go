@@ -2,7 +2,11 @@ package tree
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"testing"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
 )
 
 func TestDiff_IdenticalTrees(t *testing.T) {
@@ -15,7 +19,9 @@ func TestDiff_IdenticalTrees(t *testing.T) {
 	treeB := NewMerkleTreeFromChunks(chunks)
 
 	diff := NewDiff(treeA, treeB)
-	diff.Compare()
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
 
 	got := diff.GetRanges()
 	t.Logf("identical trees diff ranges: %+v", got)
@@ -38,7 +44,9 @@ func TestDiff_ChangedLeaf(t *testing.T) {
 	treeB := NewMerkleTreeFromChunks(chunksB)
 
 	diff := NewDiff(treeA, treeB)
-	diff.Compare()
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
 
 	ranges := diff.GetRanges()
 	t.Logf("changed leaf diff ranges: %+v", ranges)
@@ -79,7 +87,9 @@ func TestDiff_StructurallyDifferentTrees(t *testing.T) {
 		string(treeB.GetRoot().GetEndKey()))
 
 	diff := NewDiff(treeA, treeB)
-	diff.Compare()
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
 
 	ranges := diff.GetRanges()
 	t.Logf("structural diff ranges: %+v", ranges)
@@ -130,7 +140,9 @@ func TestDiff_ImbalancedTrees_StructuralMismatch(t *testing.T) {
 		treeB.GetRoot().GetLevel())
 
 	diff := NewDiff(treeA, treeB)
-	diff.Compare()
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
 
 	ranges := diff.GetRanges()
 	t.Logf("imbalanced trees diff ranges: %+v", ranges)
@@ -176,7 +188,9 @@ func TestDiff_ImbalancedTrees_OneSideDeeper(t *testing.T) {
 	t.Logf("Tree B root level: %d", treeB.GetRoot().GetLevel())
 
 	diff := NewDiff(treeA, treeB)
-	diff.Compare()
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
 
 	ranges := diff.GetRanges()
 	t.Logf("imbalanced (one side deeper) diff ranges: %+v", ranges)
@@ -193,3 +207,282 @@ func TestDiff_ImbalancedTrees_OneSideDeeper(t *testing.T) {
 		t.Fatalf("expected range chunk-2..chunk-2, got %q..%q", r.Start, r.End)
 	}
 }
+
+func TestDiff_HasherMismatch(t *testing.T) {
+	chunks := [][]byte{[]byte("a"), []byte("b")}
+
+	treeA := NewMerkleTreeFromChunks(chunks)
+	treeB, err := NewMerkleTreeFromChunksWithConfig(chunks, TreeConfig{Hasher: &hasher.FNVHasher{}})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	err = NewDiff(treeA, treeB).Compare(context.Background())
+	if !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("expected ErrHasherMismatch, got %v", err)
+	}
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) || mismatch.A != "sha256" || mismatch.B != "fnv128a" {
+		t.Fatalf("expected a MismatchError naming both hashers, got %#v", err)
+	}
+
+	err = NewDiffWithHasher(treeA, treeA, &hasher.FNVHasher{}).Compare(context.Background())
+	if !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("expected ErrHasherMismatch for the diff's hasher, got %v", err)
+	}
+}
+
+func TestDiff_ShapeMismatch(t *testing.T) {
+	rows := []Row{}
+	for _, k := range []string{"d", "a", "c", "b", "e"} {
+		rows = append(rows, Row{Key: []byte(k), Values: []any{k}})
+	}
+	positional := NewMerkleTreeFromRows(rows)
+	content, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Shape: ShapeContentDefined})
+
+	for _, diff := range []*Diff{NewDiff(positional, content), NewDiff(content, positional)} {
+		err := diff.Compare(context.Background())
+		if !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("expected ErrShapeMismatch, got %v", err)
+		}
+		var mismatch *MismatchError
+		if !errors.As(err, &mismatch) || mismatch.A == mismatch.B {
+			t.Fatalf("expected a MismatchError naming both shapes, got %#v", err)
+		}
+	}
+}
+
+func TestDiff_HMACKeyMismatch(t *testing.T) {
+	chunks := [][]byte{[]byte("a"), []byte("b")}
+	treeA, _ := NewMerkleTreeFromChunksWithConfig(chunks, TreeConfig{Hasher: hasher.NewHMACHasher([]byte("key-a"))})
+	treeB, _ := NewMerkleTreeFromChunksWithConfig(chunks, TreeConfig{Hasher: hasher.NewHMACHasher([]byte("key-b"))})
+
+	err := NewDiff(treeA, treeB).Compare(context.Background())
+	if !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("expected ErrHasherMismatch for different keys, got %v", err)
+	}
+
+	same, _ := NewMerkleTreeFromChunksWithConfig(chunks, TreeConfig{Hasher: hasher.NewHMACHasher([]byte("key-a"))})
+	if err := NewDiff(treeA, same).Compare(context.Background()); err != nil {
+		t.Fatalf("expected trees with the same key to compare, got %v", err)
+	}
+}
+
+func TestDiff_WithHasher(t *testing.T) {
+	config := TreeConfig{Hasher: &hasher.SHA512_256Hasher{}}
+	treeA, _ := NewMerkleTreeFromRowsWithConfig(makeRows(10), config)
+	treeB, _ := NewMerkleTreeFromRowsWithConfig(makeRows(11), config)
+
+	diff := NewDiffWithHasher(treeA, treeB, &hasher.SHA512_256Hasher{})
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	if len(diff.GetRanges()) == 0 {
+		t.Fatal("expected differences")
+	}
+	if diff.GetHasher().Name() != hasher.NameSHA512_256 {
+		t.Fatalf("expected hasher %s, got %s", hasher.NameSHA512_256, diff.GetHasher().Name())
+	}
+}
+
+func TestDiff_FormatMismatch(t *testing.T) {
+	rows := makeRows(4)
+	treeA, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Format: FormatLegacy})
+	treeB := NewMerkleTreeFromRows(rows)
+
+	if err := NewDiff(treeA, treeB).Compare(context.Background()); !errors.Is(err, ErrFormatMismatch) {
+		t.Fatalf("expected ErrFormatMismatch, got %v", err)
+	}
+}
+
+func TestDiff_NaryTrees(t *testing.T) {
+	rows := makeRows(100)
+	changed := make([]Row, len(rows))
+	copy(changed, rows)
+	changed[42] = Row{Key: rows[42].Key, Values: []any{"changed", int64(-1)}}
+
+	config := TreeConfig{Fanout: 8}
+	treeA, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+	treeB, _ := NewMerkleTreeFromRowsWithConfig(changed, config)
+
+	diff := NewDiff(treeA, treeB)
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	ranges := diff.GetRanges()
+	if len(ranges) != 1 {
+		t.Fatalf("expected 1 range, got %d: %v", len(ranges), ranges)
+	}
+	if ranges[0].Type != DiffTypeChanged || !bytes.Equal(ranges[0].Start, rows[42].Key) {
+		t.Fatalf("expected changed %q, got %s %q", rows[42].Key, ranges[0].Type, ranges[0].Start)
+	}
+}
+
+func TestDiff_FanoutMismatch(t *testing.T) {
+	rows := makeRows(10)
+	treeA := NewMerkleTreeFromRows(rows)
+	treeB, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Fanout: 4})
+
+	if err := NewDiff(treeA, treeB).Compare(context.Background()); !errors.Is(err, ErrFanoutMismatch) {
+		t.Fatalf("expected ErrFanoutMismatch, got %v", err)
+	}
+}
+
+func TestDiff_DifferentKeyLengths(t *testing.T) {
+	// The first keys differ in length, which must not stop the comparison
+	treeA := NewMerkleTreeFromRows([]Row{{Key: []byte("a"), Values: []any{1}}, {Key: []byte("b"), Values: []any{2}}})
+	treeB := NewMerkleTreeFromRows([]Row{{Key: []byte("aaaa"), Values: []any{1}}, {Key: []byte("b"), Values: []any{2}}})
+
+	diff := NewDiff(treeA, treeB)
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+	if len(diff.GetRanges()) == 0 {
+		t.Fatal("expected differences between trees with different keys")
+	}
+}
+
+func TestDiff_Cancelled(t *testing.T) {
+	for _, config := range []TreeConfig{{}, {Shape: ShapeContentDefined}} {
+		treeA, _ := NewMerkleTreeFromRowsWithConfig(makeRows(100), config)
+		treeB, _ := NewMerkleTreeFromRowsWithConfig(makeRows(120), config)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		diff := NewDiff(treeA, treeB)
+		if err := diff.Compare(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%+v: expected context.Canceled, got %v", config, err)
+		}
+		if len(diff.GetRanges()) != 0 {
+			t.Fatalf("%+v: expected no ranges from a cancelled compare", config)
+		}
+	}
+}
+
+func TestDiff_ConcurrentMatchesSequential(t *testing.T) {
+	rows := makeRows(3000)
+	changed := append([]Row(nil), rows[:2900]...)
+	for i := 0; i < len(changed); i += 37 {
+		changed[i] = Row{Key: rows[i].Key, Values: []any{"changed", int64(i)}}
+	}
+
+	for _, config := range []TreeConfig{{}, {Fanout: 7}} {
+		treeA, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		treeB, _ := NewMerkleTreeFromRowsWithConfig(changed, config)
+
+		sequential := NewDiff(treeA, treeB)
+		if err := sequential.Compare(context.Background()); err != nil {
+			t.Fatalf("compare: %v", err)
+		}
+
+		for _, concurrency := range []int{2, 4, 64} {
+			diff := NewDiff(treeA, treeB)
+			diff.SetConcurrency(concurrency)
+			if err := diff.Compare(context.Background()); err != nil {
+				t.Fatalf("compare: %v", err)
+			}
+			got, want := diff.GetRanges(), sequential.GetRanges()
+			if len(got) != len(want) {
+				t.Fatalf("%+v: expected %d ranges with concurrency %d, got %d", config, len(want), concurrency, len(got))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i].Start, want[i].Start) || !bytes.Equal(got[i].End, want[i].End) || got[i].Type != want[i].Type {
+					t.Fatalf("%+v: range %d differs with concurrency %d: %+v vs %+v", config, i, concurrency, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestDiff_ConcurrentCancelled(t *testing.T) {
+	treeA := NewMerkleTreeFromRows(makeRows(1000))
+	treeB := NewMerkleTreeFromRows(makeRows(1200))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	diff := NewDiff(treeA, treeB)
+	diff.SetConcurrency(8)
+	if err := diff.Compare(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestDiff_RangesMatchesCompare(t *testing.T) {
+	rows := makeRows(2000)
+	changed := append([]Row(nil), rows[50:]...)
+	for i := 0; i < len(changed); i += 101 {
+		changed[i] = Row{Key: changed[i].Key, Values: []any{"changed", int64(i)}}
+	}
+
+	for _, config := range []TreeConfig{{}, {Shape: ShapeContentDefined}} {
+		treeA, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		treeB, _ := NewMerkleTreeFromRowsWithConfig(changed, config)
+
+		want := NewDiff(treeA, treeB)
+		if err := want.Compare(context.Background()); err != nil {
+			t.Fatalf("compare: %v", err)
+		}
+
+		for _, concurrency := range []int{1, 4} {
+			diff := NewDiff(treeA, treeB)
+			diff.SetConcurrency(concurrency)
+
+			var got []KeyRange
+			for r, err := range diff.Ranges(context.Background()) {
+				if err != nil {
+					t.Fatalf("ranges: %v", err)
+				}
+				got = append(got, r)
+			}
+			if len(got) != len(want.GetRanges()) {
+				t.Fatalf("%+v: expected %d ranges, got %d", config, len(want.GetRanges()), len(got))
+			}
+			for i, r := range want.GetRanges() {
+				if !bytes.Equal(got[i].Start, r.Start) || got[i].Type != r.Type {
+					t.Fatalf("%+v: range %d differs: %+v vs %+v", config, i, got[i], r)
+				}
+			}
+		}
+	}
+}
+
+func TestDiff_RangesStopsEarly(t *testing.T) {
+	treeA := NewMerkleTreeFromRows(makeRows(1000))
+	treeB := NewMerkleTreeFromRows(makeRows(500))
+
+	for _, concurrency := range []int{1, 4} {
+		diff := NewDiff(treeA, treeB)
+		diff.SetConcurrency(concurrency)
+
+		seen := 0
+		for _, err := range diff.Ranges(context.Background()) {
+			if err != nil {
+				t.Fatalf("ranges: %v", err)
+			}
+			seen++
+			if seen == 2 {
+				break
+			}
+		}
+		if seen != 2 {
+			t.Fatalf("expected to stop after 2 ranges, saw %d", seen)
+		}
+	}
+}
+
+func TestDiff_RangesYieldsError(t *testing.T) {
+	treeA := NewMerkleTreeFromRows(makeRows(10))
+	treeB, _ := NewMerkleTreeFromRowsWithConfig(makeRows(10), TreeConfig{Format: FormatLegacy})
+
+	var errs []error
+	for _, err := range NewDiff(treeA, treeB).Ranges(context.Background()) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrFormatMismatch) {
+		t.Fatalf("expected a single ErrFormatMismatch, got %v", errs)
+	}
+}
@@ -0,0 +1,187 @@
+package tree
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// ExportNode is a node of a tree exported for inspection, as a plain value
+// that can be encoded as JSON or written as Graphviz DOT.
+type ExportNode struct {
+	Hash     string `json:"hash"`
+	StartKey string `json:"start_key"`
+	EndKey   string `json:"end_key"`
+	Level    int    `json:"level"`
+	Rows     int    `json:"rows"`
+
+	// Changed and Identical are only set when exporting a diff: an
+	// identical node was matched with an identical subtree of the other
+	// tree and skipped by the comparison, while a changed one was not.
+	Changed   bool `json:"changed,omitempty"`
+	Identical bool `json:"identical,omitempty"`
+
+	// Truncated reports that the node has children that were not
+	// exported, because of the depth limit or because it is identical.
+	Truncated bool `json:"truncated,omitempty"`
+
+	Children []*ExportNode `json:"children,omitempty"`
+}
+
+// ExportedTree is a named exported tree.
+type ExportedTree struct {
+	Name string      `json:"name"`
+	Root *ExportNode `json:"root,omitempty"`
+}
+
+// ExportTree exports the top maxDepth levels below the root of t, or the
+// whole tree if maxDepth is 0.
+func ExportTree(t *MerkleTree, maxDepth int) *ExportNode {
+	return exportNode(t.GetRoot(), 0, maxDepth, nil)
+}
+
+// Export exports the region of both trees that a comparison explores. It
+// walks the trees exactly as Compare does: subtrees Compare skips as
+// identical are marked identical and not expanded, and every other node is
+// marked changed and expanded, down to maxDepth levels below the roots (0
+// for no limit). Like Compare, it returns a *MismatchError if the trees
+// cannot be compared.
+func (d *Diff) Export(maxDepth int) (a, b *ExportNode, err error) {
+	// Walk a copy, on one goroutine, so this diff's stats are left alone
+	// and the marks need no locking
+	identicalA, identicalB := make(map[*MerkleNode]bool), make(map[*MerkleNode]bool)
+	walker := &Diff{
+		treeA:  d.treeA,
+		treeB:  d.treeB,
+		hasher: d.hasher,
+		byKey:  d.byKey,
+		onIdentical: func(a, b *MerkleNode) {
+			identicalA[a], identicalB[b] = true, true
+		},
+	}
+	if err := walker.walk(context.Background(), func(KeyRange) bool { return true }); err != nil {
+		return nil, nil, err
+	}
+
+	a = exportNode(d.treeA.GetRoot(), 0, maxDepth, identicalA)
+	b = exportNode(d.treeB.GetRoot(), 0, maxDepth, identicalB)
+	return a, b, nil
+}
+
+// exportNode exports n and, depth permitting, its children. If identical
+// is non-nil, n is marked by whether the comparison skipped it.
+func exportNode(n *MerkleNode, depth, maxDepth int, identical map[*MerkleNode]bool) *ExportNode {
+	if n == nil {
+		return nil
+	}
+	e := &ExportNode{
+		Hash:     hex.EncodeToString(n.GetHash()),
+		StartKey: displayKey(n.GetStartKey()),
+		EndKey:   displayKey(n.GetEndKey()),
+		Level:    n.GetLevel(),
+		Rows:     n.GetCount(),
+	}
+
+	expand := maxDepth == 0 || depth < maxDepth
+	if identical != nil {
+		e.Identical = identical[n]
+		e.Changed = !e.Identical
+		expand = expand && e.Changed
+	}
+
+	if !expand {
+		e.Truncated = !n.IsLeaf()
+		return e
+	}
+	for _, child := range n.GetChildren() {
+		if c := exportNode(child, depth+1, maxDepth, identical); c != nil {
+			e.Children = append(e.Children, c)
+		}
+	}
+	return e
+}
+
+// displayKey renders a key as text, or as hex if it is not valid UTF-8.
+func displayKey(key []byte) string {
+	if utf8.Valid(key) {
+		return string(key)
+	}
+	return "0x" + hex.EncodeToString(key)
+}
+
+// WriteDOT writes trees as a Graphviz digraph, one cluster per tree.
+// Changed nodes are filled red and identical ones green; a dashed border
+// marks a node whose children were not exported.
+func WriteDOT(w io.Writer, trees ...ExportedTree) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph merkle {")
+	fmt.Fprintln(bw, `  node [shape=box, fontname="monospace", fontsize=10];`)
+
+	for i, t := range trees {
+		fmt.Fprintf(bw, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(bw, "    label=%s;\n", dotQuote(t.Name))
+		next := 0
+		writeDOTNode(bw, t.Root, fmt.Sprintf("t%d_", i), &next, "")
+		fmt.Fprintln(bw, "  }")
+	}
+
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// writeDOTNode writes n and its subtree, naming nodes prefix0, prefix1, ...
+// in pre-order, with an edge from parent if there is one.
+func writeDOTNode(w io.Writer, n *ExportNode, prefix string, next *int, parent string) {
+	if n == nil {
+		return
+	}
+	id := fmt.Sprintf("%s%d", prefix, *next)
+	*next++
+
+	hash := n.Hash
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	label := fmt.Sprintf("L%d %s\n%s .. %s\n%d rows", n.Level, hash, n.StartKey, n.EndKey, n.Rows)
+
+	var fill string
+	var styles []string
+	switch {
+	case n.Changed:
+		fill = "#f4cccc"
+	case n.Identical:
+		fill = "#d9ead3"
+	}
+	if fill != "" {
+		styles = append(styles, "filled")
+	}
+	if n.Truncated {
+		styles = append(styles, "dashed")
+	}
+
+	attrs := []string{"label=" + dotQuote(label)}
+	if len(styles) > 0 {
+		attrs = append(attrs, "style="+dotQuote(strings.Join(styles, ",")))
+	}
+	if fill != "" {
+		attrs = append(attrs, "fillcolor="+dotQuote(fill))
+	}
+
+	fmt.Fprintf(w, "    %s [%s];\n", id, strings.Join(attrs, ", "))
+	if parent != "" {
+		fmt.Fprintf(w, "    %s -> %s;\n", parent, id)
+	}
+	for _, child := range n.Children {
+		writeDOTNode(w, child, prefix, next, id)
+	}
+}
+
+// dotQuote quotes s as a DOT string.
+func dotQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,119 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
+
+// countExported returns the number of nodes in an exported tree and how
+// many of them are marked changed.
+func countExported(n *ExportNode) (nodes, changed int) {
+	if n == nil {
+		return 0, 0
+	}
+	nodes = 1
+	if n.Changed {
+		changed = 1
+	}
+	for _, c := range n.Children {
+		cn, cc := countExported(c)
+		nodes += cn
+		changed += cc
+	}
+	return nodes, changed
+}
+
+func TestExportTree_DepthLimit(t *testing.T) {
+	mt := NewMerkleTreeFromRows(makeRows(64))
+
+	if nodes, _ := countExported(ExportTree(mt, 0)); nodes != 127 {
+		t.Fatalf("expected the whole tree of 127 nodes, got %d", nodes)
+	}
+
+	root := ExportTree(mt, 2)
+	if nodes, _ := countExported(root); nodes != 7 {
+		t.Fatalf("expected 7 nodes in the top 3 levels, got %d", nodes)
+	}
+	if root.Truncated || !root.Children[0].Children[0].Truncated {
+		t.Fatal("expected only the nodes at the depth limit to be truncated")
+	}
+}
+
+func TestDiffExport_MarksChangedPath(t *testing.T) {
+	rows := makeRows(64)
+	diff := NewDiff(NewMerkleTreeFromRows(rows), NewMerkleTreeFromRows(changeRow(rows, 20)))
+
+	a, b, err := diff.Export(0)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	for _, root := range []*ExportNode{a, b} {
+		// The root path of the changed row, plus an identical sibling at
+		// each of its 6 levels
+		nodes, changed := countExported(root)
+		if changed != 7 || nodes != 13 {
+			t.Fatalf("expected 7 changed of 13 nodes, got %d of %d", changed, nodes)
+		}
+	}
+	if !a.Children[0].Children[0].Identical || !a.Children[1].Identical {
+		t.Fatal("expected subtrees without the change to be marked identical")
+	}
+}
+
+func TestDiffExport_PairsNodesLikeCompare(t *testing.T) {
+	// B's first half matches A's second half, but Compare pairs it with
+	// A's first half, so neither is skipped
+	chunk := func(s ...string) [][]byte {
+		out := make([][]byte, len(s))
+		for i := range s {
+			out[i] = []byte(s[i])
+		}
+		return out
+	}
+	treeA := NewMerkleTreeFromChunks(chunk("a", "b", "x", "y"))
+	treeB := NewMerkleTreeFromChunks(chunk("x", "y", "c", "d"))
+
+	a, b, err := NewDiff(treeA, treeB).Export(0)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !a.Children[1].Changed || !b.Children[0].Changed {
+		t.Fatal("expected subtrees paired with different ones to be marked changed")
+	}
+
+	other, _ := NewMerkleTreeFromChunksWithConfig(chunk("a", "b"), TreeConfig{Hasher: &hasher.FNVHasher{}})
+	_, _, err = NewDiff(treeA, other).Export(0)
+	if !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("expected ErrHasherMismatch, got %v", err)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	rows := makeRows(8)
+	diff := NewDiff(NewMerkleTreeFromRows(rows), NewMerkleTreeFromRows(changeRow(rows, 3)))
+	a, b, _ := diff.Export(0)
+
+	var buf bytes.Buffer
+	if err := WriteDOT(&buf, ExportedTree{Name: `Tree "A"`, Root: a}, ExportedTree{Name: "Tree B", Root: b}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"digraph merkle {",
+		`label="Tree \"A\"";`,
+		"subgraph cluster_1 {",
+		`fillcolor="#f4cccc"`,
+		`style="filled,dashed"`,
+		"t0_0 -> t0_1;",
+		`k00030 .. k00030`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected DOT output to contain %q:\n%s", want, out)
+		}
+	}
+}
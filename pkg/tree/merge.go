@@ -0,0 +1,118 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+)
+
+// MergeKind classifies a key that changed since the base of a three-way
+// merge.
+type MergeKind string
+
+const (
+	// MergeOurs is a key changed only in ours.
+	MergeOurs MergeKind = "ours"
+
+	// MergeTheirs is a key changed only in theirs.
+	MergeTheirs MergeKind = "theirs"
+
+	// MergeBoth is a key changed the same way in both, including a key
+	// removed from both.
+	MergeBoth MergeKind = "both"
+
+	// MergeConflict is a key changed differently in ours and theirs.
+	MergeConflict MergeKind = "conflict"
+)
+
+// MergeChange is a key that differs from the base in ours, theirs or both.
+type MergeChange struct {
+	Key  []byte
+	Kind MergeKind
+
+	// Base, Ours and Theirs are the key's leaves in each tree, or nil
+	// where the tree does not hold the key.
+	Base, Ours, Theirs *MerkleNode
+}
+
+// Merge is a three-way comparison of two trees that were both derived from
+// a common base, such as two editors' copies of the same dataset.
+type Merge struct {
+	base, ours, theirs *MerkleTree
+	changes            []MergeChange
+	concurrency        int
+}
+
+// NewMerge creates a three-way comparison of ours and theirs against base.
+func NewMerge(base, ours, theirs *MerkleTree) *Merge {
+	return &Merge{base: base, ours: ours, theirs: theirs}
+}
+
+// SetConcurrency sets the number of goroutines each underlying Diff may
+// use; see Diff.SetConcurrency.
+func (m *Merge) SetConcurrency(n int) {
+	m.concurrency = n
+}
+
+// Compare classifies every key that changed since the base. Ours and theirs
+// are each diffed against the base, and the keys in the differing ranges
+// are classified by their leaf hashes in all three trees. If a tree's
+// leaves are not in key order, ranges cannot be mapped back to keys, so
+// every leaf is classified instead.
+//
+// It returns the same errors as Diff.Compare, and ErrPrunedSubtree if a
+// differing range reaches a pruned subtree.
+func (m *Merge) Compare(ctx context.Context) error {
+	keys, index, err := changedKeys(ctx, []*MerkleTree{m.base, m.ours, m.theirs}, m.concurrency)
+	if err != nil {
+		return err
+	}
+
+	m.changes = nil
+	for _, key := range keys {
+		base, ours, theirs := index[0][key], index[1][key], index[2][key]
+		if kind, changed := classifyMerge(base, ours, theirs); changed {
+			m.changes = append(m.changes, MergeChange{
+				Key:    []byte(key),
+				Kind:   kind,
+				Base:   base,
+				Ours:   ours,
+				Theirs: theirs,
+			})
+		}
+	}
+	return nil
+}
+
+// GetChanges returns the changed keys found by the last Compare, in key
+// order.
+func (m *Merge) GetChanges() []MergeChange {
+	return m.changes
+}
+
+// classifyMerge classifies a key from its leaves in each tree, reporting
+// false if neither side changed it.
+func classifyMerge(base, ours, theirs *MerkleNode) (MergeKind, bool) {
+	oursChanged := !sameLeaf(base, ours)
+	theirsChanged := !sameLeaf(base, theirs)
+	switch {
+	case !oursChanged && !theirsChanged:
+		return "", false
+	case !theirsChanged:
+		return MergeOurs, true
+	case !oursChanged:
+		return MergeTheirs, true
+	case sameLeaf(ours, theirs):
+		return MergeBoth, true
+	default:
+		return MergeConflict, true
+	}
+}
+
+// sameLeaf reports whether two leaves, either of which may be missing,
+// hold the same row.
+func sameLeaf(a, b *MerkleNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.GetHash(), b.GetHash())
+}
@@ -0,0 +1,106 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// editRows returns a copy of rows with the rows at the given indices set to
+// value, or removed if value is empty, plus the extra rows in key order.
+func editRows(rows []Row, edits map[int]string, extra ...Row) []Row {
+	var out []Row
+	for i, row := range rows {
+		value, ok := edits[i]
+		switch {
+		case !ok:
+			out = append(out, row)
+		case value != "":
+			out = append(out, Row{Key: row.Key, Values: []any{value, int64(i)}})
+		}
+	}
+	out = append(out, extra...)
+	slices.SortFunc(out, func(a, b Row) int { return bytes.Compare(a.Key, b.Key) })
+	return out
+}
+
+func TestMerge_Classifies(t *testing.T) {
+	base := makeRows(100)
+	ours := editRows(base,
+		map[int]string{10: "ours", 20: "same", 30: "ours", 40: "", 60: "", 70: ""},
+		Row{Key: []byte("k00555"), Values: []any{"new", int64(0)}})
+	theirs := editRows(base,
+		map[int]string{20: "same", 30: "theirs", 50: "theirs", 60: "", 70: "theirs"},
+		Row{Key: []byte("k00777"), Values: []any{"new", int64(0)}})
+
+	want := []struct {
+		key  string
+		kind MergeKind
+	}{
+		{"k00100", MergeOurs},
+		{"k00200", MergeBoth},
+		{"k00300", MergeConflict},
+		{"k00400", MergeOurs},
+		{"k00500", MergeTheirs},
+		{"k00555", MergeOurs},
+		{"k00600", MergeBoth},
+		{"k00700", MergeConflict},
+		{"k00777", MergeTheirs},
+	}
+
+	shuffle := func(rows []Row) []Row {
+		shuffled := append([]Row(nil), rows...)
+		rand.New(rand.NewPCG(1, 2)).Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		return shuffled
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config TreeConfig
+		order  func([]Row) []Row
+	}{
+		{"positional", TreeConfig{}, slices.Clone[[]Row]},
+		{"content", TreeConfig{Shape: ShapeContentDefined}, slices.Clone[[]Row]},
+		{"unsorted", TreeConfig{Fanout: 4}, shuffle},
+	} {
+		build := func(rows []Row) *MerkleTree {
+			mt, _ := NewMerkleTreeFromRowsWithConfig(tc.order(rows), tc.config)
+			return mt
+		}
+		merge := NewMerge(build(base), build(ours), build(theirs))
+		if err := merge.Compare(context.Background()); err != nil {
+			t.Fatalf("%s: compare: %v", tc.name, err)
+		}
+
+		changes := merge.GetChanges()
+		if len(changes) != len(want) {
+			t.Fatalf("%s: expected %d changes, got %d", tc.name, len(want), len(changes))
+		}
+		for i, w := range want {
+			if string(changes[i].Key) != w.key || changes[i].Kind != w.kind {
+				t.Fatalf("%s: expected %s to be %s, got %s %s", tc.name, w.key, w.kind, changes[i].Key, changes[i].Kind)
+			}
+		}
+
+		// A removal leaves that side's leaf empty
+		if c := changes[3]; c.Base == nil || c.Ours != nil || c.Theirs == nil {
+			t.Fatalf("%s: expected a removal in ours to have no leaf in ours", tc.name)
+		}
+	}
+}
+
+func TestMerge_Unchanged(t *testing.T) {
+	rows := makeRows(50)
+	tree := NewMerkleTreeFromRows(rows)
+	merge := NewMerge(tree, tree, NewMerkleTreeFromRows(rows))
+	if err := merge.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+	if len(merge.GetChanges()) != 0 {
+		t.Fatalf("expected no changes, got %d", len(merge.GetChanges()))
+	}
+}
@@ -3,6 +3,7 @@ package tree
 import (
 	"encoding/hex"
 	"fmt"
+	"math"
 
 	itree "github.com/BryceDouglasJames/merklediff/internal/tree"
 	"github.com/BryceDouglasJames/merklediff/pkg/types"
@@ -16,33 +17,95 @@ type (
 type MerkleTree struct {
 	root        *MerkleNode
 	nodeBuilder *itree.NodeBuilder
+	config      TreeConfig
+	rowCount    int
+	schema      types.Schema
+	keyOrder    keyOrder
 }
 
 func NewMerkleTree(root *MerkleNode) *MerkleTree {
-	return &MerkleTree{root: root, nodeBuilder: itree.NewNodeBuilder()}
+	return &MerkleTree{root: root, nodeBuilder: itree.NewNodeBuilder(), config: DefaultTreeConfig()}
 }
 
 // NewMerkleTreeFromRows builds a Merkle tree from typed rows.
 // Each row's Values are serialized consistently before hashing.
 // This is the preferred constructor for data source rows.
 func NewMerkleTreeFromRows(rows []Row) *MerkleTree {
-	nodeBuilder := itree.NewNodeBuilder()
-	root := buildTreeFromRows(rows, nodeBuilder)
-	return &MerkleTree{root: root, nodeBuilder: nodeBuilder}
+	tree, _ := NewMerkleTreeFromRowsWithConfig(rows, DefaultTreeConfig())
+	return tree
+}
+
+// NewMerkleTreeFromRowsWithConfig builds a Merkle tree from typed rows
+// using a custom configuration. Content-defined trees return
+// ErrUnsortedInput if two rows share a key.
+func NewMerkleTreeFromRowsWithConfig(rows []Row, config TreeConfig) (*MerkleTree, error) {
+	config = config.withDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	root, err := buildTreeFromRows(rows, config)
+	if err != nil {
+		return nil, err
+	}
+	return &MerkleTree{root: root, nodeBuilder: itree.NewNodeBuilder(), config: config, rowCount: len(rows)}, nil
 }
 
 // NewMerkleTreeFromChunks builds a Merkle tree from raw byte chunks.
 // Keys are auto-generated as "chunk-0", "chunk-1", etc.
 // Use NewMerkleTreeFromRows when you have keyed data.
 func NewMerkleTreeFromChunks(chunks [][]byte) *MerkleTree {
-	root := buildTreeFromChunks(chunks)
-	return &MerkleTree{root: root, nodeBuilder: itree.NewNodeBuilder()}
+	tree, _ := NewMerkleTreeFromChunksWithConfig(chunks, DefaultTreeConfig())
+	return tree
+}
+
+// NewMerkleTreeFromChunksWithConfig builds a Merkle tree from raw byte
+// chunks using a custom configuration. Chunk trees are always positional.
+func NewMerkleTreeFromChunksWithConfig(chunks [][]byte, config TreeConfig) (*MerkleTree, error) {
+	config = config.withDefaults()
+	config.Shape = ShapePositional
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	root := buildTreeFromChunks(chunks, config.treeHasher(), config.Fanout, config.Workers)
+	return &MerkleTree{root: root, nodeBuilder: itree.NewNodeBuilder(), config: config, rowCount: len(chunks)}, nil
 }
 
 func (t *MerkleTree) GetRoot() *MerkleNode {
 	return t.root
 }
 
+// GetConfig returns the configuration the tree was built with.
+func (t *MerkleTree) GetConfig() TreeConfig {
+	return t.config
+}
+
+// GetRowCount returns the number of rows (or chunks) in the tree.
+func (t *MerkleTree) GetRowCount() int {
+	return t.rowCount
+}
+
+// GetSchema returns the schema of the rows in the tree, if known.
+func (t *MerkleTree) GetSchema() types.Schema {
+	return t.schema
+}
+
+// SetSchema records the schema of the rows in the tree. Trees built from a
+// RowReader record it automatically; it is saved with snapshots.
+func (t *MerkleTree) SetSchema(schema types.Schema) {
+	t.schema = schema
+}
+
+// Fingerprint returns the root hash tagged with the tree format and hasher,
+// e.g. "v2:sha256:9f86d0...". Publish this rather than the bare root hash so
+// roots from different formats or hashers are never mistaken for each other.
+func (t *MerkleTree) Fingerprint() string {
+	var hash []byte
+	if t.root != nil {
+		hash = t.root.GetHash()
+	}
+	return fmt.Sprintf("%s:%s:%x", t.config.Format, t.config.Hasher.Name(), hash)
+}
+
 // String implements fmt.Stringer and returns a depth-first textual representation
 // of the Merkle tree starting from the root.
 func (t *MerkleTree) String() string {
@@ -53,27 +116,29 @@ func (t *MerkleTree) String() string {
 }
 
 // buildTreeFromRows constructs the Merkle tree from typed rows.
-func buildTreeFromRows(rows []Row, nodeBuilder *itree.NodeBuilder) *MerkleNode {
+// Positional trees keep the rows in input order; content-defined trees
+// sort them by key and reject repeated keys.
+func buildTreeFromRows(rows []Row, config TreeConfig) (*MerkleNode, error) {
 	if len(rows) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	nodes := make([]*MerkleNode, len(rows))
-
 	// Leaf nodes (level 0) - serialize values for hashing
-	for i, row := range rows {
-		// Serialize typed values to bytes for consistent hashing
-		serializedValue := nodeBuilder.SerializeRowValues(row.Values)
-		nodes[i] = NewNode(serializedValue, row.Key, row.Key)
-		nodes[i].SetLevel(0)
-	}
+	nodes := hashRowLeaves(rows, config)
 
-	// Build the tree level by level
-	return buildTreeLevels(nodes)
+	return buildFromLeaves(nodes, config)
+}
+
+// buildFromLeaves builds the tree above the leaf nodes using the configured shape.
+func buildFromLeaves(nodes []*MerkleNode, config TreeConfig) (*MerkleNode, error) {
+	if config.Shape == ShapeContentDefined {
+		return buildContentDefined(nodes, config.treeHasher(), config.Workers)
+	}
+	return buildTreeLevels(nodes, config.treeHasher(), config.Fanout, config.Workers), nil
 }
 
 // buildTreeFromChunks constructs the Merkle tree from raw chunks.
-func buildTreeFromChunks(chunks [][]byte) *MerkleNode {
+func buildTreeFromChunks(chunks [][]byte, th treeHasher, fanout, workers int) *MerkleNode {
 	if len(chunks) == 0 {
 		return nil
 	}
@@ -83,52 +148,119 @@ func buildTreeFromChunks(chunks [][]byte) *MerkleNode {
 	// Leaf nodes (level 0) - auto-generate keys
 	for i, chunk := range chunks {
 		key := []byte(fmt.Sprintf("chunk-%d", i))
-		nodes[i] = NewNode(chunk, key, key)
+		nodes[i] = th.chunkLeaf(key, chunk)
 		nodes[i].SetLevel(0)
 	}
 
 	// Build the tree level by level
-	return buildTreeLevels(nodes)
+	return buildTreeLevels(nodes, th, fanout, workers)
 }
 
-// buildTreeLevels builds the tree from leaf nodes upward.
-func buildTreeLevels(nodes []*MerkleNode) *MerkleNode {
+// buildTreeLevels builds the tree from leaf nodes upward, grouping up to
+// fanout nodes under each parent.
+func buildTreeLevels(nodes []*MerkleNode, th treeHasher, fanout, workers int) *MerkleNode {
 	for len(nodes) > 1 {
-		nextLevel := make([]*MerkleNode, 0, (len(nodes)+1)/2)
+		nextLevel := make([]*MerkleNode, (len(nodes)+fanout-1)/fanout)
+
+		runSpans(splitSpans(len(nextLevel), workers), func(_ int, s span) {
+			for j := s.start; j < s.end; j++ {
+				group := nodes[j*fanout : min((j+1)*fanout, len(nodes))]
+				if len(group) > 1 {
+					nextLevel[j] = th.parent(group...)
+				} else {
+					// Carry a lone trailing node up
+					nextLevel[j] = group[0]
+				}
+			}
+		})
 
-		for i := 0; i < len(nodes); i += 2 {
-			if i+1 < len(nodes) {
-				left, right := nodes[i], nodes[i+1]
+		nodes = nextLevel
+	}
 
-				// Combine the hashes of the left and right nodes
-				combined := make([]byte, 0, len(left.GetHash())+len(right.GetHash()))
-				combined = append(combined, left.GetHash()...)
-				combined = append(combined, right.GetHash()...)
+	return nodes[0]
+}
 
-				parent := NewNode(combined, left.GetStartKey(), right.GetEndKey())
+// positionalBuilder assembles a positional tree from leaves one at a time.
+// It produces exactly the tree buildTreeLevels builds, holding at most
+// fanout-1 pending subtrees per level.
+type positionalBuilder struct {
+	hasher     treeHasher
+	fanout     int
+	pending    []pendingSubtree
+	pruneLevel int
+}
 
-				// Set parent/child relationships
-				parent.SetLeft(left)
-				parent.SetRight(right)
+// pendingSubtree is a complete subtree waiting for siblings of equal size.
+type pendingSubtree struct {
+	node   *MerkleNode
+	leaves int
+}
 
-				// Level is one more than the deepest child
-				level := left.GetLevel()
-				if right.GetLevel() > level {
-					level = right.GetLevel()
-				}
-				parent.SetLevel(level + 1)
+// push appends the next leaf.
+func (b *positionalBuilder) push(leaf *MerkleNode) {
+	b.pending = append(b.pending, pendingSubtree{node: leaf, leaves: 1})
 
-				nextLevel = append(nextLevel, parent)
-			} else {
-				// Carry last odd node up
-				nextLevel = append(nextLevel, nodes[i])
-			}
+	// Join fanout equal-sized subtrees, like carrying in a base-fanout counter
+	for n := len(b.pending); n >= b.fanout && b.pending[n-b.fanout].leaves == b.pending[n-1].leaves; n = len(b.pending) {
+		group := b.pending[n-b.fanout:]
+		b.pending = append(b.pending[:n-b.fanout], b.join(group))
+	}
+}
+
+// finish joins the pending subtrees and returns the root.
+// Working up from the smallest subtrees, each size class is joined together
+// with whatever was carried up from below, which matches how buildTreeLevels
+// groups the trailing partial node of every level.
+func (b *positionalBuilder) finish() *MerkleNode {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	var carry *pendingSubtree
+	for size := 1; len(b.pending) > 0; size *= b.fanout {
+		i := len(b.pending)
+		for i > 0 && b.pending[i-1].leaves == size {
+			i--
+		}
+		group := append([]pendingSubtree(nil), b.pending[i:]...)
+		b.pending = b.pending[:i]
+		if carry != nil {
+			group = append(group, *carry)
 		}
+		if len(group) == 0 {
+			continue
+		}
+		joined := b.join(group)
+		carry = &joined
+	}
+	return carry.node
+}
 
-		nodes = nextLevel
+// join combines subtrees under a single parent. A lone subtree is carried
+// up unchanged.
+func (b *positionalBuilder) join(group []pendingSubtree) pendingSubtree {
+	if len(group) == 1 {
+		return group[0]
+	}
+	children := make([]*MerkleNode, len(group))
+	leaves := 0
+	for i, g := range group {
+		children[i] = g.node
+		leaves += g.leaves
 	}
+	return pendingSubtree{
+		node:   pruneChildren(b.hasher.parent(children...), b.pruneLevel),
+		leaves: leaves,
+	}
+}
 
-	return nodes[0]
+// pruneChildren drops the children of node if it sits at or below pruneLevel.
+// The node keeps its hash and key range.
+func pruneChildren(node *MerkleNode, pruneLevel int) *MerkleNode {
+	if node.GetLevel() <= pruneLevel {
+		node.SetChildren(nil)
+	}
+	return node
 }
 
 func recursivePrint(node *MerkleNode) string {
@@ -142,7 +274,10 @@ func recursivePrint(node *MerkleNode) string {
 		string(node.GetEndKey()),
 		node.GetLevel())
 
-	return current + recursivePrint(node.GetLeft()) + recursivePrint(node.GetRight())
+	for _, child := range node.GetChildren() {
+		current += recursivePrint(child)
+	}
+	return current
 }
 
 func (t *MerkleTree) GetChunkSize() int {
@@ -160,47 +295,245 @@ func (t *MerkleTree) GetChunkSize() int {
 // This streams rows without loading everything into memory first.
 // For very large datasets, consider using StreamingTreeBuilder.
 func BuildTreeFromReader(r RowReader) (*MerkleTree, error) {
+	return BuildTreeFromReaderWithConfig(r, DefaultTreeConfig())
+}
+
+// BuildTreeFromReaderWithConfig builds a Merkle tree from a RowReader
+// using a custom configuration.
+func BuildTreeFromReaderWithConfig(r RowReader, config TreeConfig) (*MerkleTree, error) {
+	config = config.withDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
 	nodeBuilder := itree.NewNodeBuilder()
 	var nodes []*MerkleNode
 
-	for r.Next() {
-		row := r.Row()
-		serializedValue := nodeBuilder.SerializeRowValues(row.Values)
-		node := NewNode(serializedValue, row.Key, row.Key)
-		node.SetLevel(0)
-		nodes = append(nodes, node)
+	if config.Workers > 1 {
+		nodes = hashReaderLeaves(r, config)
+	} else {
+		for r.Next() {
+			row := r.Row()
+			serializedValue := nodeBuilder.SerializeRowValues(row.Values)
+			node := config.treeHasher().rowLeaf(row.Key, serializedValue)
+			node.SetLevel(0)
+			nodes = append(nodes, node)
+		}
 	}
 
 	if err := r.Err(); err != nil {
 		return nil, err
 	}
 
-	if len(nodes) == 0 {
-		return &MerkleTree{root: nil, nodeBuilder: nodeBuilder}, nil
+	mt := &MerkleTree{nodeBuilder: nodeBuilder, config: config, rowCount: len(nodes), schema: r.Schema()}
+	if len(nodes) > 0 {
+		root, err := buildFromLeaves(nodes, config)
+		if err != nil {
+			return nil, err
+		}
+		mt.root = root
 	}
-
-	root := buildTreeLevels(nodes)
-	return &MerkleTree{root: root, nodeBuilder: nodeBuilder}, nil
+	return mt, nil
 }
 
+// ErrUnsortedInput is returned by StreamingTreeBuilder when rows do not
+// arrive in strictly increasing key order.
+var ErrUnsortedInput = itree.ErrUnsortedInput
+
 // StreamingTreeBuilder builds a Merkle tree incrementally.
 // Use this for very large datasets where collecting all leaf nodes
 // doesn't fit in memory.
-// TODO: Implement this
 //
-// type StreamingTreeBuilder struct {
-// 	internal *itree.StreamingBuilder
-// 	nodes    []*MerkleNode
-// }
+// Rows must arrive in strictly increasing key order. Leaves are hashed one
+// batch at a time and folded into the tree as they arrive, so the builder
+// only holds the current batch plus O(log n) pending subtrees. The finished
+// tree is identical to the one built from the same rows in memory.
 //
-// func NewStreamingTreeBuilder(batchSize int) *StreamingTreeBuilder {
-// 	return &StreamingTreeBuilder{
-// 		internal: itree.NewStreamingBuilder(batchSize),
-// 	}
-// }
-//
-// Requirements:
-// - Batch-based leaf node construction with proper key ranges
-// - Flush partial batches in Build()
-// - Error handling in AddRow()
-// - Sorted input validation
+// Streaming bounds the memory used while building, not the size of the
+// result: by default the finished tree keeps every node, so it still holds
+// all n leaves and their parents. Call SetPruneLevel to drop the nodes at
+// and below a level as soon as their parent is hashed, which leaves roughly
+// n/fanout^level nodes in a positional tree; pruned subtrees keep their
+// hash and key range, so they still compare as a single range. Builds that
+// only need the root should use FingerprintReader, which prunes everything.
+type StreamingTreeBuilder struct {
+	internal   *itree.StreamingBuilder
+	config     TreeConfig
+	schema     types.Schema
+	positional positionalBuilder
+	content    contentBuilder
+}
+
+// NewStreamingTreeBuilder creates a streaming builder with the default
+// configuration that hashes rows in batches of batchSize.
+func NewStreamingTreeBuilder(batchSize int) *StreamingTreeBuilder {
+	b, _ := NewStreamingTreeBuilderWithConfig(batchSize, DefaultTreeConfig())
+	return b
+}
+
+// NewStreamingTreeBuilderWithConfig creates a streaming builder using a
+// custom configuration.
+func NewStreamingTreeBuilderWithConfig(batchSize int, config TreeConfig) (*StreamingTreeBuilder, error) {
+	config = config.withDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &StreamingTreeBuilder{
+		internal:   itree.NewStreamingBuilder(batchSize),
+		config:     config,
+		positional: positionalBuilder{hasher: config.treeHasher(), fanout: config.Fanout},
+		content:    contentBuilder{hasher: config.treeHasher()},
+	}, nil
+}
+
+// PruneAll passed to SetPruneLevel keeps only the root, so memory stays at
+// one batch of rows plus the pending subtrees however many rows arrive.
+const PruneAll = math.MaxInt
+
+// SetPruneLevel drops the children of every node at or below level once it
+// is built. Level 0 (the default) keeps the whole tree. It must be called
+// before the first row is added.
+func (b *StreamingTreeBuilder) SetPruneLevel(level int) {
+	b.positional.pruneLevel = level
+	b.content.pruneLevel = level
+}
+
+// AddRow adds the next row. It returns ErrUnsortedInput if the row's key
+// does not follow the previous key.
+func (b *StreamingTreeBuilder) AddRow(row Row) error {
+	if err := b.internal.AddRow(row); err != nil {
+		return err
+	}
+	if b.internal.Full() {
+		b.flush()
+	}
+	return nil
+}
+
+// Consume adds every remaining row from r and records its schema.
+func (b *StreamingTreeBuilder) Consume(r RowReader) error {
+	for r.Next() {
+		if err := b.AddRow(r.Row()); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	b.schema = r.Schema()
+	return nil
+}
+
+// Build flushes any partial batch and returns the finished tree.
+// The builder must not be used after Build.
+func (b *StreamingTreeBuilder) Build() (*MerkleTree, error) {
+	b.flush()
+
+	var root *MerkleNode
+	if b.config.Shape == ShapeContentDefined {
+		root = b.content.finish()
+	} else {
+		root = b.positional.finish()
+	}
+	return &MerkleTree{
+		root:        root,
+		nodeBuilder: itree.NewNodeBuilder(),
+		config:      b.config,
+		rowCount:    b.internal.RowCount(),
+		schema:      b.schema,
+	}, nil
+}
+
+// FingerprintReader returns the fingerprint of the rows in r and how many
+// there were, without keeping the tree. Rows must be sorted by key, as for
+// StreamingTreeBuilder; every node is pruned once its parent is hashed, so
+// memory is bounded by one batch of batchSize rows plus O(fanout·log n)
+// pending subtrees.
+func FingerprintReader(r RowReader, batchSize int, config TreeConfig) (string, int, error) {
+	b, err := NewStreamingTreeBuilderWithConfig(batchSize, config)
+	if err != nil {
+		return "", 0, err
+	}
+	b.SetPruneLevel(PruneAll)
+	if err := b.Consume(r); err != nil {
+		return "", 0, err
+	}
+	mt, err := b.Build()
+	if err != nil {
+		return "", 0, err
+	}
+	return mt.Fingerprint(), mt.GetRowCount(), nil
+}
+
+// ChunkTreeBuilder builds a chunk tree one chunk at a time, so a file can be
+// hashed as it is read. It builds the same tree as
+// NewMerkleTreeFromChunksWithConfig without holding the chunks, and like
+// StreamingTreeBuilder it keeps every node unless SetPruneLevel is called.
+type ChunkTreeBuilder struct {
+	config     TreeConfig
+	positional positionalBuilder
+	count      int
+}
+
+// NewChunkTreeBuilder creates a chunk tree builder. Chunk trees are always
+// positional.
+func NewChunkTreeBuilder(config TreeConfig) (*ChunkTreeBuilder, error) {
+	config = config.withDefaults()
+	config.Shape = ShapePositional
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &ChunkTreeBuilder{
+		config:     config,
+		positional: positionalBuilder{hasher: config.treeHasher(), fanout: config.Fanout},
+	}, nil
+}
+
+// SetPruneLevel drops the children of every node at or below level once it
+// is built, as StreamingTreeBuilder.SetPruneLevel does. It must be called
+// before the first chunk is added.
+func (b *ChunkTreeBuilder) SetPruneLevel(level int) {
+	b.positional.pruneLevel = level
+}
+
+// Add appends the next chunk and returns its leaf hash, which depends only
+// on the chunk's bytes. The chunk is not retained.
+func (b *ChunkTreeBuilder) Add(chunk []byte) []byte {
+	leaf := b.config.treeHasher().chunkLeaf([]byte(fmt.Sprintf("chunk-%d", b.count)), chunk)
+	leaf.SetLevel(0)
+	b.positional.push(leaf)
+	b.count++
+	return leaf.GetHash()
+}
+
+// Build returns the tree of the chunks added so far. The builder must not be
+// used after Build.
+func (b *ChunkTreeBuilder) Build() *MerkleTree {
+	return &MerkleTree{
+		root:        b.positional.finish(),
+		nodeBuilder: itree.NewNodeBuilder(),
+		config:      b.config,
+		rowCount:    b.count,
+	}
+}
+
+// flush hashes the current batch into leaves and folds them into the tree.
+func (b *StreamingTreeBuilder) flush() {
+	th := b.config.treeHasher()
+	batch := b.internal.Flush()
+	leaves := make([]*MerkleNode, len(batch))
+	runSpans(splitSpans(len(batch), b.config.Workers), func(_ int, s span) {
+		for i := s.start; i < s.end; i++ {
+			leaves[i] = th.rowLeaf(batch[i].Key, batch[i].SerializedData)
+			leaves[i].SetLevel(0)
+		}
+	})
+
+	for _, node := range leaves {
+		if b.config.Shape == ShapeContentDefined {
+			b.content.push(node)
+		} else {
+			b.positional.push(node)
+		}
+	}
+}
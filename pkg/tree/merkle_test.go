@@ -2,9 +2,16 @@ package tree
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+	"github.com/BryceDouglasJames/merklediff/pkg/types"
 )
 
 func TestNewMerkleTreeFromChunks_TwoLeaves(t *testing.T) {
@@ -24,10 +31,11 @@ func TestNewMerkleTreeFromChunks_TwoLeaves(t *testing.T) {
 	}
 
 	h := &hasher.SHA256Hasher{}
-	leftHash := h.Hash([]byte("a"))
-	rightHash := h.Hash([]byte("b"))
+	leftHash := h.Hash([]byte("\x00a"))
+	rightHash := h.Hash([]byte("\x00b"))
 
-	combined := append(append([]byte{}, leftHash...), rightHash...)
+	// Leaves are prefixed with 0x00 and internal nodes with 0x01
+	combined := append(append([]byte{0x01}, leftHash...), rightHash...)
 	expectedRootHash := h.Hash(combined)
 
 	if !bytes.Equal(root.GetHash(), expectedRootHash) {
@@ -67,15 +75,15 @@ func TestNewMerkleTreeFromChunks_FullTree(t *testing.T) {
 	h := &hasher.SHA256Hasher{}
 
 	// Recompute expected root hash following the same Merkle logic
-	aHash := h.Hash([]byte("a"))
-	bHash := h.Hash([]byte("b"))
-	cHash := h.Hash([]byte("c"))
-	dHash := h.Hash([]byte("d"))
+	aHash := h.Hash([]byte("\x00a"))
+	bHash := h.Hash([]byte("\x00b"))
+	cHash := h.Hash([]byte("\x00c"))
+	dHash := h.Hash([]byte("\x00d"))
 
-	abParent := h.Hash(append(append([]byte{}, aHash...), bHash...))
-	cdParent := h.Hash(append(append([]byte{}, cHash...), dHash...))
+	abParent := h.Hash(append(append([]byte{0x01}, aHash...), bHash...))
+	cdParent := h.Hash(append(append([]byte{0x01}, cHash...), dHash...))
 
-	expectedRootHash := h.Hash(append(append([]byte{}, abParent...), cdParent...))
+	expectedRootHash := h.Hash(append(append([]byte{0x01}, abParent...), cdParent...))
 
 	if !bytes.Equal(root.GetHash(), expectedRootHash) {
 		t.Fatalf("unexpected root hash")
@@ -117,6 +125,41 @@ func TestNewMerkleTreeFromChunks_FullTree(t *testing.T) {
 	}
 }
 
+func TestNewMerkleTreeFromChunks_LegacyFormat(t *testing.T) {
+	chunks := [][]byte{
+		[]byte("a"),
+		[]byte("b"),
+	}
+
+	mt, err := NewMerkleTreeFromChunksWithConfig(chunks, TreeConfig{Format: FormatLegacy})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	// Legacy trees hash without domain separation prefixes
+	h := &hasher.SHA256Hasher{}
+	combined := append(h.Hash([]byte("a")), h.Hash([]byte("b"))...)
+	if !bytes.Equal(mt.GetRoot().GetHash(), h.Hash(combined)) {
+		t.Fatalf("unexpected legacy root hash")
+	}
+}
+
+func TestNewMerkleTreeFromRows_BindsKeyIntoLeaf(t *testing.T) {
+	rowsA := []Row{{Key: []byte("1"), Values: []any{"same"}}}
+	rowsB := []Row{{Key: []byte("2"), Values: []any{"same"}}}
+
+	if bytes.Equal(NewMerkleTreeFromRows(rowsA).GetRoot().GetHash(), NewMerkleTreeFromRows(rowsB).GetRoot().GetHash()) {
+		t.Fatal("expected rows with different keys to hash differently")
+	}
+
+	legacy := TreeConfig{Format: FormatLegacy}
+	treeA, _ := NewMerkleTreeFromRowsWithConfig(rowsA, legacy)
+	treeB, _ := NewMerkleTreeFromRowsWithConfig(rowsB, legacy)
+	if !bytes.Equal(treeA.GetRoot().GetHash(), treeB.GetRoot().GetHash()) {
+		t.Fatal("expected legacy leaves to hash values only")
+	}
+}
+
 func TestNewMerkleTreeFromChunks_EmptyInput(t *testing.T) {
 	var chunks [][]byte
 
@@ -125,3 +168,269 @@ func TestNewMerkleTreeFromChunks_EmptyInput(t *testing.T) {
 		t.Fatalf("expected nil root for empty input")
 	}
 }
+
+// sliceReader is a minimal RowReader over an in-memory slice.
+type sliceReader struct {
+	rows []Row
+	pos  int
+}
+
+func (r *sliceReader) Schema() types.Schema { return types.Schema{} }
+func (r *sliceReader) IsSorted() bool       { return true }
+func (r *sliceReader) Next() bool           { r.pos++; return r.pos <= len(r.rows) }
+func (r *sliceReader) Row() Row             { return r.rows[r.pos-1] }
+func (r *sliceReader) Err() error           { return nil }
+func (r *sliceReader) Close() error         { return nil }
+
+func TestStreamingTreeBuilder_MatchesInMemoryBuild(t *testing.T) {
+	for _, shape := range []TreeShape{ShapePositional, ShapeContentDefined} {
+		for _, n := range []int{1, 2, 3, 5, 7, 13, 64, 100, 1000} {
+			rows := makeRows(n)
+			config := TreeConfig{Shape: shape}
+
+			want, err := NewMerkleTreeFromRowsWithConfig(rows, config)
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+
+			b, err := NewStreamingTreeBuilderWithConfig(3, config)
+			if err != nil {
+				t.Fatalf("new builder: %v", err)
+			}
+			if err := b.Consume(&sliceReader{rows: rows}); err != nil {
+				t.Fatalf("consume: %v", err)
+			}
+			got, err := b.Build()
+			if err != nil {
+				t.Fatalf("build: %v", err)
+			}
+
+			if !bytes.Equal(got.GetRoot().GetHash(), want.GetRoot().GetHash()) {
+				t.Fatalf("%s shape, %d rows: streaming root differs from in-memory root", shape, n)
+			}
+			if got.GetRoot().GetLevel() != want.GetRoot().GetLevel() {
+				t.Fatalf("%s shape, %d rows: expected level %d, got %d",
+					shape, n, want.GetRoot().GetLevel(), got.GetRoot().GetLevel())
+			}
+		}
+	}
+}
+
+func TestStreamingTreeBuilder_RejectsUnsortedInput(t *testing.T) {
+	b := NewStreamingTreeBuilder(10)
+	if err := b.AddRow(Row{Key: []byte("b"), Values: []any{"b"}}); err != nil {
+		t.Fatalf("first row: %v", err)
+	}
+	if err := b.AddRow(Row{Key: []byte("a"), Values: []any{"a"}}); !errors.Is(err, ErrUnsortedInput) {
+		t.Fatalf("expected ErrUnsortedInput for out-of-order key, got %v", err)
+	}
+	if err := b.AddRow(Row{Key: []byte("b"), Values: []any{"b"}}); !errors.Is(err, ErrUnsortedInput) {
+		t.Fatalf("expected ErrUnsortedInput for duplicate key, got %v", err)
+	}
+}
+
+func TestStreamingTreeBuilder_EmptyInput(t *testing.T) {
+	mt, err := NewStreamingTreeBuilder(10).Build()
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if mt.GetRoot() != nil {
+		t.Fatalf("expected nil root for empty input")
+	}
+}
+
+func TestStreamingTreeBuilder_PrunedTreesCompareByRange(t *testing.T) {
+	rows := makeRows(256)
+	changed := make([]Row, len(rows))
+	copy(changed, rows)
+	changed[100] = Row{Key: rows[100].Key, Values: []any{"changed", int64(-1)}}
+
+	for _, shape := range []TreeShape{ShapePositional, ShapeContentDefined} {
+		build := func(rows []Row) *MerkleTree {
+			b, _ := NewStreamingTreeBuilderWithConfig(16, TreeConfig{Shape: shape})
+			b.SetPruneLevel(3)
+			for _, r := range rows {
+				if err := b.AddRow(r); err != nil {
+					t.Fatalf("add: %v", err)
+				}
+			}
+			mt, _ := b.Build()
+			return mt
+		}
+
+		full, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Shape: shape})
+		treeA, treeB := build(rows), build(changed)
+		if !bytes.Equal(treeA.GetRoot().GetHash(), full.GetRoot().GetHash()) {
+			t.Fatalf("%s shape: pruning changed the root hash", shape)
+		}
+
+		diff := NewDiff(treeA, treeB)
+		if err := diff.Compare(context.Background()); err != nil {
+			t.Fatalf("compare: %v", err)
+		}
+
+		ranges := diff.GetRanges()
+		if len(ranges) != 1 {
+			t.Fatalf("%s shape: expected 1 range, got %d: %v", shape, len(ranges), ranges)
+		}
+		key := rows[100].Key
+		if bytes.Compare(ranges[0].Start, key) > 0 || bytes.Compare(ranges[0].End, key) < 0 {
+			t.Fatalf("%s shape: range %q..%q does not cover %q", shape, ranges[0].Start, ranges[0].End, key)
+		}
+	}
+}
+
+func TestFingerprintReader(t *testing.T) {
+	rows := makeRows(1000)
+	for _, config := range []TreeConfig{{}, {Fanout: 4}, {Shape: ShapeContentDefined}} {
+		want, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		got, n, err := FingerprintReader(&sliceReader{rows: rows}, 16, config)
+		if err != nil {
+			t.Fatalf("%+v: fingerprint: %v", config, err)
+		}
+		if got != want.Fingerprint() || n != len(rows) {
+			t.Fatalf("%+v: expected %s over %d rows, got %s over %d", config, want.Fingerprint(), len(rows), got, n)
+		}
+	}
+
+	// Only the root is kept
+	b := NewStreamingTreeBuilder(16)
+	b.SetPruneLevel(PruneAll)
+	if err := b.Consume(&sliceReader{rows: rows}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	if mt, _ := b.Build(); len(mt.GetRoot().GetChildren()) != 0 {
+		t.Fatal("expected PruneAll to keep only the root")
+	}
+
+	unsorted := []Row{rows[1], rows[0]}
+	if _, _, err := FingerprintReader(&sliceReader{rows: unsorted}, 16, TreeConfig{}); !errors.Is(err, ErrUnsortedInput) {
+		t.Fatalf("expected ErrUnsortedInput, got %v", err)
+	}
+}
+
+func TestStreamingTreeBuilder_MatchesInMemoryBuildWithFanout(t *testing.T) {
+	for _, fanout := range []int{3, 4, 16} {
+		for _, n := range []int{1, 2, 3, 4, 5, 9, 10, 17, 100, 1000} {
+			rows := makeRows(n)
+			config := TreeConfig{Fanout: fanout}
+
+			want, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+			b, _ := NewStreamingTreeBuilderWithConfig(7, config)
+			if err := b.Consume(&sliceReader{rows: rows}); err != nil {
+				t.Fatalf("consume: %v", err)
+			}
+			got, _ := b.Build()
+
+			if !bytes.Equal(got.GetRoot().GetHash(), want.GetRoot().GetHash()) {
+				t.Fatalf("fanout %d, %d rows: streaming root differs from in-memory root", fanout, n)
+			}
+		}
+	}
+}
+
+func TestChunkTreeBuilder_MatchesInMemoryBuild(t *testing.T) {
+	for _, fanout := range []int{2, 3, 16} {
+		for _, n := range []int{0, 1, 2, 3, 5, 17, 100} {
+			chunks := make([][]byte, n)
+			for i := range chunks {
+				chunks[i] = []byte(fmt.Sprintf("chunk %d", i))
+			}
+			config := TreeConfig{Fanout: fanout}
+
+			want, _ := NewMerkleTreeFromChunksWithConfig(chunks, config)
+			b, err := NewChunkTreeBuilder(config)
+			if err != nil {
+				t.Fatalf("new builder: %v", err)
+			}
+			for i, chunk := range chunks {
+				leaf, _ := want.LeafAt(i)
+				if got := b.Add(chunk); !bytes.Equal(got, leaf.GetHash()) {
+					t.Fatalf("fanout %d, chunk %d: leaf hash differs from in-memory leaf", fanout, i)
+				}
+			}
+			got := b.Build()
+
+			if got.GetRowCount() != n {
+				t.Fatalf("expected %d chunks, got %d", n, got.GetRowCount())
+			}
+			if got.Fingerprint() != want.Fingerprint() {
+				t.Fatalf("fanout %d, %d chunks: builder root differs from in-memory root", fanout, n)
+			}
+		}
+	}
+}
+
+func TestNewMerkleTreeFromChunks_Fanout(t *testing.T) {
+	chunks := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+	mt, err := NewMerkleTreeFromChunksWithConfig(chunks, TreeConfig{Fanout: 4})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	// Four leaves share a parent; the fifth is carried up beside it
+	root := mt.GetRoot()
+	if len(root.GetChildren()) != 2 {
+		t.Fatalf("expected 2 root children, got %d", len(root.GetChildren()))
+	}
+	group := root.GetChildren()[0]
+	if len(group.GetChildren()) != 4 || group.GetLevel() != 1 {
+		t.Fatalf("expected a level-1 node with 4 children, got %d children at level %d",
+			len(group.GetChildren()), group.GetLevel())
+	}
+
+	leaf := func(s string) []byte { h := sha256.Sum256([]byte("\x00" + s)); return h[:] }
+	combined := []byte{0x01}
+	for _, s := range []string{"a", "b", "c", "d"} {
+		combined = append(combined, leaf(s)...)
+	}
+	want := sha256.Sum256(combined)
+	if !bytes.Equal(group.GetHash(), want[:]) {
+		t.Fatalf("unexpected hash for 4-way node")
+	}
+}
+
+func TestTreeConfig_ValidateFanout(t *testing.T) {
+	for _, config := range []TreeConfig{
+		{Fanout: 1},
+		{Fanout: MaxFanout + 1},
+		{Shape: ShapeContentDefined, Fanout: 4},
+	} {
+		if _, err := NewMerkleTreeFromRowsWithConfig(makeRows(3), config); err == nil {
+			t.Fatalf("expected error for %+v", config)
+		}
+	}
+	if _, err := NewMerkleTreeFromRowsWithConfig(makeRows(3), TreeConfig{Fanout: MaxFanout}); err != nil {
+		t.Fatalf("fanout %d: %v", MaxFanout, err)
+	}
+}
+
+func TestNewMerkleTreeFromChunksWithConfig_UsesHasher(t *testing.T) {
+	h := &hasher.FNVHasher{}
+	mt, err := NewMerkleTreeFromChunksWithConfig([][]byte{[]byte("a"), []byte("b")}, TreeConfig{Hasher: h})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	combined := append(append([]byte{0x01}, h.Hash([]byte("\x00a"))...), h.Hash([]byte("\x00b"))...)
+	if !bytes.Equal(mt.GetRoot().GetHash(), h.Hash(combined)) {
+		t.Fatalf("unexpected root hash")
+	}
+	if mt.GetConfig().Hasher.Name() != hasher.NameFNV128a {
+		t.Fatalf("expected config to record hasher %s", hasher.NameFNV128a)
+	}
+}
+
+func TestMerkleTree_Fingerprint(t *testing.T) {
+	mt := NewMerkleTreeFromRows(makeRows(3))
+
+	want := "v2:sha256:" + hex.EncodeToString(mt.GetRoot().GetHash())
+	if mt.Fingerprint() != want {
+		t.Fatalf("expected fingerprint %q, got %q", want, mt.Fingerprint())
+	}
+
+	legacy, _ := NewMerkleTreeFromRowsWithConfig(makeRows(3), TreeConfig{Format: FormatLegacy})
+	if !strings.HasPrefix(legacy.Fingerprint(), "v1:sha256:") {
+		t.Fatalf("expected legacy fingerprint prefix, got %q", legacy.Fingerprint())
+	}
+}
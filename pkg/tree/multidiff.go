@@ -0,0 +1,170 @@
+package tree
+
+import (
+	"context"
+	"slices"
+)
+
+// MultiDiff compares any number of trees of the same data, such as a source
+// table and its replicas, to find which copies diverge.
+type MultiDiff struct {
+	trees       []*MerkleTree
+	divergences []Divergence
+	concurrency int
+}
+
+// Divergence is a key on which the trees do not all agree.
+type Divergence struct {
+	Key []byte
+
+	// Groups partitions the trees by the version of the row they hold,
+	// largest group first and ties in tree order. Trees without the key
+	// form a group whose Leaf is nil.
+	Groups []VersionGroup
+
+	// Majority reports whether Groups[0] holds more than half the trees.
+	Majority bool
+
+	// Outliers lists, in order, the trees outside the majority group. It
+	// is nil if there is no majority.
+	Outliers []int
+}
+
+// VersionGroup is a set of trees holding the same version of a row.
+type VersionGroup struct {
+	// Trees lists the indices of the trees, in order.
+	Trees []int
+
+	// Leaf is the row's leaf, or nil if the trees do not hold the key.
+	Leaf *MerkleNode
+}
+
+// NewMultiDiff creates a comparison of all the given trees.
+func NewMultiDiff(trees ...*MerkleTree) *MultiDiff {
+	return &MultiDiff{trees: trees}
+}
+
+// SetConcurrency sets the number of goroutines each underlying Diff may
+// use; see Diff.SetConcurrency.
+func (m *MultiDiff) SetConcurrency(n int) {
+	m.concurrency = n
+}
+
+// Compare finds every key on which the trees disagree. Each tree is diffed
+// against the first, since a key on which any two trees differ differs from
+// the first tree in at least one of them, and the keys in the differing
+// ranges are then grouped by their leaf hashes across all trees. As with
+// Merge, trees whose leaves are not in key order have every leaf grouped.
+//
+// It returns the same errors as Diff.Compare, and ErrPrunedSubtree if a
+// differing range reaches a pruned subtree.
+func (m *MultiDiff) Compare(ctx context.Context) error {
+	keys, index, err := changedKeys(ctx, m.trees, m.concurrency)
+	if err != nil {
+		return err
+	}
+
+	m.divergences = nil
+	for _, key := range keys {
+		leaves := make([]*MerkleNode, len(m.trees))
+		for i := range m.trees {
+			leaves[i] = index[i][key]
+		}
+		if d, ok := diverge(leaves); ok {
+			d.Key = []byte(key)
+			m.divergences = append(m.divergences, d)
+		}
+	}
+	return nil
+}
+
+// GetDivergences returns the keys found by the last Compare, in key order.
+func (m *MultiDiff) GetDivergences() []Divergence {
+	return m.divergences
+}
+
+// diverge groups one key's leaves, one per tree, by version, reporting
+// false if every tree holds the same version.
+func diverge(leaves []*MerkleNode) (Divergence, bool) {
+	var d Divergence
+	for i, leaf := range leaves {
+		g := slices.IndexFunc(d.Groups, func(g VersionGroup) bool { return sameLeaf(g.Leaf, leaf) })
+		if g < 0 {
+			d.Groups = append(d.Groups, VersionGroup{Leaf: leaf})
+			g = len(d.Groups) - 1
+		}
+		d.Groups[g].Trees = append(d.Groups[g].Trees, i)
+	}
+	if len(d.Groups) == 1 {
+		return Divergence{}, false
+	}
+
+	// The stable sort keeps groups of equal size in order of their first tree
+	slices.SortStableFunc(d.Groups, func(a, b VersionGroup) int { return len(b.Trees) - len(a.Trees) })
+
+	if d.Majority = 2*len(d.Groups[0].Trees) > len(leaves); d.Majority {
+		for _, g := range d.Groups[1:] {
+			d.Outliers = append(d.Outliers, g.Trees...)
+		}
+		slices.Sort(d.Outliers)
+	}
+	return d, true
+}
+
+// changedKeys diffs every tree against the first and returns, in order,
+// each key that differs between any of the trees or may do so, along with
+// every tree's leaves by key.
+//
+// If all the trees are in key order they are diffed by key, so every
+// differing key lies in some range, and only leaves in those ranges are
+// indexed. Otherwise a positional diff's ranges cannot be mapped back to
+// keys, and every leaf is indexed.
+func changedKeys(ctx context.Context, trees []*MerkleTree, concurrency int) ([]string, []map[string]*MerkleNode, error) {
+	if len(trees) < 2 {
+		return nil, nil, nil
+	}
+
+	ordered := true
+	for _, t := range trees {
+		ordered = ordered && t.isKeyOrdered()
+	}
+
+	var ranges []KeyRange
+	for _, t := range trees[1:] {
+		diff := NewDiff(trees[0], t)
+		diff.SetConcurrency(concurrency)
+		diff.byKey = ordered
+		if err := diff.Compare(ctx); err != nil {
+			return nil, nil, err
+		}
+		ranges = append(ranges, diff.GetRanges()...)
+	}
+	if len(ranges) == 0 {
+		return nil, nil, nil
+	}
+
+	var keys []string
+	index := make([]map[string]*MerkleNode, len(trees))
+	for i, t := range trees {
+		var leaves []*MerkleNode
+		var err error
+		if ordered {
+			for _, r := range ranges {
+				if leaves, err = leavesInRange(t.root, r.Start, r.End, leaves); err != nil {
+					return nil, nil, err
+				}
+			}
+		} else if leaves, err = collectLeaves(t.root); err != nil {
+			return nil, nil, err
+		}
+
+		index[i] = make(map[string]*MerkleNode, len(leaves))
+		for _, leaf := range leaves {
+			key := string(leaf.GetStartKey())
+			index[i][key] = leaf
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys), index, nil
+}
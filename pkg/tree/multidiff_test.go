@@ -0,0 +1,77 @@
+package tree
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestMultiDiff_FindsOutliers(t *testing.T) {
+	source := makeRows(200)
+	replicas := [][]Row{
+		source,
+		editRows(source, map[int]string{40: "stale"}),
+		source,
+		editRows(source, map[int]string{40: "stale", 90: "", 150: "other"}),
+		editRows(source, map[int]string{150: "wrong"}, Row{Key: []byte("k00555"), Values: []any{"extra", int64(0)}}),
+	}
+
+	for _, config := range []TreeConfig{{}, {Shape: ShapeContentDefined}} {
+		trees := make([]*MerkleTree, len(replicas))
+		for i, rows := range replicas {
+			trees[i], _ = NewMerkleTreeFromRowsWithConfig(rows, config)
+		}
+		multi := NewMultiDiff(trees...)
+		if err := multi.Compare(context.Background()); err != nil {
+			t.Fatalf("%+v: compare: %v", config, err)
+		}
+
+		want := []struct {
+			key      string
+			outliers []int
+			groups   int
+		}{
+			{"k00400", []int{1, 3}, 2},
+			{"k00555", []int{4}, 2},
+			{"k00900", []int{3}, 2},
+			{"k01500", []int{3, 4}, 3},
+		}
+		got := multi.GetDivergences()
+		if len(got) != len(want) {
+			t.Fatalf("%+v: expected %d divergences, got %d", config, len(want), len(got))
+		}
+		for i, w := range want {
+			d := got[i]
+			if string(d.Key) != w.key || !d.Majority || !slices.Equal(d.Outliers, w.outliers) || len(d.Groups) != w.groups {
+				t.Fatalf("%+v: expected %s with outliers %v in %d groups, got %s %v in %d groups",
+					config, w.key, w.outliers, w.groups, d.Key, d.Outliers, len(d.Groups))
+			}
+		}
+
+		// The removed row's outlier group has no leaf
+		if removed := got[2]; removed.Groups[1].Leaf != nil || removed.Groups[0].Leaf == nil {
+			t.Fatalf("%+v: expected the missing row to form a group without a leaf", config)
+		}
+	}
+}
+
+func TestMultiDiff_NoMajority(t *testing.T) {
+	rows := makeRows(20)
+	multi := NewMultiDiff(
+		NewMerkleTreeFromRows(rows),
+		NewMerkleTreeFromRows(rows),
+		NewMerkleTreeFromRows(changeRow(rows, 5)),
+		NewMerkleTreeFromRows(changeRow(rows, 5)),
+	)
+	if err := multi.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	got := multi.GetDivergences()
+	if len(got) != 1 || got[0].Majority || got[0].Outliers != nil {
+		t.Fatalf("expected one key without a majority, got %+v", got)
+	}
+	if !slices.Equal(got[0].Groups[0].Trees, []int{0, 1}) || !slices.Equal(got[0].Groups[1].Trees, []int{2, 3}) {
+		t.Fatalf("expected tied groups in tree order, got %+v", got[0].Groups)
+	}
+}
@@ -1,24 +1,36 @@
 package tree
 
-import "github.com/BryceDouglasJames/merklediff/pkg/hasher"
+import (
+	itree "github.com/BryceDouglasJames/merklediff/internal/tree"
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
 
 type MerkleNode struct {
 	hash     []byte
 	startKey []byte
 	endKey   []byte
-	left     *MerkleNode
-	right    *MerkleNode
+	children []*MerkleNode
 	level    int
+
+	// count is the number of leaves beneath the node, 1 for a leaf. A
+	// pruned node keeps the count of the subtree it replaced.
+	count int
 }
 
+// NewNode hashes data with SHA-256 into a new node.
 func NewNode(hash []byte, startKey []byte, endKey []byte) *MerkleNode {
-	h := &hasher.SHA256Hasher{}
-	hashed := h.Hash(hash)
+	return NewNodeWithHasher(&hasher.SHA256Hasher{}, hash, startKey, endKey)
+}
+
+// NewNodeWithHasher hashes data with h into a new node.
+func NewNodeWithHasher(h hasher.Hasher, data []byte, startKey []byte, endKey []byte) *MerkleNode {
+	hashed := h.Hash(data)
 	return &MerkleNode{
 		hash:     hashed,
 		startKey: startKey,
 		endKey:   endKey,
 		level:    0,
+		count:    1,
 	}
 }
 
@@ -34,18 +46,37 @@ func (n *MerkleNode) GetEndKey() []byte {
 	return n.endKey
 }
 
+// GetLeft returns the first child.
 func (n *MerkleNode) GetLeft() *MerkleNode {
-	return n.left
+	if len(n.children) == 0 {
+		return nil
+	}
+	return n.children[0]
 }
 
+// GetRight returns the last child of a node with two or more children.
+// In a binary tree this is the right child.
 func (n *MerkleNode) GetRight() *MerkleNode {
-	return n.right
+	if len(n.children) < 2 {
+		return nil
+	}
+	return n.children[len(n.children)-1]
+}
+
+// GetChildren returns the node's children in key order.
+func (n *MerkleNode) GetChildren() []*MerkleNode {
+	return n.children
 }
 
 func (n *MerkleNode) GetLevel() int {
 	return n.level
 }
 
+// GetCount returns the number of rows, or chunks, beneath the node.
+func (n *MerkleNode) GetCount() int {
+	return n.count
+}
+
 func (n *MerkleNode) SetHash(hash []byte) {
 	n.hash = hash
 }
@@ -58,26 +89,111 @@ func (n *MerkleNode) SetEndKey(endKey []byte) {
 	n.endKey = endKey
 }
 
+// SetLeft sets the first child.
 func (n *MerkleNode) SetLeft(left *MerkleNode) {
-	n.left = left
+	n.setChild(0, left)
 }
 
+// SetRight sets the last child, or the second child if there are fewer
+// than two.
 func (n *MerkleNode) SetRight(right *MerkleNode) {
-	n.right = right
+	n.setChild(max(1, len(n.children)-1), right)
+}
+
+// SetChildren replaces the node's children.
+func (n *MerkleNode) SetChildren(children []*MerkleNode) {
+	n.children = children
+}
+
+// setChild sets the child at index i, growing the slice as needed and
+// trimming trailing nil children.
+func (n *MerkleNode) setChild(i int, child *MerkleNode) {
+	for len(n.children) <= i {
+		n.children = append(n.children, nil)
+	}
+	n.children[i] = child
+	for len(n.children) > 0 && n.children[len(n.children)-1] == nil {
+		n.children = n.children[:len(n.children)-1]
+	}
 }
 
 func (n *MerkleNode) SetLevel(level int) {
 	n.level = level
 }
 
+func (n *MerkleNode) SetCount(count int) {
+	n.count = count
+}
+
 func (n *MerkleNode) GetChunkSize() int {
 	return len(n.startKey)
 }
 
 func (n *MerkleNode) IsLeaf() bool {
-	return n.left == nil && n.right == nil
+	return len(n.children) == 0
 }
 
 func (n *MerkleNode) IsInternal() bool {
-	return n.left != nil && n.right != nil
+	return len(n.children) >= 2 && n.children[0] != nil
+}
+
+// treeHasher builds leaf and parent nodes with a hasher and tree format.
+type treeHasher struct {
+	hasher hasher.Hasher
+	format TreeFormat
+}
+
+// rowLeaf creates a leaf for a row from its key and serialized values.
+func (th treeHasher) rowLeaf(key []byte, data []byte) *MerkleNode {
+	if th.format != FormatLegacy {
+		data = itree.KeyedLeafHashInput(key, data)
+	}
+	return NewNodeWithHasher(th.hasher, data, key, key)
+}
+
+// chunkLeaf creates a leaf for a raw chunk. The key only names the chunk
+// and is not part of its hash.
+func (th treeHasher) chunkLeaf(key []byte, chunk []byte) *MerkleNode {
+	if th.format != FormatLegacy {
+		chunk = itree.LeafHashInput(chunk)
+	}
+	return NewNodeWithHasher(th.hasher, chunk, key, key)
+}
+
+// internalHash hashes child hashes, in order, into their parent's hash.
+func (th treeHasher) internalHash(childHashes ...[]byte) []byte {
+	combined := itree.InternalHashInput(childHashes...)
+	if th.format == FormatLegacy {
+		// Concatenate the child hashes with no prefix
+		combined = combined[1:]
+	}
+	return th.hasher.Hash(combined)
+}
+
+// parent hashes two or more children into their parent node.
+func (th treeHasher) parent(children ...*MerkleNode) *MerkleNode {
+	hashes := make([][]byte, len(children))
+	for i, child := range children {
+		hashes[i] = child.GetHash()
+	}
+
+	first, last := children[0], children[len(children)-1]
+	parent := &MerkleNode{
+		hash:     th.internalHash(hashes...),
+		startKey: first.GetStartKey(),
+		endKey:   last.GetEndKey(),
+	}
+
+	// Set parent/child relationships
+	parent.SetChildren(children)
+
+	// Level is one more than the deepest child; the count is their sum
+	level := 0
+	for _, child := range children {
+		level = max(level, child.GetLevel())
+		parent.count += child.GetCount()
+	}
+	parent.SetLevel(level + 1)
+
+	return parent
 }
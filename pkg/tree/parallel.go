@@ -0,0 +1,122 @@
+package tree
+
+import (
+	"sync"
+
+	itree "github.com/BryceDouglasJames/merklediff/internal/tree"
+)
+
+// Parallel builds split the leaves, and each level of a positional tree,
+// into contiguous spans, one per worker. Every node is still computed from
+// the same children as in a serial build, so the tree is identical; only the
+// order in which nodes are hashed changes.
+
+// minSpan is the smallest span worth handing to its own goroutine.
+const minSpan = 512
+
+// readBatchSize is the number of rows BuildTreeFromReaderWithConfig reads
+// before handing them to the workers.
+const readBatchSize = 16384
+
+// span is a half-open range of indices handled by one worker.
+type span struct {
+	start, end int
+}
+
+// splitSpans divides [0, n) into at most workers contiguous spans of at
+// least minSpan items each, or a single span if n is too small to split.
+func splitSpans(n, workers int) []span {
+	count := min(max(workers, 1), n/minSpan)
+	if count <= 1 {
+		return []span{{0, n}}
+	}
+	spans := make([]span, count)
+	for i := range spans {
+		spans[i] = span{start: i * n / count, end: (i + 1) * n / count}
+	}
+	return spans
+}
+
+// runSpans calls fn for every span and waits for them all. Spans run on
+// their own goroutines when there is more than one.
+func runSpans(spans []span, fn func(i int, s span)) {
+	if len(spans) == 1 {
+		fn(0, spans[0])
+		return
+	}
+	var wg sync.WaitGroup
+	for i, s := range spans {
+		wg.Go(func() { fn(i, s) })
+	}
+	wg.Wait()
+}
+
+// hashRowLeaves serializes and hashes rows into leaf nodes, in row order.
+func hashRowLeaves(rows []Row, config TreeConfig) []*MerkleNode {
+	th := config.treeHasher()
+	nodes := make([]*MerkleNode, len(rows))
+	runSpans(splitSpans(len(rows), config.Workers), func(_ int, s span) {
+		// A serializer reuses its buffer, so each worker needs its own
+		serializer := itree.NewSerializer()
+		for i := s.start; i < s.end; i++ {
+			nodes[i] = th.rowLeaf(rows[i].Key, serializer.SerializeRow(rows[i].Values))
+			nodes[i].SetLevel(0)
+		}
+	})
+	return nodes
+}
+
+// hashReaderLeaves reads rows in batches and hashes each batch on the
+// workers while the next one is read. The caller checks r.Err.
+func hashReaderLeaves(r RowReader, config TreeConfig) []*MerkleNode {
+	var nodes []*MerkleNode
+	hashed := make(chan []*MerkleNode, 1)
+	inFlight := false
+
+	flush := func(batch []Row) {
+		if inFlight {
+			nodes = append(nodes, <-hashed...)
+		}
+		go func() { hashed <- hashRowLeaves(batch, config) }()
+		inFlight = true
+	}
+
+	batch := make([]Row, 0, readBatchSize)
+	for r.Next() {
+		batch = append(batch, r.Row())
+		if len(batch) == readBatchSize {
+			flush(batch)
+			batch = make([]Row, 0, readBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		flush(batch)
+	}
+	if inFlight {
+		nodes = append(nodes, <-hashed...)
+	}
+	return nodes
+}
+
+// buildContentParallel builds a content-defined tree from sorted leaves by
+// building a subtree per span and joining them in order. Joining two
+// content-defined trees yields the tree built from all of their leaves, so
+// the result matches a serial build.
+func buildContentParallel(leaves []*MerkleNode, th treeHasher, workers int) *MerkleNode {
+	spans := splitSpans(len(leaves), workers)
+	subtrees := make([]*MerkleNode, len(spans))
+	runSpans(spans, func(i int, s span) {
+		b := contentBuilder{hasher: th}
+		for _, leaf := range leaves[s.start:s.end] {
+			b.push(leaf)
+		}
+		subtrees[i] = b.finish()
+	})
+
+	root := subtrees[0]
+	for _, subtree := range subtrees[1:] {
+		// Only pruned subtrees can fail to join, and these are never pruned
+		root, _ = joinContent(th, root, subtree)
+	}
+	return root
+}
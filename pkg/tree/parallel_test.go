@@ -0,0 +1,96 @@
+package tree
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
+
+func TestParallelBuild_MatchesSerial(t *testing.T) {
+	for _, config := range []TreeConfig{
+		{},
+		{Fanout: 5},
+		{Shape: ShapeContentDefined},
+		{Format: FormatLegacy, Hasher: &hasher.SHA512_256Hasher{}},
+	} {
+		for _, n := range []int{0, 1, minSpan - 1, 4*minSpan + 3, 20011} {
+			rows := makeRows(n)
+			serial, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+
+			for _, workers := range []int{2, 3, 8} {
+				parallelConfig := config
+				parallelConfig.Workers = workers
+				parallel, err := NewMerkleTreeFromRowsWithConfig(rows, parallelConfig)
+				if err != nil {
+					t.Fatalf("build: %v", err)
+				}
+				if !sameTree(serial.GetRoot(), parallel.GetRoot()) {
+					t.Fatalf("%+v: %d rows with %d workers differs from the serial build", config, n, workers)
+				}
+			}
+		}
+	}
+}
+
+func TestParallelBuild_FromReader(t *testing.T) {
+	rows := makeRows(2*readBatchSize + 17)
+	for _, config := range []TreeConfig{{}, {Shape: ShapeContentDefined}} {
+		serial, _ := BuildTreeFromReaderWithConfig(&sliceReader{rows: rows}, config)
+
+		config.Workers = 4
+		parallel, err := BuildTreeFromReaderWithConfig(&sliceReader{rows: rows}, config)
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		if parallel.GetRowCount() != len(rows) {
+			t.Fatalf("expected %d rows, got %d", len(rows), parallel.GetRowCount())
+		}
+		if !sameTree(serial.GetRoot(), parallel.GetRoot()) {
+			t.Fatalf("%+v: parallel reader build differs from the serial build", config)
+		}
+	}
+}
+
+func TestParallelBuild_Streaming(t *testing.T) {
+	rows := makeRows(5000)
+	want := NewMerkleTreeFromRows(rows)
+
+	b, _ := NewStreamingTreeBuilderWithConfig(2048, TreeConfig{Workers: 4})
+	for _, row := range rows {
+		if err := b.AddRow(row); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	got, _ := b.Build()
+	if !sameTree(want.GetRoot(), got.GetRoot()) {
+		t.Fatal("parallel streaming build differs from the serial build")
+	}
+}
+
+func TestValidate_Workers(t *testing.T) {
+	if _, err := NewMerkleTreeFromRowsWithConfig(makeRows(3), TreeConfig{Workers: -1}); err == nil {
+		t.Fatal("expected an error for a negative worker count")
+	}
+}
+
+// sameTree reports whether two trees have the same nodes in the same places.
+func sameTree(a, b *MerkleNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !bytes.Equal(a.GetHash(), b.GetHash()) || a.GetLevel() != b.GetLevel() ||
+		!bytes.Equal(a.GetStartKey(), b.GetStartKey()) || !bytes.Equal(a.GetEndKey(), b.GetEndKey()) {
+		return false
+	}
+	childrenA, childrenB := a.GetChildren(), b.GetChildren()
+	if len(childrenA) != len(childrenB) {
+		return false
+	}
+	for i := range childrenA {
+		if !sameTree(childrenA[i], childrenB[i]) {
+			return false
+		}
+	}
+	return true
+}
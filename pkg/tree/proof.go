@@ -0,0 +1,123 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	itree "github.com/BryceDouglasJames/merklediff/internal/tree"
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
+
+var (
+	// ErrKeyNotFound is returned by Prove when the tree has no row with the
+	// requested key.
+	ErrKeyNotFound = errors.New("key not found in tree")
+
+	// ErrInvalidProof is returned when a proof does not lead from a row to
+	// the expected root hash.
+	ErrInvalidProof = errors.New("invalid proof")
+)
+
+// Proof shows that a row is part of a tree with a given root hash. It holds
+// the sibling hashes along the row's root path, so its size grows with the
+// depth of the tree rather than with the number of rows.
+type Proof struct {
+	// Key is the key of the proven row.
+	Key []byte `json:"key"`
+
+	// Format and Hasher identify how the tree was hashed.
+	Format TreeFormat `json:"format"`
+	Hasher string     `json:"hasher"`
+
+	// Steps run from the leaf's parent up to the root.
+	Steps []ProofStep `json:"steps"`
+}
+
+// ProofStep is one level of a proof: the hashes of the siblings before and
+// after the node on the path, in child order.
+type ProofStep struct {
+	Left  [][]byte `json:"left,omitempty"`
+	Right [][]byte `json:"right,omitempty"`
+}
+
+// Prove returns a proof that the row with the given key is in the tree.
+func (t *MerkleTree) Prove(key []byte) (*Proof, error) {
+	path := t.leafPath(key)
+	if path == nil {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+
+	proof := &Proof{
+		Key:    append([]byte(nil), key...),
+		Format: t.config.Format,
+		Hasher: t.config.Hasher.Name(),
+		Steps:  make([]ProofStep, 0, len(path)-1),
+	}
+	for i := len(path) - 2; i >= 0; i-- {
+		children := path[i].node.GetChildren()
+		idx := path[i].child
+		proof.Steps = append(proof.Steps, ProofStep{
+			Left:  childHashes(children[:idx]),
+			Right: childHashes(children[idx+1:]),
+		})
+	}
+	return proof, nil
+}
+
+// VerifyProof checks that row, with its values serialized as the tree
+// builder serializes them, hashes up through proof to rootHash. The hasher
+// is looked up by the name in the proof; keyed hashers need
+// VerifyProofWithHasher.
+//
+// A proof names its own hash function, so rootHash should be checked
+// against a published Fingerprint, which names the hash function too, rather
+// than trusted on its own.
+func VerifyProof(rootHash []byte, row Row, proof *Proof) error {
+	h, err := hasher.New(proof.Hasher, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+	return VerifyProofWithHasher(h, rootHash, row, proof)
+}
+
+// VerifyProofWithHasher is VerifyProof using h, which must have the name
+// recorded in the proof.
+func VerifyProofWithHasher(h hasher.Hasher, rootHash []byte, row Row, proof *Proof) error {
+	if h.Name() != proof.Hasher {
+		return fmt.Errorf("%w: proof uses %s, got %s", ErrInvalidProof, proof.Hasher, h.Name())
+	}
+	if proof.Format != FormatLegacy && proof.Format != FormatDomainSeparated {
+		return fmt.Errorf("%w: unsupported tree format %s", ErrInvalidProof, proof.Format)
+	}
+	if !bytes.Equal(row.Key, proof.Key) {
+		return fmt.Errorf("%w: proof is for key %q, not %q", ErrInvalidProof, proof.Key, row.Key)
+	}
+
+	th := treeHasher{hasher: h, format: proof.Format}
+	hash := th.rowLeaf(row.Key, itree.NewSerializer().SerializeRow(row.Values)).GetHash()
+	for _, step := range proof.Steps {
+		hashes := make([][]byte, 0, len(step.Left)+1+len(step.Right))
+		hashes = append(hashes, step.Left...)
+		hashes = append(hashes, hash)
+		hashes = append(hashes, step.Right...)
+		hash = th.internalHash(hashes...)
+	}
+
+	if !bytes.Equal(hash, rootHash) {
+		return fmt.Errorf("%w: row %q does not hash to the root", ErrInvalidProof, row.Key)
+	}
+	return nil
+}
+
+// childHashes returns the hashes of nodes, in order.
+func childHashes(nodes []*MerkleNode) [][]byte {
+	if len(nodes) == 0 {
+		return nil
+	}
+	hashes := make([][]byte, len(nodes))
+	for i, n := range nodes {
+		hashes[i] = n.GetHash()
+	}
+	return hashes
+}
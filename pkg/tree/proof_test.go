@@ -0,0 +1,125 @@
+package tree
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
+
+func TestProve_VerifiesEveryRow(t *testing.T) {
+	rows := makeRows(37)
+	for _, config := range []TreeConfig{
+		{},
+		{Shape: ShapeContentDefined},
+		{Fanout: 4, Hasher: &hasher.SHA512_256Hasher{}},
+		{Format: FormatLegacy},
+	} {
+		mt, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		root := mt.GetRoot().GetHash()
+
+		for _, row := range rows {
+			proof, err := mt.Prove(row.Key)
+			if err != nil {
+				t.Fatalf("prove %q: %v", row.Key, err)
+			}
+			if err := VerifyProof(root, row, proof); err != nil {
+				t.Fatalf("%+v: verify %q: %v", config, row.Key, err)
+			}
+		}
+	}
+}
+
+func TestVerifyProof_RejectsTamperedInput(t *testing.T) {
+	rows := makeRows(20)
+	mt := NewMerkleTreeFromRows(rows)
+	root := mt.GetRoot().GetHash()
+	row := rows[5]
+
+	proof, err := mt.Prove(row.Key)
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+
+	changed := Row{Key: row.Key, Values: []any{"forged", int64(5)}}
+	if err := VerifyProof(root, changed, proof); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected ErrInvalidProof for changed values, got %v", err)
+	}
+
+	other := rows[6]
+	if err := VerifyProof(root, other, proof); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected ErrInvalidProof for another row, got %v", err)
+	}
+
+	proof.Steps[0].Left, proof.Steps[0].Right = proof.Steps[0].Right, proof.Steps[0].Left
+	if err := VerifyProof(root, row, proof); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected ErrInvalidProof for reordered siblings, got %v", err)
+	}
+}
+
+func TestVerifyProof_RejectsOtherHMACKey(t *testing.T) {
+	rows := makeRows(10)
+	mt, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Hasher: hasher.NewHMACHasher([]byte("key-a"))})
+	proof, err := mt.Prove(rows[3].Key)
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+
+	root := mt.GetRoot().GetHash()
+	if err := VerifyProofWithHasher(hasher.NewHMACHasher([]byte("key-b")), root, rows[3], proof); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected ErrInvalidProof for another key, got %v", err)
+	}
+	if err := VerifyProofWithHasher(hasher.NewHMACHasher([]byte("key-a")), root, rows[3], proof); err != nil {
+		t.Fatalf("verify with the tree's key: %v", err)
+	}
+}
+
+func TestProve_MissingKey(t *testing.T) {
+	mt := NewMerkleTreeFromRows(makeRows(10))
+	if _, err := mt.Prove([]byte("k00005")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestProof_JSONRoundTrip(t *testing.T) {
+	h := hasher.NewHMACHasher([]byte("secret"))
+	rows := makeRows(9)
+	mt, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Hasher: h})
+
+	proof, _ := mt.Prove(rows[3].Key)
+	data, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var decoded Proof
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	if err := VerifyProof(mt.GetRoot().GetHash(), rows[3], &decoded); err == nil {
+		t.Fatal("expected an error verifying a keyed proof without the key")
+	}
+	if err := VerifyProofWithHasher(h, mt.GetRoot().GetHash(), rows[3], &decoded); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestProve_UnsortedTree(t *testing.T) {
+	// Numeric keys in numeric order, so the root's range "1".."30" does not
+	// contain "7" as bytes
+	var rows []Row
+	for i := 1; i <= 30; i++ {
+		rows = append(rows, Row{Key: []byte(strconv.Itoa(i)), Values: []any{int64(i)}})
+	}
+	mt := NewMerkleTreeFromRows(rows)
+
+	proof, err := mt.Prove([]byte("7"))
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+	if err := VerifyProof(mt.GetRoot().GetHash(), rows[6], proof); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// RangeHash returns a digest of exactly the rows with keys in [start, end],
+// or nil if there are none. The tree's leaves must be in key order.
+//
+// The digest is the root hash of the content-defined tree of those rows, so
+// it depends only on the rows, the hasher and the tree format: trees of any
+// shape or fan-out, holding any other rows, agree on it when they agree on
+// the range. It can be checked by building a content-defined tree from the
+// rows themselves, for example those revealed by ProveRange.
+//
+// A content-defined tree is split at start and end, reusing every subtree
+// between them, so only O(log n) nodes are rehashed. A positional tree's
+// subtrees do not line up with the content-defined shape, so every leaf in
+// the range is rehashed.
+func (t *MerkleTree) RangeHash(start, end []byte) ([]byte, error) {
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("range start %q is after end %q", start, end)
+	}
+	if !t.isKeyOrdered() {
+		return nil, ErrUnorderedTree
+	}
+
+	th := t.config.treeHasher()
+	var root *MerkleNode
+	if t.config.Shape == ShapeContentDefined {
+		var err error
+		if root, err = rangeContent(th, t.root, start, end); err != nil {
+			return nil, err
+		}
+	} else {
+		leaves, err := leavesInRange(t.root, start, end, nil)
+		if err != nil {
+			return nil, err
+		}
+		// The tree is key-ordered, so its keys are already unique
+		if root, err = buildContentDefined(leaves, th, t.config.Workers); err != nil {
+			return nil, err
+		}
+	}
+
+	if root == nil {
+		return nil, nil
+	}
+	return root.GetHash(), nil
+}
+
+// rangeContent returns the content-defined tree holding the leaves of n
+// with keys in [start, end]. Only nodes on the paths to start and end are
+// rebuilt.
+func rangeContent(th treeHasher, n *MerkleNode, start, end []byte) (*MerkleNode, error) {
+	_, first, rest, err := splitContent(th, n, start)
+	if err != nil {
+		return nil, err
+	}
+	if n, err = joinContent(th, first, rest); err != nil {
+		return nil, err
+	}
+
+	rest, last, _, err := splitContent(th, n, end)
+	if err != nil {
+		return nil, err
+	}
+	return joinContent(th, rest, last)
+}
+
+// leavesInRange appends the leaves under n with keys in [start, end], in
+// order. Leaves must be in key order.
+func leavesInRange(n *MerkleNode, start, end []byte, leaves []*MerkleNode) ([]*MerkleNode, error) {
+	switch {
+	case n == nil || bytes.Compare(n.GetEndKey(), start) < 0 || bytes.Compare(n.GetStartKey(), end) > 0:
+		return leaves, nil
+	case isPruned(n):
+		return nil, fmt.Errorf("%w: %q..%q", ErrPrunedSubtree, n.GetStartKey(), n.GetEndKey())
+	case n.IsLeaf():
+		return append(leaves, n), nil
+	}
+
+	var err error
+	for _, child := range n.GetChildren() {
+		if leaves, err = leavesInRange(child, start, end, leaves); err != nil {
+			return nil, err
+		}
+	}
+	return leaves, nil
+}
@@ -0,0 +1,102 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRangeHash_IndependentOfShapeAndOtherRows(t *testing.T) {
+	rows := makeRows(1000) // keys k00000, k00010, ...
+	want := contentTree(t, rows[101:501]).GetRoot().GetHash()
+
+	// Rows outside the range differ, and one is added, in the other trees
+	other := append(changeRow(rows, 50), Row{Key: []byte("k99999"), Values: []any{"extra", int64(0)}})
+
+	for _, config := range []TreeConfig{
+		{},
+		{Fanout: 5},
+		{Shape: ShapeContentDefined},
+		{Shape: ShapeContentDefined, Workers: 4},
+	} {
+		for _, input := range [][]Row{rows, other} {
+			mt, _ := NewMerkleTreeFromRowsWithConfig(input, config)
+			rootBefore := mt.GetRoot().GetHash()
+
+			got, err := mt.RangeHash([]byte("k01005"), []byte("k05000"))
+			if err != nil {
+				t.Fatalf("%+v: range hash: %v", config, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%+v: range hash does not match a tree of just the range's rows", config)
+			}
+			if !bytes.Equal(mt.GetRoot().GetHash(), rootBefore) {
+				t.Fatalf("%+v: range hash modified the tree", config)
+			}
+		}
+	}
+}
+
+func TestRangeHash_DetectsChangeInRange(t *testing.T) {
+	rows := makeRows(200)
+	for _, shape := range []TreeShape{ShapePositional, ShapeContentDefined} {
+		treeA, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Shape: shape})
+		treeB, _ := NewMerkleTreeFromRowsWithConfig(changeRow(rows, 120), TreeConfig{Shape: shape})
+
+		a, _ := treeA.RangeHash(rows[100].Key, rows[150].Key)
+		b, _ := treeB.RangeHash(rows[100].Key, rows[150].Key)
+		if bytes.Equal(a, b) {
+			t.Fatalf("%s: expected a changed row to change the range hash", shape)
+		}
+
+		a, _ = treeA.RangeHash(rows[0].Key, rows[99].Key)
+		b, _ = treeB.RangeHash(rows[0].Key, rows[99].Key)
+		if !bytes.Equal(a, b) {
+			t.Fatalf("%s: expected ranges without the change to match", shape)
+		}
+	}
+}
+
+func TestRangeHash_EdgeCases(t *testing.T) {
+	rows := makeRows(100)
+	mt := contentTree(t, rows)
+
+	if got, err := mt.RangeHash([]byte("k00001"), []byte("k00009")); err != nil || got != nil {
+		t.Fatalf("expected no digest for an empty range, got %x (%v)", got, err)
+	}
+	leaf, _ := mt.LeafAt(7)
+	if got, _ := mt.RangeHash(rows[7].Key, rows[7].Key); !bytes.Equal(got, leaf.GetHash()) {
+		t.Fatal("expected a single row's digest to be its leaf hash")
+	}
+	if _, err := mt.RangeHash([]byte("b"), []byte("a")); err == nil {
+		t.Fatal("expected an error for a reversed range")
+	}
+
+	unsorted := NewMerkleTreeFromRows([]Row{rows[1], rows[0]})
+	if _, err := unsorted.RangeHash(rows[0].Key, rows[1].Key); !errors.Is(err, ErrUnorderedTree) {
+		t.Fatalf("expected ErrUnorderedTree, got %v", err)
+	}
+}
+
+func TestRangeHash_PrunedTree(t *testing.T) {
+	rows := makeRows(256)
+	for _, shape := range []TreeShape{ShapePositional, ShapeContentDefined} {
+		b, _ := NewStreamingTreeBuilderWithConfig(16, TreeConfig{Shape: shape})
+		b.SetPruneLevel(3)
+		if err := b.Consume(&sliceReader{rows: rows}); err != nil {
+			t.Fatalf("consume: %v", err)
+		}
+		mt, _ := b.Build()
+
+		if shape == ShapeContentDefined {
+			// A range around the whole tree reuses the root
+			got, err := mt.RangeHash([]byte("a"), []byte("z"))
+			if err != nil || !bytes.Equal(got, mt.GetRoot().GetHash()) {
+				t.Fatalf("expected the root hash for the whole tree, got %v", err)
+			}
+		}
+		if _, err := mt.RangeHash(rows[10].Key, rows[20].Key); !errors.Is(err, ErrPrunedSubtree) {
+			t.Fatalf("%s: expected ErrPrunedSubtree, got %v", shape, err)
+		}
+	}
+}
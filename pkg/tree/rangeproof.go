@@ -0,0 +1,409 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	itree "github.com/BryceDouglasJames/merklediff/internal/tree"
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
+
+// ErrUnorderedTree is returned by ProveRange when the tree's leaves are not
+// in strictly increasing key order. Positional trees follow input order, so
+// build them from sorted rows (or use ShapeContentDefined, which always
+// sorts) to prove ranges.
+var ErrUnorderedTree = errors.New("tree leaves are not ordered by key")
+
+// RowLookup returns the row with the given key from the data a tree was
+// built from. Trees keep hashes, not values, so proofs that reveal rows
+// need the rows from the caller.
+type RowLookup func(key []byte) (Row, bool)
+
+// RangeProof shows exactly which rows a tree holds in the key range
+// [Start, End]. With no rows it proves that no key in the range exists;
+// ProveRange(key, key) is a non-membership proof for key.
+//
+// Besides the rows in the range, the proof reveals the rows immediately
+// before and after it, which show that nothing lies between them and the
+// range. The rest of the tree is represented only by hashes.
+type RangeProof struct {
+	Start []byte `json:"start"`
+	End   []byte `json:"end"`
+
+	// Format and Hasher identify how the tree was hashed.
+	Format TreeFormat `json:"format"`
+	Hasher string     `json:"hasher"`
+
+	// Before and After are the nearest rows outside the range, or nil if
+	// the range reaches the start or end of the tree.
+	Before *ProofLeaf `json:"before,omitempty"`
+	After  *ProofLeaf `json:"after,omitempty"`
+
+	// Rows are the rows in the range, in key order.
+	Rows []ProofLeaf `json:"rows"`
+
+	// Nodes is the part of the tree covering the revealed rows, in
+	// pre-order.
+	Nodes []RangeProofNode `json:"nodes"`
+}
+
+// ProofLeaf is a revealed row: its key and its values as serialized for
+// hashing.
+type ProofLeaf struct {
+	Key  []byte `json:"key"`
+	Data []byte `json:"data"`
+}
+
+// Matches reports whether the leaf holds row.
+func (l ProofLeaf) Matches(row Row) bool {
+	return bytes.Equal(l.Key, row.Key) && bytes.Equal(l.Data, itree.NewSerializer().SerializeRow(row.Values))
+}
+
+// RangeProofNode is one node of a range proof. A node with a Hash stands
+// for a whole subtree outside the revealed rows; a node with Children is
+// followed by that many child nodes; a node with neither is the next
+// revealed row.
+type RangeProofNode struct {
+	Hash     []byte `json:"hash,omitempty"`
+	Children int    `json:"children,omitempty"`
+}
+
+// ProveRange returns a proof of exactly which rows the tree holds with keys
+// in [start, end]. lookup supplies the values of the revealed rows.
+//
+// The tree's leaves must be in key order and use FormatDomainSeparated,
+// which binds each key into its leaf hash. A verifier must also trust that
+// the published root came from a key-ordered tree: a root built from
+// unsorted rows could hide rows outside their key position.
+func (t *MerkleTree) ProveRange(start, end []byte, lookup RowLookup) (*RangeProof, error) {
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("range start %q is after end %q", start, end)
+	}
+	if t.config.Format == FormatLegacy {
+		return nil, fmt.Errorf("range proofs need tree format %s or later", FormatDomainSeparated)
+	}
+	if !t.isKeyOrdered() {
+		return nil, ErrUnorderedTree
+	}
+
+	proof := &RangeProof{
+		Start:  append([]byte(nil), start...),
+		End:    append([]byte(nil), end...),
+		Format: t.config.Format,
+		Hasher: t.config.Hasher.Name(),
+		Rows:   []ProofLeaf{},
+	}
+	if t.root == nil {
+		return proof, nil
+	}
+
+	// Reveal every leaf from the last one before the range to the first
+	// one after it
+	lo, hi := start, end
+	before, err := lastLeafBefore(t.root, start)
+	if err != nil {
+		return nil, err
+	}
+	if before != nil {
+		lo = before.GetStartKey()
+	}
+	after, err := firstLeafAfter(t.root, end)
+	if err != nil {
+		return nil, err
+	}
+	if after != nil {
+		hi = after.GetStartKey()
+	}
+
+	var leaves []*MerkleNode
+	if err := encodeRange(t.root, lo, hi, &proof.Nodes, &leaves); err != nil {
+		return nil, err
+	}
+
+	th := t.config.treeHasher()
+	for _, leaf := range leaves {
+		key := leaf.GetStartKey()
+		row, ok := lookup(key)
+		if !ok {
+			return nil, fmt.Errorf("lookup has no row for key %q", key)
+		}
+		data := itree.NewSerializer().SerializeRow(row.Values)
+		if !bytes.Equal(th.rowLeaf(key, data).GetHash(), leaf.GetHash()) {
+			return nil, fmt.Errorf("row %q from lookup does not match the tree", key)
+		}
+
+		pl := ProofLeaf{Key: append([]byte(nil), key...), Data: data}
+		switch {
+		case bytes.Compare(key, start) < 0:
+			proof.Before = &pl
+		case bytes.Compare(key, end) > 0:
+			proof.After = &pl
+		default:
+			proof.Rows = append(proof.Rows, pl)
+		}
+	}
+	return proof, nil
+}
+
+// VerifyRangeProof checks that proof hashes to rootHash and that its rows
+// are exactly the rows in [proof.Start, proof.End]. The hasher is looked up
+// by the name in the proof; keyed hashers need VerifyRangeProofWithHasher.
+// As with VerifyProof, check rootHash against a published Fingerprint.
+func VerifyRangeProof(rootHash []byte, proof *RangeProof) error {
+	h, err := hasher.New(proof.Hasher, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+	return VerifyRangeProofWithHasher(h, rootHash, proof)
+}
+
+// VerifyRangeProofWithHasher is VerifyRangeProof using h, which must have
+// the name recorded in the proof.
+func VerifyRangeProofWithHasher(h hasher.Hasher, rootHash []byte, proof *RangeProof) error {
+	if h.Name() != proof.Hasher {
+		return fmt.Errorf("%w: proof uses %s, got %s", ErrInvalidProof, proof.Hasher, h.Name())
+	}
+	if proof.Format != FormatDomainSeparated {
+		return fmt.Errorf("%w: unsupported tree format %s", ErrInvalidProof, proof.Format)
+	}
+	if bytes.Compare(proof.Start, proof.End) > 0 {
+		return fmt.Errorf("%w: range start is after end", ErrInvalidProof)
+	}
+
+	// The revealed leaves must be strictly increasing, with only the
+	// boundary rows outside the range
+	var leaves []ProofLeaf
+	if proof.Before != nil {
+		if bytes.Compare(proof.Before.Key, proof.Start) >= 0 {
+			return fmt.Errorf("%w: row before the range has key %q", ErrInvalidProof, proof.Before.Key)
+		}
+		leaves = append(leaves, *proof.Before)
+	}
+	for _, row := range proof.Rows {
+		if bytes.Compare(row.Key, proof.Start) < 0 || bytes.Compare(row.Key, proof.End) > 0 {
+			return fmt.Errorf("%w: row %q is outside the range", ErrInvalidProof, row.Key)
+		}
+		leaves = append(leaves, row)
+	}
+	if proof.After != nil {
+		if bytes.Compare(proof.After.Key, proof.End) <= 0 {
+			return fmt.Errorf("%w: row after the range has key %q", ErrInvalidProof, proof.After.Key)
+		}
+		leaves = append(leaves, *proof.After)
+	}
+	for i := 1; i < len(leaves); i++ {
+		if bytes.Compare(leaves[i-1].Key, leaves[i].Key) >= 0 {
+			return fmt.Errorf("%w: rows are not in key order", ErrInvalidProof)
+		}
+	}
+
+	if len(proof.Nodes) == 0 {
+		// Only an empty tree has no nodes
+		if len(rootHash) != 0 || len(leaves) != 0 {
+			return fmt.Errorf("%w: no nodes", ErrInvalidProof)
+		}
+		return nil
+	}
+
+	v := rangeVerifier{th: treeHasher{hasher: h, format: proof.Format}, nodes: proof.Nodes, leaves: leaves}
+	hash, err := v.node(0)
+	if err != nil {
+		return err
+	}
+	if v.next != len(v.nodes) || v.leaf != len(v.leaves) {
+		return fmt.Errorf("%w: unused nodes or rows", ErrInvalidProof)
+	}
+
+	// Hidden subtrees beyond the revealed rows are only allowed on sides
+	// where a boundary row shows they lie outside the range
+	if v.hiddenBefore && proof.Before == nil {
+		return fmt.Errorf("%w: hidden rows before the range start", ErrInvalidProof)
+	}
+	if v.hiddenAfter && proof.After == nil {
+		return fmt.Errorf("%w: hidden rows after the range end", ErrInvalidProof)
+	}
+
+	if !bytes.Equal(hash, rootHash) {
+		return fmt.Errorf("%w: rows do not hash to the root", ErrInvalidProof)
+	}
+	return nil
+}
+
+// rangeVerifier rebuilds a root hash from a range proof's nodes.
+type rangeVerifier struct {
+	th     treeHasher
+	nodes  []RangeProofNode
+	leaves []ProofLeaf
+	next   int
+	leaf   int
+
+	// hiddenBefore and hiddenAfter record hashed subtrees seen before the
+	// first revealed row and after the last
+	hiddenBefore bool
+	hiddenAfter  bool
+}
+
+func (v *rangeVerifier) node(depth int) ([]byte, error) {
+	if v.next >= len(v.nodes) {
+		return nil, fmt.Errorf("%w: truncated nodes", ErrInvalidProof)
+	}
+	if depth > maxSnapshotDepth {
+		return nil, fmt.Errorf("%w: tree too deep", ErrInvalidProof)
+	}
+	n := v.nodes[v.next]
+	v.next++
+
+	switch {
+	case n.Hash != nil && n.Children != 0:
+		return nil, fmt.Errorf("%w: node has both a hash and children", ErrInvalidProof)
+
+	case n.Hash != nil:
+		if v.leaf == 0 {
+			v.hiddenBefore = true
+		} else {
+			v.hiddenAfter = true
+		}
+		return n.Hash, nil
+
+	case n.Children == 1 || n.Children < 0:
+		return nil, fmt.Errorf("%w: node with %d children", ErrInvalidProof, n.Children)
+
+	case n.Children > 0:
+		hashes := make([][]byte, n.Children)
+		for i := range hashes {
+			hash, err := v.node(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			hashes[i] = hash
+		}
+		return v.th.internalHash(hashes...), nil
+
+	default:
+		// A hidden subtree between two revealed rows could hold more rows
+		if v.hiddenAfter {
+			return nil, fmt.Errorf("%w: hidden rows between revealed rows", ErrInvalidProof)
+		}
+		if v.leaf >= len(v.leaves) {
+			return nil, fmt.Errorf("%w: more leaves than rows", ErrInvalidProof)
+		}
+		l := v.leaves[v.leaf]
+		v.leaf++
+		return v.th.rowLeaf(l.Key, l.Data).GetHash(), nil
+	}
+}
+
+// encodeRange appends the proof nodes for the subtree n, expanding every
+// node that overlaps [lo, hi] and collecting the leaves inside it.
+func encodeRange(n *MerkleNode, lo, hi []byte, nodes *[]RangeProofNode, leaves *[]*MerkleNode) error {
+	if bytes.Compare(n.GetEndKey(), lo) < 0 || bytes.Compare(n.GetStartKey(), hi) > 0 {
+		*nodes = append(*nodes, RangeProofNode{Hash: n.GetHash()})
+		return nil
+	}
+	if isPruned(n) {
+		return fmt.Errorf("%w: %q..%q", ErrPrunedSubtree, n.GetStartKey(), n.GetEndKey())
+	}
+	if n.IsLeaf() {
+		*nodes = append(*nodes, RangeProofNode{})
+		*leaves = append(*leaves, n)
+		return nil
+	}
+
+	*nodes = append(*nodes, RangeProofNode{Children: len(n.GetChildren())})
+	for _, child := range n.GetChildren() {
+		if err := encodeRange(child, lo, hi, nodes, leaves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastLeafBefore returns the leaf with the greatest key below key in a
+// key-ordered tree, or nil if there is none.
+func lastLeafBefore(n *MerkleNode, key []byte) (*MerkleNode, error) {
+	if bytes.Compare(n.GetStartKey(), key) >= 0 {
+		return nil, nil
+	}
+	if isPruned(n) {
+		return nil, fmt.Errorf("%w: %q..%q", ErrPrunedSubtree, n.GetStartKey(), n.GetEndKey())
+	}
+	if n.IsLeaf() {
+		return n, nil
+	}
+	children := n.GetChildren()
+	for i := len(children) - 1; i >= 0; i-- {
+		if found, err := lastLeafBefore(children[i], key); found != nil || err != nil {
+			return found, err
+		}
+	}
+	return nil, nil
+}
+
+// firstLeafAfter returns the leaf with the smallest key above key in a
+// key-ordered tree, or nil if there is none.
+func firstLeafAfter(n *MerkleNode, key []byte) (*MerkleNode, error) {
+	if bytes.Compare(n.GetEndKey(), key) <= 0 {
+		return nil, nil
+	}
+	if isPruned(n) {
+		return nil, fmt.Errorf("%w: %q..%q", ErrPrunedSubtree, n.GetStartKey(), n.GetEndKey())
+	}
+	if n.IsLeaf() {
+		return n, nil
+	}
+	for _, child := range n.GetChildren() {
+		if found, err := firstLeafAfter(child, key); found != nil || err != nil {
+			return found, err
+		}
+	}
+	return nil, nil
+}
+
+// isKeyOrdered reports whether the tree's leaves are in strictly increasing
+// key order. Content-defined trees always are, since their builds reject
+// repeated keys; positional trees are when they were built from sorted
+// rows. The answer is worked out on first use and cached; updates never
+// reorder keys, so it stays valid. It is safe to call from concurrent
+// readers.
+func (t *MerkleTree) isKeyOrdered() bool {
+	if t.config.Shape == ShapeContentDefined {
+		return true
+	}
+	t.keyOrder.once.Do(func() {
+		t.keyOrder.sorted = leavesSorted(t.root)
+	})
+	return t.keyOrder.sorted
+}
+
+// leavesSorted reports whether the leaves under n are in strictly
+// increasing key order.
+func leavesSorted(n *MerkleNode) bool {
+	var last []byte
+	ordered, first := true, true
+	var walk func(n *MerkleNode)
+	walk = func(n *MerkleNode) {
+		switch {
+		case n == nil || !ordered:
+		case n.IsLeaf():
+			if (!first && bytes.Compare(n.GetStartKey(), last) <= 0) ||
+				bytes.Compare(n.GetStartKey(), n.GetEndKey()) > 0 {
+				ordered = false
+			}
+			last, first = n.GetEndKey(), false
+		default:
+			for _, child := range n.GetChildren() {
+				walk(child)
+			}
+		}
+	}
+	walk(n)
+	return ordered
+}
+
+// keyOrder caches whether a positional tree's leaves are sorted by key.
+type keyOrder struct {
+	once   sync.Once
+	sorted bool
+}
@@ -0,0 +1,154 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func lookupIn(rows []Row) RowLookup {
+	byKey := make(map[string]Row, len(rows))
+	for _, r := range rows {
+		byKey[string(r.Key)] = r
+	}
+	return func(key []byte) (Row, bool) {
+		r, ok := byKey[string(key)]
+		return r, ok
+	}
+}
+
+func TestProveRange_Verifies(t *testing.T) {
+	rows := makeRows(50) // keys k00000, k00010, ..., k00490
+	for _, config := range []TreeConfig{{}, {Shape: ShapeContentDefined}, {Fanout: 3}} {
+		mt, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		root := mt.GetRoot().GetHash()
+
+		for _, tc := range []struct {
+			start, end string
+			want       int
+		}{
+			{"k00100", "k00200", 11},
+			{"k00105", "k00109", 0}, // between two keys
+			{"k00015", "k00015", 0}, // absent key
+			{"k00020", "k00020", 1}, // present key
+			{"a", "b", 0},           // before the first key
+			{"z", "zz", 0},          // after the last key
+			{"a", "zz", 50},         // everything
+		} {
+			proof, err := mt.ProveRange([]byte(tc.start), []byte(tc.end), lookupIn(rows))
+			if err != nil {
+				t.Fatalf("prove %s..%s: %v", tc.start, tc.end, err)
+			}
+			if len(proof.Rows) != tc.want {
+				t.Fatalf("%s..%s: expected %d rows, got %d", tc.start, tc.end, tc.want, len(proof.Rows))
+			}
+			if err := VerifyRangeProof(root, proof); err != nil {
+				t.Fatalf("%+v: verify %s..%s: %v", config, tc.start, tc.end, err)
+			}
+		}
+	}
+}
+
+func TestProveRange_ConcurrentReaders(t *testing.T) {
+	// The first read works out the key order, so it must not race with others
+	rows := makeRows(200)
+	mt := NewMerkleTreeFromRows(rows)
+	root := mt.GetRoot().GetHash()
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			proof, err := mt.ProveRange([]byte("k00100"), []byte("k00300"), lookupIn(rows))
+			if err != nil {
+				t.Errorf("prove: %v", err)
+				return
+			}
+			if err := VerifyRangeProof(root, proof); err != nil {
+				t.Errorf("verify: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestVerifyRangeProof_RejectsHiddenRow(t *testing.T) {
+	rows := makeRows(50)
+	mt := contentTree(t, rows)
+	root := mt.GetRoot().GetHash()
+
+	proof, err := mt.ProveRange([]byte("k00100"), []byte("k00130"), lookupIn(rows))
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+
+	// Dropping a row from the proof must not verify
+	hidden := *proof
+	hidden.Rows = append([]ProofLeaf{}, proof.Rows[:1]...)
+	hidden.Rows = append(hidden.Rows, proof.Rows[2:]...)
+	if err := VerifyRangeProof(root, &hidden); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected ErrInvalidProof for a dropped row, got %v", err)
+	}
+
+	// Nor may a boundary row be dropped, since it proves the range's edge
+	noBefore := *proof
+	noBefore.Before = nil
+	if err := VerifyRangeProof(root, &noBefore); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected ErrInvalidProof without the row before the range, got %v", err)
+	}
+
+	// Nor may a proof for one range be passed off as covering a wider one
+	wider := *proof
+	wider.End = []byte("k00150")
+	if err := VerifyRangeProof(root, &wider); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("expected ErrInvalidProof for a widened range, got %v", err)
+	}
+
+	if !proof.Rows[0].Matches(rows[10]) || proof.Rows[0].Matches(rows[11]) {
+		t.Fatal("Matches does not identify the revealed row")
+	}
+}
+
+func TestProveRange_NonMembershipAfterDelete(t *testing.T) {
+	rows := makeRows(30)
+	mt := contentTree(t, rows)
+	key := rows[12].Key
+
+	if _, err := mt.Delete(key); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	proof, err := mt.ProveRange(key, key, lookupIn(rows))
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+	if len(proof.Rows) != 0 || proof.Before == nil || proof.After == nil {
+		t.Fatalf("expected an empty range between two neighbours, got %+v", proof)
+	}
+	if !bytes.Equal(proof.Before.Key, rows[11].Key) || !bytes.Equal(proof.After.Key, rows[13].Key) {
+		t.Fatalf("unexpected neighbours %q and %q", proof.Before.Key, proof.After.Key)
+	}
+	if err := VerifyRangeProof(mt.GetRoot().GetHash(), proof); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestProveRange_RequiresOrderedTree(t *testing.T) {
+	rows := makeRows(10)
+	rows[2], rows[7] = rows[7], rows[2]
+	mt := NewMerkleTreeFromRows(rows)
+
+	if _, err := mt.ProveRange([]byte("a"), []byte("z"), lookupIn(rows)); !errors.Is(err, ErrUnorderedTree) {
+		t.Fatalf("expected ErrUnorderedTree, got %v", err)
+	}
+}
+
+func TestProveRange_EmptyTree(t *testing.T) {
+	mt := NewMerkleTreeFromRows(nil)
+	proof, err := mt.ProveRange([]byte("a"), []byte("z"), lookupIn(nil))
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+	if err := VerifyRangeProof(nil, proof); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
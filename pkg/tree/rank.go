@@ -0,0 +1,165 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+)
+
+// Every node counts the rows beneath it, so the queries below descend a
+// single path from the root and never visit the rows themselves. A query
+// whose answer lies inside a pruned subtree fails with ErrPrunedSubtree.
+
+// leafCount returns the number of leaves recorded in the root.
+func (t *MerkleTree) leafCount() int {
+	if t.root == nil {
+		return 0
+	}
+	return t.root.GetCount()
+}
+
+// Rank returns the number of rows with keys before key. The tree's leaves
+// must be in key order.
+func (t *MerkleTree) Rank(key []byte) (int, error) {
+	if !t.isKeyOrdered() {
+		return 0, ErrUnorderedTree
+	}
+	return countBefore(t.root, key, false)
+}
+
+// CountRange returns the number of rows with keys in [start, end]. The
+// tree's leaves must be in key order.
+func (t *MerkleTree) CountRange(start, end []byte) (int, error) {
+	if bytes.Compare(start, end) > 0 {
+		return 0, fmt.Errorf("range start %q is after end %q", start, end)
+	}
+	if !t.isKeyOrdered() {
+		return 0, ErrUnorderedTree
+	}
+	before, err := countBefore(t.root, start, false)
+	if err != nil {
+		return 0, err
+	}
+	through, err := countBefore(t.root, end, true)
+	if err != nil {
+		return 0, err
+	}
+	return through - before, nil
+}
+
+// LeafAt returns the leaf at position i, counting from 0, in the tree's
+// leaf order. In a key-ordered tree this is the row of rank i.
+func (t *MerkleTree) LeafAt(i int) (*MerkleNode, error) {
+	if i < 0 || i >= t.leafCount() {
+		return nil, fmt.Errorf("leaf %d out of range for %d rows", i, t.leafCount())
+	}
+
+	n := t.root
+	for !n.IsLeaf() {
+		var next *MerkleNode
+		for _, child := range n.GetChildren() {
+			if child == nil {
+				continue
+			}
+			if i < child.GetCount() {
+				next = child
+				break
+			}
+			i -= child.GetCount()
+		}
+		n = next
+	}
+	if isPruned(n) {
+		return nil, fmt.Errorf("%w: %q..%q", ErrPrunedSubtree, n.GetStartKey(), n.GetEndKey())
+	}
+	return n, nil
+}
+
+// Quantile returns the row at quantile q of the key order, 0 giving the
+// first row and 1 the last. The tree's leaves must be in key order.
+func (t *MerkleTree) Quantile(q float64) (*MerkleNode, error) {
+	if q < 0 || q > 1 {
+		return nil, fmt.Errorf("quantile %v outside [0, 1]", q)
+	}
+	if !t.isKeyOrdered() {
+		return nil, ErrUnorderedTree
+	}
+	n := t.leafCount()
+	if n == 0 {
+		return nil, fmt.Errorf("quantile of an empty tree")
+	}
+	return t.LeafAt(min(int(q*float64(n)), n-1))
+}
+
+// Sample returns n leaves drawn uniformly at random, without replacement,
+// in leaf order. If the tree holds n rows or fewer, every leaf is returned.
+func (t *MerkleTree) Sample(n int, rng *rand.Rand) ([]*MerkleNode, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("sample size %d is negative", n)
+	}
+	total := t.leafCount()
+	n = min(n, total)
+
+	// Floyd's algorithm picks n distinct positions in O(n)
+	picked := make(map[int]struct{}, n)
+	for j := total - n; j < total; j++ {
+		k := rng.IntN(j + 1)
+		if _, ok := picked[k]; ok {
+			k = j
+		}
+		picked[k] = struct{}{}
+	}
+	positions := make([]int, 0, n)
+	for k := range picked {
+		positions = append(positions, k)
+	}
+	slices.Sort(positions)
+
+	leaves := make([]*MerkleNode, len(positions))
+	for i, k := range positions {
+		leaf, err := t.LeafAt(k)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+// countBefore returns the number of leaves under n whose keys sort before
+// key, or at it too if inclusive is set. Leaves must be in key order.
+func countBefore(n *MerkleNode, key []byte, inclusive bool) (int, error) {
+	before := func(k []byte) bool {
+		c := bytes.Compare(k, key)
+		return c < 0 || (inclusive && c == 0)
+	}
+
+	total := 0
+	for n != nil {
+		switch {
+		case before(n.GetEndKey()):
+			return total + n.GetCount(), nil
+		case !before(n.GetStartKey()):
+			return total, nil
+		case n.IsLeaf():
+			// Only a pruned subtree can straddle key
+			return 0, fmt.Errorf("%w: %q..%q", ErrPrunedSubtree, n.GetStartKey(), n.GetEndKey())
+		}
+
+		// Skip the children wholly before key and descend into the next
+		var next *MerkleNode
+		for _, child := range n.GetChildren() {
+			if child == nil {
+				continue
+			}
+			if !before(child.GetEndKey()) {
+				next = child
+				break
+			}
+			total += child.GetCount()
+		}
+		n = next
+	}
+	return total, nil
+}
@@ -0,0 +1,172 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+// prunedTree streams rows into a tree whose nodes at level 3 and below are
+// pruned.
+func prunedTree(t *testing.T, rows []Row) *MerkleTree {
+	t.Helper()
+	b := NewStreamingTreeBuilder(16)
+	b.SetPruneLevel(3)
+	if err := b.Consume(&sliceReader{rows: rows}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	mt, _ := b.Build()
+	return mt
+}
+
+// checkCounts reports whether every node under n counts the leaves beneath it.
+func checkCounts(n *MerkleNode) bool {
+	if n == nil || n.IsLeaf() {
+		return true
+	}
+	sum := 0
+	for _, child := range n.GetChildren() {
+		if !checkCounts(child) {
+			return false
+		}
+		sum += child.GetCount()
+	}
+	return n.GetCount() == sum
+}
+
+func TestNodeCounts(t *testing.T) {
+	rows := makeRows(1000)
+	for _, config := range []TreeConfig{{}, {Fanout: 5}, {Shape: ShapeContentDefined}, {Workers: 4}} {
+		mt, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		if mt.GetRoot().GetCount() != len(rows) || !checkCounts(mt.GetRoot()) {
+			t.Fatalf("%+v: expected counts summing to %d rows, root has %d", config, len(rows), mt.GetRoot().GetCount())
+		}
+
+		if err := mt.Upsert(Row{Key: rows[5].Key, Values: []any{"changed", int64(1)}}); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+		if config.Shape == ShapeContentDefined {
+			if err := mt.Upsert(Row{Key: []byte("k00005"), Values: []any{"new", int64(1)}}); err != nil {
+				t.Fatalf("upsert: %v", err)
+			}
+			if _, err := mt.Delete(rows[10].Key); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+		}
+		if mt.GetRoot().GetCount() != mt.GetRowCount() || !checkCounts(mt.GetRoot()) {
+			t.Fatalf("%+v: counts not maintained by updates", config)
+		}
+	}
+
+	pruned := prunedTree(t, rows)
+	if got := snapshotRoundTrip(t, pruned).GetRoot(); got.GetCount() != len(rows) || !checkCounts(got) {
+		t.Fatalf("expected pruned counts to survive a snapshot, root has %d", got.GetCount())
+	}
+}
+
+func TestRank(t *testing.T) {
+	rows := makeRows(1000) // keys k00000, k00010, ...
+	for _, shape := range []TreeShape{ShapePositional, ShapeContentDefined} {
+		mt, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Shape: shape})
+
+		for _, i := range []int{0, 1, 377, 999} {
+			if got, err := mt.Rank(rows[i].Key); err != nil || got != i {
+				t.Fatalf("%s: expected rank %d, got %d (%v)", shape, i, got, err)
+			}
+			leaf, err := mt.LeafAt(i)
+			if err != nil || !bytes.Equal(leaf.GetStartKey(), rows[i].Key) {
+				t.Fatalf("%s: expected leaf %d to hold %q, got %v", shape, i, rows[i].Key, err)
+			}
+		}
+		if got, _ := mt.Rank([]byte("k00015")); got != 2 {
+			t.Fatalf("%s: expected 2 rows before a missing key, got %d", shape, got)
+		}
+		if got, _ := mt.CountRange([]byte("k00015"), []byte("k00050")); got != 4 {
+			t.Fatalf("%s: expected 4 rows in range, got %d", shape, got)
+		}
+		if median, _ := mt.Quantile(0.5); !bytes.Equal(median.GetStartKey(), rows[500].Key) {
+			t.Fatalf("%s: expected median %q, got %q", shape, rows[500].Key, median.GetStartKey())
+		}
+		if _, err := mt.LeafAt(len(rows)); err == nil {
+			t.Fatalf("%s: expected an error past the last leaf", shape)
+		}
+	}
+
+	unsorted := NewMerkleTreeFromRows([]Row{rows[1], rows[0]})
+	if _, err := unsorted.Rank(rows[0].Key); !errors.Is(err, ErrUnorderedTree) {
+		t.Fatalf("expected ErrUnorderedTree, got %v", err)
+	}
+}
+
+func TestRank_PrunedTree(t *testing.T) {
+	rows := makeRows(256)
+	mt := prunedTree(t, rows)
+
+	// Keys at subtree boundaries are counted from the pruned nodes
+	if got, err := mt.Rank(rows[64].Key); err != nil || got != 64 {
+		t.Fatalf("expected rank 64, got %d (%v)", got, err)
+	}
+	if got, err := mt.CountRange(rows[0].Key, rows[255].Key); err != nil || got != 256 {
+		t.Fatalf("expected 256 rows, got %d (%v)", got, err)
+	}
+	if _, err := mt.Rank(rows[65].Key); !errors.Is(err, ErrPrunedSubtree) {
+		t.Fatalf("expected ErrPrunedSubtree inside a pruned subtree, got %v", err)
+	}
+	if _, err := mt.LeafAt(65); !errors.Is(err, ErrPrunedSubtree) {
+		t.Fatalf("expected ErrPrunedSubtree, got %v", err)
+	}
+}
+
+func TestSample(t *testing.T) {
+	rows := makeRows(1000)
+	mt := NewMerkleTreeFromRows(rows)
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	sample, err := mt.Sample(50, rng)
+	if err != nil {
+		t.Fatalf("sample: %v", err)
+	}
+	if len(sample) != 50 {
+		t.Fatalf("expected 50 leaves, got %d", len(sample))
+	}
+	keys := make([]string, len(sample))
+	for i, leaf := range sample {
+		keys[i] = string(leaf.GetStartKey())
+	}
+	if !slices.IsSorted(keys) || len(slices.Compact(keys)) != 50 {
+		t.Fatalf("expected 50 distinct keys in order, got %v", keys)
+	}
+
+	all, _ := mt.Sample(5000, rng)
+	if len(all) != len(rows) {
+		t.Fatalf("expected every leaf when sampling more than the tree holds, got %d", len(all))
+	}
+}
+
+func TestDiff_RangeRowCounts(t *testing.T) {
+	rows := makeRows(500)
+	fewer := append(append([]Row(nil), rows[:100]...), rows[110:]...)
+	fewer = changeRow(fewer, 300)
+
+	for _, shape := range []TreeShape{ShapePositional, ShapeContentDefined} {
+		treeA, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Shape: shape})
+		treeB, _ := NewMerkleTreeFromRowsWithConfig(fewer, TreeConfig{Shape: shape})
+		diff := NewDiff(treeA, treeB)
+		if err := diff.Compare(context.Background()); err != nil {
+			t.Fatalf("compare: %v", err)
+		}
+
+		// Identical subtrees hold the same rows on both sides, so the
+		// ranges account for the whole difference in row count
+		delta := 0
+		for _, r := range diff.GetRanges() {
+			delta += r.RowsA - r.RowsB
+		}
+		if delta != 10 {
+			t.Fatalf("%s: expected ranges to lose 10 rows, got %d", shape, delta)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package tree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Content-defined trees are Cartesian trees over the gaps between adjacent
+// leaves. Each gap gets a priority derived from the key on its left, and the
+// gap with the highest priority in a run of leaves becomes the boundary
+// between that run's left and right subtrees. Because priorities depend only
+// on keys, the shape of a subtree depends only on the keys beneath it:
+// inserting or deleting a row changes the nodes on its root path and nothing
+// else.
+
+// gapPriority returns the priority of the gap that follows key.
+// SHA-256 is used regardless of the tree's hasher so that the shape of a
+// tree never depends on how its nodes are hashed.
+func gapPriority(key []byte) uint64 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// sortLeavesByKey orders leaves by key, keeping input order for equal keys.
+func sortLeavesByKey(leaves []*MerkleNode) {
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return bytes.Compare(leaves[i].GetStartKey(), leaves[j].GetStartKey()) < 0
+	})
+}
+
+// contentBuilder assembles a content-defined tree from leaves in key order.
+// Only the right spine of the tree under construction is kept, so the
+// builder holds O(log n) pending nodes on average.
+type contentBuilder struct {
+	hasher     treeHasher
+	spine      []spineEntry
+	tail       *MerkleNode
+	lastKey    []byte
+	pruneLevel int
+}
+
+// spineEntry is a finished left subtree waiting for the subtree to the right
+// of its gap.
+type spineEntry struct {
+	left     *MerkleNode
+	priority uint64
+}
+
+// push appends the next leaf in key order.
+func (b *contentBuilder) push(leaf *MerkleNode) {
+	if b.tail == nil {
+		b.tail = leaf
+		b.lastKey = leaf.GetEndKey()
+		return
+	}
+
+	priority := gapPriority(b.lastKey)
+
+	// Every pending gap with a lower priority sits below the new gap, so its
+	// subtree is complete. Ties go to the earlier gap.
+	for len(b.spine) > 0 && b.spine[len(b.spine)-1].priority < priority {
+		top := b.spine[len(b.spine)-1]
+		b.spine = b.spine[:len(b.spine)-1]
+		b.tail = pruneChildren(b.hasher.parent(top.left, b.tail), b.pruneLevel)
+	}
+
+	b.spine = append(b.spine, spineEntry{left: b.tail, priority: priority})
+	b.tail = leaf
+	b.lastKey = leaf.GetEndKey()
+}
+
+// finish closes the remaining spine and returns the root.
+func (b *contentBuilder) finish() *MerkleNode {
+	for len(b.spine) > 0 {
+		top := b.spine[len(b.spine)-1]
+		b.spine = b.spine[:len(b.spine)-1]
+		b.tail = pruneChildren(b.hasher.parent(top.left, b.tail), b.pruneLevel)
+	}
+	return b.tail
+}
+
+// buildContentDefined builds a content-defined tree from leaf nodes. Keys
+// must be unique: equal keys share a gap priority, so a run of them would
+// chain into a tree as deep as the run is long. Like StreamingTreeBuilder,
+// it returns ErrUnsortedInput for a repeated key.
+func buildContentDefined(leaves []*MerkleNode, th treeHasher, workers int) (*MerkleNode, error) {
+	if len(leaves) == 0 {
+		return nil, nil
+	}
+
+	sortLeavesByKey(leaves)
+	for i := 1; i < len(leaves); i++ {
+		if bytes.Equal(leaves[i].GetStartKey(), leaves[i-1].GetStartKey()) {
+			return nil, fmt.Errorf("%w: duplicate key %q", ErrUnsortedInput, leaves[i].GetStartKey())
+		}
+	}
+
+	return buildContentParallel(leaves, th, workers), nil
+}
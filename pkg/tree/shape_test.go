@@ -0,0 +1,180 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func makeRows(n int) []Row {
+	rows := make([]Row, n)
+	for i := range rows {
+		key := fmt.Sprintf("k%05d", i*10)
+		rows[i] = Row{Key: []byte(key), Values: []any{key, int64(i)}}
+	}
+	return rows
+}
+
+func contentTree(t *testing.T, rows []Row) *MerkleTree {
+	t.Helper()
+	mt, err := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Shape: ShapeContentDefined})
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	return mt
+}
+
+func TestContentDefined_IndependentOfInputOrder(t *testing.T) {
+	rows := makeRows(200)
+	reversed := make([]Row, len(rows))
+	for i, r := range rows {
+		reversed[len(rows)-1-i] = r
+	}
+
+	treeA := contentTree(t, rows)
+	treeB := contentTree(t, reversed)
+
+	if !bytes.Equal(treeA.GetRoot().GetHash(), treeB.GetRoot().GetHash()) {
+		t.Fatalf("expected identical roots for the same rows in a different order")
+	}
+}
+
+func TestContentDefined_InsertOnlyReportsNewRow(t *testing.T) {
+	rows := makeRows(1000)
+
+	inserted := Row{Key: []byte("k00015"), Values: []any{"k00015", int64(-1)}}
+	rowsB := append([]Row{rows[0], rows[1], inserted}, rows[2:]...)
+
+	treeA := contentTree(t, rows)
+	treeB := contentTree(t, rowsB)
+
+	diff := NewDiff(treeA, treeB)
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	ranges := diff.GetRanges()
+	if len(ranges) != 1 {
+		t.Fatalf("expected 1 difference, got %d: %v", len(ranges), ranges)
+	}
+	if ranges[0].Type != DiffTypeAdded || !bytes.Equal(ranges[0].Start, inserted.Key) {
+		t.Fatalf("expected added %q, got %s %q", inserted.Key, ranges[0].Type, ranges[0].Start)
+	}
+}
+
+func TestContentDefined_InsertOnlyChangesRootPath(t *testing.T) {
+	rows := makeRows(1000)
+	inserted := Row{Key: []byte("k00015"), Values: []any{"k00015", int64(-1)}}
+
+	treeA := contentTree(t, rows)
+	treeB := contentTree(t, append([]Row{inserted}, rows...))
+
+	hashesA := make(map[string]bool)
+	collectHashes(treeA.GetRoot(), hashesA)
+
+	// Every node in B that is not in A lies on the new leaf's root path.
+	newNodes := 0
+	countNew(treeB.GetRoot(), hashesA, &newNodes)
+	depth := depthOf(treeB.GetRoot(), inserted.Key)
+	if newNodes > depth+1 {
+		t.Fatalf("expected at most %d new nodes, got %d", depth+1, newNodes)
+	}
+}
+
+func TestContentDefined_ChangeAndDelete(t *testing.T) {
+	rows := makeRows(500)
+
+	rowsB := make([]Row, 0, len(rows))
+	for i, r := range rows {
+		switch i {
+		case 100:
+			continue
+		case 300:
+			r = Row{Key: r.Key, Values: []any{string(r.Key), int64(-1)}}
+		}
+		rowsB = append(rowsB, r)
+	}
+
+	diff := NewDiff(contentTree(t, rows), contentTree(t, rowsB))
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	ranges := diff.GetRanges()
+	if len(ranges) != 2 {
+		t.Fatalf("expected 2 differences, got %d: %v", len(ranges), ranges)
+	}
+	if ranges[0].Type != DiffTypeRemoved || !bytes.Equal(ranges[0].Start, rows[100].Key) {
+		t.Fatalf("expected removed %q first, got %s %q", rows[100].Key, ranges[0].Type, ranges[0].Start)
+	}
+	if ranges[1].Type != DiffTypeChanged || !bytes.Equal(ranges[1].Start, rows[300].Key) {
+		t.Fatalf("expected changed %q second, got %s %q", rows[300].Key, ranges[1].Type, ranges[1].Start)
+	}
+}
+
+func TestContentDefined_RejectsDuplicateKeys(t *testing.T) {
+	rows := make([]Row, 3000)
+	for i := range rows {
+		rows[i] = Row{Key: []byte("same"), Values: []any{int64(i)}}
+	}
+	if _, err := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Shape: ShapeContentDefined}); !errors.Is(err, ErrUnsortedInput) {
+		t.Fatalf("expected ErrUnsortedInput, got %v", err)
+	}
+	if _, err := BuildTreeFromReaderWithConfig(&sliceReader{rows: rows}, TreeConfig{Shape: ShapeContentDefined}); !errors.Is(err, ErrUnsortedInput) {
+		t.Fatalf("expected ErrUnsortedInput from a reader, got %v", err)
+	}
+
+	// Positional trees keep input order and allow repeats
+	if _, err := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{}); err != nil {
+		t.Fatalf("positional build: %v", err)
+	}
+}
+
+func TestParseTreeShape(t *testing.T) {
+	for name, want := range map[string]TreeShape{
+		"":           ShapePositional,
+		"positional": ShapePositional,
+		"content":    ShapeContentDefined,
+	} {
+		got, err := ParseTreeShape(name)
+		if err != nil || got != want {
+			t.Fatalf("ParseTreeShape(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseTreeShape("spiral"); err == nil {
+		t.Fatal("expected error for unknown shape")
+	}
+}
+
+func collectHashes(node *MerkleNode, seen map[string]bool) {
+	if node == nil {
+		return
+	}
+	seen[string(node.GetHash())] = true
+	collectHashes(node.GetLeft(), seen)
+	collectHashes(node.GetRight(), seen)
+}
+
+func countNew(node *MerkleNode, seen map[string]bool, count *int) {
+	if node == nil || seen[string(node.GetHash())] {
+		return
+	}
+	*count++
+	countNew(node.GetLeft(), seen, count)
+	countNew(node.GetRight(), seen, count)
+}
+
+func depthOf(node *MerkleNode, key []byte) int {
+	depth := 0
+	for !node.IsLeaf() {
+		if bytes.Compare(key, node.GetLeft().GetEndKey()) <= 0 {
+			node = node.GetLeft()
+		} else {
+			node = node.GetRight()
+		}
+		depth++
+	}
+	return depth
+}
@@ -0,0 +1,343 @@
+package tree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// A Sketch is an invertible Bloom lookup table of a tree's leaves. Two
+// parties can each sketch their tree and exchange only the sketches, whose
+// size depends on how many rows they expect to differ rather than on how
+// many they hold; subtracting one sketch from the other recovers the keys
+// that differ. This needs one message rather than the round trip per tree
+// level of a Merkle traversal, at the cost of failing outright when the
+// difference outgrows the sketch.
+//
+// Each leaf is entered as its key and leaf hash, so the sketch depends only
+// on the rows, the hasher and the tree format, and never on the tree's shape
+// or fan-out.
+
+// Sketch layout (integers are unsigned varints unless noted):
+//
+//	magic             "MDSK"
+//	version           uint16, big-endian
+//	hasher name       length-prefixed bytes
+//	format, row count, cell count
+//	cells             count (zigzag), key sum, hash sum (both length-
+//	                  prefixed), check sum (uint64, big-endian)
+//	checksum          CRC-32 (IEEE) of everything above, uint32 big-endian
+
+// SketchMagic starts every sketch file.
+const SketchMagic = "MDSK"
+
+const (
+	sketchVersion = 1
+
+	// sketchHashes is the number of cells each leaf is added to, one in
+	// each of as many equal partitions of the table.
+	sketchHashes = 3
+
+	// minSketchCells keeps small sketches from failing on chance
+	// collisions between a handful of leaves.
+	minSketchCells = 30
+)
+
+var (
+	// ErrSketchOverflow is returned by Reconcile when the sketches differ
+	// in more rows than they have room to recover.
+	ErrSketchOverflow = errors.New("sketches differ in too many rows to decode")
+
+	// ErrInvalidSketch is returned by ReadSketch when the input is not a
+	// sketch this version can read, or fails its integrity checks.
+	ErrInvalidSketch = errors.New("invalid sketch")
+)
+
+// Sketch is an invertible Bloom lookup table of a tree's leaves.
+type Sketch struct {
+	hasher string
+	format TreeFormat
+	rows   int
+	cells  []sketchCell
+}
+
+// sketchCell sums the leaves added to it: how many, the XOR of their
+// length-prefixed keys and of their hashes, and the XOR of each leaf's
+// check value, which tells a cell holding a single leaf from a mix.
+type sketchCell struct {
+	count   int64
+	keySum  []byte
+	hashSum []byte
+	check   uint64
+}
+
+// SketchCells returns the number of cells a sketch needs to recover up to
+// differences differing keys with high probability, allowing for both
+// versions of each changed row.
+func SketchCells(differences int) int {
+	cells := max(minSketchCells, 3*differences+minSketchCells)
+	return (cells + sketchHashes - 1) / sketchHashes * sketchHashes
+}
+
+// NewSketch returns a sketch of t's leaves with the given number of cells,
+// which is rounded up to a multiple of the number of cells per leaf.
+// Sketches can only be reconciled if they have the same number of cells;
+// see SketchCells. It returns ErrPrunedSubtree if t has pruned subtrees.
+func NewSketch(t *MerkleTree, cells int) (*Sketch, error) {
+	if cells <= 0 {
+		return nil, fmt.Errorf("sketch needs at least one cell, got %d", cells)
+	}
+	leaves, err := collectLeaves(t.root)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sketch{
+		hasher: t.config.Hasher.Name(),
+		format: t.config.Format,
+		rows:   len(leaves),
+		cells:  make([]sketchCell, (cells+sketchHashes-1)/sketchHashes*sketchHashes),
+	}
+	for _, leaf := range leaves {
+		s.toggle(leaf.GetStartKey(), leaf.GetHash(), 1)
+	}
+	return s, nil
+}
+
+// Hasher returns the name of the hasher of the sketched tree.
+func (s *Sketch) Hasher() string {
+	return s.hasher
+}
+
+// Format returns the format of the sketched tree.
+func (s *Sketch) Format() TreeFormat {
+	return s.format
+}
+
+// Rows returns the number of leaves in the sketch.
+func (s *Sketch) Rows() int {
+	return s.rows
+}
+
+// Cells returns the number of cells in the sketch.
+func (s *Sketch) Cells() int {
+	return len(s.cells)
+}
+
+// Reconcile recovers the keys whose rows differ between the tree sketched
+// by s, taken as A, and the one sketched by other, as B. Ranges are single
+// keys, in key order, with the same types and row counts Diff reports.
+//
+// It returns a *MismatchError if the sketches used different hashers or tree
+// formats, and ErrSketchOverflow if the difference is too large for the
+// sketches, in which case larger sketches are needed.
+func (s *Sketch) Reconcile(other *Sketch) ([]KeyRange, error) {
+	if s.hasher != other.hasher {
+		return nil, &MismatchError{Err: ErrHasherMismatch, A: s.hasher, B: other.hasher}
+	}
+	if s.format != other.format {
+		return nil, &MismatchError{Err: ErrFormatMismatch, A: s.format.String(), B: other.format.String()}
+	}
+	if len(s.cells) != len(other.cells) {
+		return nil, fmt.Errorf("sketch sizes differ: %d vs %d cells", len(s.cells), len(other.cells))
+	}
+
+	// Subtract other from a copy of s, leaving only the leaves that differ
+	diff := &Sketch{cells: make([]sketchCell, len(s.cells))}
+	for i := range diff.cells {
+		a, b := s.cells[i], other.cells[i]
+		diff.cells[i] = sketchCell{
+			count:   a.count - b.count,
+			keySum:  xorInto(bytes.Clone(a.keySum), b.keySum),
+			hashSum: xorInto(bytes.Clone(a.hashSum), b.hashSum),
+			check:   a.check ^ b.check,
+		}
+	}
+
+	// Peel off cells holding a single leaf until none are left
+	inA := make(map[string][]byte)
+	inB := make(map[string][]byte)
+	for progress := true; progress; {
+		progress = false
+		for i := range diff.cells {
+			key, hash, ok := diff.cells[i].pure()
+			if !ok {
+				continue
+			}
+			if diff.cells[i].count == 1 {
+				inA[string(key)] = hash
+				diff.toggle(key, hash, -1)
+			} else {
+				inB[string(key)] = hash
+				diff.toggle(key, hash, 1)
+			}
+			progress = true
+		}
+	}
+	for _, c := range diff.cells {
+		if !c.empty() {
+			return nil, ErrSketchOverflow
+		}
+	}
+
+	var ranges []KeyRange
+	for key := range inA {
+		r := KeyRange{Start: []byte(key), End: []byte(key), Type: DiffTypeRemoved, RowsA: 1}
+		if _, ok := inB[key]; ok {
+			r.Type, r.RowsB = DiffTypeChanged, 1
+		}
+		ranges = append(ranges, r)
+	}
+	for key := range inB {
+		if _, ok := inA[key]; !ok {
+			ranges = append(ranges, KeyRange{Start: []byte(key), End: []byte(key), Type: DiffTypeAdded, RowsB: 1})
+		}
+	}
+	slices.SortFunc(ranges, func(a, b KeyRange) int { return bytes.Compare(a.Start, b.Start) })
+	return ranges, nil
+}
+
+// toggle adds a leaf to the sketch with sign 1, or removes it with -1.
+func (s *Sketch) toggle(key, hash []byte, sign int64) {
+	check, indices := sketchDigest(key, hash, len(s.cells))
+	entry := binary.AppendUvarint(nil, uint64(len(key)))
+	entry = append(entry, key...)
+	for _, i := range indices {
+		c := &s.cells[i]
+		c.count += sign
+		c.keySum = xorInto(c.keySum, entry)
+		c.hashSum = xorInto(c.hashSum, hash)
+		c.check ^= check
+	}
+}
+
+// pure returns the leaf in a cell holding exactly one, added or removed.
+func (c sketchCell) pure() (key, hash []byte, ok bool) {
+	if c.count != 1 && c.count != -1 {
+		return nil, nil, false
+	}
+	n, size := binary.Uvarint(c.keySum)
+	if size <= 0 || n > uint64(len(c.keySum)-size) {
+		return nil, nil, false
+	}
+	// Longer keys that cancelled out leave zeros after the key
+	key = c.keySum[size : size+int(n)]
+	if !allZero(c.keySum[size+int(n):]) {
+		return nil, nil, false
+	}
+	if check, _ := sketchDigest(key, c.hashSum, 0); check != c.check {
+		return nil, nil, false
+	}
+	return bytes.Clone(key), bytes.Clone(c.hashSum), true
+}
+
+// empty reports whether the cell holds no leaves.
+func (c sketchCell) empty() bool {
+	return c.count == 0 && c.check == 0 && allZero(c.keySum) && allZero(c.hashSum)
+}
+
+// sketchDigest returns a leaf's check value and, for a table of the given
+// size, the cell it occupies in each partition.
+func sketchDigest(key, hash []byte, cells int) (uint64, []int) {
+	h := sha256.New()
+	h.Write(binary.AppendUvarint(nil, uint64(len(key))))
+	h.Write(key)
+	h.Write(hash)
+	sum := h.Sum(nil)
+
+	check := binary.BigEndian.Uint64(sum[:8])
+	if cells == 0 {
+		return check, nil
+	}
+	part := cells / sketchHashes
+	indices := make([]int, sketchHashes)
+	for i := range indices {
+		v := binary.BigEndian.Uint64(sum[8+8*i:])
+		indices[i] = i*part + int(v%uint64(part))
+	}
+	return check, indices
+}
+
+// xorInto XORs src into dst, first padding dst with zeros to src's length.
+func xorInto(dst, src []byte) []byte {
+	if len(dst) < len(src) {
+		dst = append(dst, make([]byte, len(src)-len(dst))...)
+	}
+	for i, b := range src {
+		dst[i] ^= b
+	}
+	return dst
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo writes the sketch to w. It implements io.WriterTo.
+func (s *Sketch) WriteTo(w io.Writer) (int64, error) {
+	e := newSnapshotEncoder(w)
+
+	e.Raw([]byte(SketchMagic))
+	e.Raw(binary.BigEndian.AppendUint16(nil, sketchVersion))
+	e.Bytes([]byte(s.hasher))
+	e.Uvarint(uint64(s.format))
+	e.Uvarint(uint64(s.rows))
+	e.Uvarint(uint64(len(s.cells)))
+	for _, c := range s.cells {
+		e.Uvarint(uint64(c.count<<1) ^ uint64(c.count>>63))
+		e.Bytes(c.keySum)
+		e.Bytes(c.hashSum)
+		e.Raw(binary.BigEndian.AppendUint64(nil, c.check))
+	}
+
+	return e.Finish()
+}
+
+// ReadSketch reads a sketch written by Sketch.WriteTo.
+func ReadSketch(r io.Reader) (*Sketch, error) {
+	d := newSnapshotDecoder(r, ErrInvalidSketch)
+
+	magic := d.Raw(len(SketchMagic))
+	if d.Err() == nil && string(magic) != SketchMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrInvalidSketch, magic)
+	}
+	version := binary.BigEndian.Uint16(d.Raw(2))
+	if d.Err() == nil && version != sketchVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSketch, version)
+	}
+
+	s := &Sketch{
+		hasher: string(d.bytes()),
+		format: TreeFormat(d.Uvarint()),
+		rows:   int(d.Uvarint()),
+	}
+	n := d.count()
+	if d.Err() == nil && (n == 0 || n%sketchHashes != 0) {
+		return nil, fmt.Errorf("%w: %d cells", ErrInvalidSketch, n)
+	}
+	// Grow as cells arrive, so a corrupt count cannot force a huge
+	// allocation before the data runs out
+	for i := 0; i < n && d.Err() == nil; i++ {
+		zigzag := d.Uvarint()
+		s.cells = append(s.cells, sketchCell{
+			count:   int64(zigzag>>1) ^ -int64(zigzag&1),
+			keySum:  d.bytes(),
+			hashSum: d.bytes(),
+			check:   binary.BigEndian.Uint64(d.Raw(8)),
+		})
+	}
+
+	if err := d.VerifyChecksum(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,158 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"runtime"
+	"testing"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+)
+
+func TestSketch_Reconcile(t *testing.T) {
+	rowsA := makeRows(1000)
+	rowsB := editRows(rowsA, map[int]string{100: "changed", 250: "", 900: "changed"},
+		Row{Key: []byte("k00555"), Values: []any{"new", int64(0)}})
+
+	want := []struct {
+		key  string
+		kind DiffType
+	}{
+		{"k00555", DiffTypeAdded},
+		{"k01000", DiffTypeChanged},
+		{"k02500", DiffTypeRemoved},
+		{"k09000", DiffTypeChanged},
+	}
+
+	for _, config := range []TreeConfig{{}, {Shape: ShapeContentDefined}, {Fanout: 4}} {
+		treeA, _ := NewMerkleTreeFromRowsWithConfig(rowsA, config)
+		treeB, _ := NewMerkleTreeFromRowsWithConfig(rowsB, config)
+
+		a, err := NewSketch(treeA, SketchCells(len(want)))
+		if err != nil {
+			t.Fatalf("%+v: sketch: %v", config, err)
+		}
+		b, _ := NewSketch(treeB, SketchCells(len(want)))
+		if a.Rows() != 1000 || b.Rows() != 1000 {
+			t.Fatalf("%+v: expected 1000 rows on each side, got %d and %d", config, a.Rows(), b.Rows())
+		}
+
+		ranges, err := a.Reconcile(b)
+		if err != nil {
+			t.Fatalf("%+v: reconcile: %v", config, err)
+		}
+		if len(ranges) != len(want) {
+			t.Fatalf("%+v: expected %d keys, got %d", config, len(want), len(ranges))
+		}
+		for i, w := range want {
+			if string(ranges[i].Start) != w.key || ranges[i].Type != w.kind {
+				t.Fatalf("%+v: expected %s to be %s, got %s %s", config, w.key, w.kind, ranges[i].Start, ranges[i].Type)
+			}
+		}
+	}
+}
+
+func TestSketch_Identical(t *testing.T) {
+	rows := makeRows(200)
+	a, _ := NewSketch(NewMerkleTreeFromRows(rows), 30)
+	b, _ := NewSketch(NewMerkleTreeFromRows(rows), 30)
+
+	ranges, err := a.Reconcile(b)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	if len(ranges) != 0 {
+		t.Fatalf("expected no differences, got %d", len(ranges))
+	}
+}
+
+func TestSketch_Overflow(t *testing.T) {
+	rowsA := makeRows(500)
+	a, _ := NewSketch(NewMerkleTreeFromRows(rowsA), SketchCells(2))
+	b, _ := NewSketch(NewMerkleTreeFromRows(rowsA[:300]), SketchCells(2))
+
+	if _, err := a.Reconcile(b); !errors.Is(err, ErrSketchOverflow) {
+		t.Fatalf("expected ErrSketchOverflow, got %v", err)
+	}
+}
+
+func TestSketch_Mismatch(t *testing.T) {
+	rows := makeRows(20)
+	treeB, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Hasher: &hasher.FNVHasher{}})
+	a, _ := NewSketch(NewMerkleTreeFromRows(rows), 30)
+	b, _ := NewSketch(treeB, 30)
+
+	if _, err := a.Reconcile(b); !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("expected ErrHasherMismatch, got %v", err)
+	}
+
+	c, _ := NewSketch(NewMerkleTreeFromRows(rows), 60)
+	if _, err := a.Reconcile(c); err == nil {
+		t.Fatal("expected an error for sketches of different sizes")
+	}
+}
+
+func TestSketch_Pruned(t *testing.T) {
+	if _, err := NewSketch(prunedTree(t, makeRows(200)), 30); !errors.Is(err, ErrPrunedSubtree) {
+		t.Fatalf("expected ErrPrunedSubtree, got %v", err)
+	}
+}
+
+func TestSketch_RoundTrip(t *testing.T) {
+	rowsA := makeRows(300)
+	rowsB := editRows(rowsA, map[int]string{7: "changed"})
+	a, _ := NewSketch(NewMerkleTreeFromRows(rowsA), 30)
+	b, _ := NewSketch(NewMerkleTreeFromRows(rowsB), 30)
+
+	var buf bytes.Buffer
+	if _, err := a.WriteTo(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	read, err := ReadSketch(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if read.Hasher() != a.Hasher() || read.Format() != a.Format() || read.Rows() != 300 || read.Cells() != 30 {
+		t.Fatalf("expected the sketch's metadata to survive, got %s %v %d %d",
+			read.Hasher(), read.Format(), read.Rows(), read.Cells())
+	}
+	ranges, err := read.Reconcile(b)
+	if err != nil || len(ranges) != 1 || string(ranges[0].Start) != "k00070" {
+		t.Fatalf("expected the read sketch to recover k00070, got %v %v", ranges, err)
+	}
+
+	corrupt := bytes.Clone(encoded)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := ReadSketch(bytes.NewReader(corrupt)); !errors.Is(err, ErrInvalidSketch) {
+		t.Fatalf("expected ErrInvalidSketch for a corrupt sketch, got %v", err)
+	}
+	if _, err := ReadSketch(bytes.NewReader(encoded[:len(encoded)-3])); !errors.Is(err, ErrInvalidSketch) {
+		t.Fatalf("expected ErrInvalidSketch for a truncated sketch, got %v", err)
+	}
+}
+
+func TestReadSketch_HugeCellCount(t *testing.T) {
+	// A short header claiming the most cells a field allows
+	header := []byte(SketchMagic)
+	header = binary.BigEndian.AppendUint16(header, sketchVersion)
+	header = binary.AppendUvarint(header, 6)
+	header = append(header, "sha256"...)
+	header = binary.AppendUvarint(header, uint64(FormatDomainSeparated))
+	header = binary.AppendUvarint(header, 0)
+	header = binary.AppendUvarint(header, maxSnapshotField/sketchHashes*sketchHashes)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ReadSketch(bytes.NewReader(header))
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrInvalidSketch) {
+		t.Fatalf("expected ErrInvalidSketch, got %v", err)
+	}
+	if grew := after.TotalAlloc - before.TotalAlloc; grew > 1<<20 {
+		t.Fatalf("expected a truncated sketch to allocate little, allocated %d bytes", grew)
+	}
+}
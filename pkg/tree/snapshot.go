@@ -0,0 +1,283 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/BryceDouglasJames/merklediff/internal/codec"
+	itree "github.com/BryceDouglasJames/merklediff/internal/tree"
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+	"github.com/BryceDouglasJames/merklediff/pkg/types"
+)
+
+// Snapshot layout (all integers are unsigned varints unless noted):
+//
+//	magic             "MDTS"
+//	version           uint16, big-endian
+//	hasher name       length-prefixed bytes
+//	format, shape, fanout, serializer version, row count
+//	schema            column count, then (name, type) per column;
+//	                  key column count, then each key column index
+//	root present      one byte, 0 or 1
+//	nodes             pre-order: level, row count, child count, start key,
+//	                  end key, hash
+//	checksum          CRC-32 (IEEE) of everything above, uint32 big-endian
+//
+// Row values are not stored, so a snapshot can be compared against but not
+// used to recover data. Version 1 snapshots have no per-node row counts;
+// they are recomputed on read, which fails for pruned subtrees.
+
+// SnapshotMagic starts every snapshot, so callers can tell a snapshot from
+// other input files.
+const SnapshotMagic = "MDTS"
+
+const (
+	snapshotVersion = 2
+
+	// snapshotVersionNoCounts is the oldest version still read, from
+	// before nodes recorded their row counts.
+	snapshotVersionNoCounts = 1
+
+	// maxSnapshotField bounds any single length read from a snapshot so a
+	// corrupt file cannot trigger a huge allocation. Counts of repeated
+	// items are bounded too, but their slices still grow as items are read,
+	// since each item may be many bytes.
+	maxSnapshotField = 1 << 26
+
+	// maxSnapshotDepth bounds node nesting. Real trees are logarithmic in
+	// their row count, far below this.
+	maxSnapshotDepth = 512
+)
+
+// ErrInvalidSnapshot is returned by ReadTree when the input is not a
+// snapshot this version can read, or fails its integrity checks.
+var ErrInvalidSnapshot = errors.New("invalid tree snapshot")
+
+// WriteTo writes a snapshot of the tree to w. It implements io.WriterTo.
+// The snapshot holds every node's hash and key range plus the tree's
+// configuration, row count and schema, but not the rows themselves.
+func (t *MerkleTree) WriteTo(w io.Writer) (int64, error) {
+	e := newSnapshotEncoder(w)
+
+	e.Raw([]byte(SnapshotMagic))
+	e.Raw(binary.BigEndian.AppendUint16(nil, snapshotVersion))
+
+	e.Bytes([]byte(t.config.Hasher.Name()))
+	e.Uvarint(uint64(t.config.Format))
+	e.Uvarint(uint64(t.config.Shape))
+	e.Uvarint(uint64(t.config.Fanout))
+	e.Uvarint(itree.SerializerVersion)
+	e.Uvarint(uint64(t.rowCount))
+
+	e.Uvarint(uint64(len(t.schema.Columns)))
+	for _, col := range t.schema.Columns {
+		e.Bytes([]byte(col.Name))
+		e.Uvarint(uint64(col.Type))
+	}
+	e.Uvarint(uint64(len(t.schema.KeyColumns)))
+	for _, idx := range t.schema.KeyColumns {
+		e.Uvarint(uint64(idx))
+	}
+
+	if t.root == nil {
+		e.Raw([]byte{0})
+	} else {
+		e.Raw([]byte{1})
+		e.node(t.root)
+	}
+
+	return e.Finish()
+}
+
+// ReadTree reads a snapshot written by WriteTo. The hasher is looked up by
+// the name recorded in the snapshot; keyed hashers need ReadTreeWithHasher,
+// and ReadTree returns an error wrapping hasher.ErrKeyRequired for them.
+func ReadTree(r io.Reader) (*MerkleTree, error) {
+	return ReadTreeWithHasher(r, nil)
+}
+
+// ReadTreeWithHasher reads a snapshot using h to check internal node hashes.
+// h must have the name recorded in the snapshot. If h is nil the hasher is
+// looked up by name.
+func ReadTreeWithHasher(r io.Reader, h hasher.Hasher) (*MerkleTree, error) {
+	d := newSnapshotDecoder(r, ErrInvalidSnapshot)
+
+	magic := d.Raw(len(SnapshotMagic))
+	if d.Err() == nil && string(magic) != SnapshotMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrInvalidSnapshot, magic)
+	}
+	version := binary.BigEndian.Uint16(d.Raw(2))
+	if d.Err() == nil && version != snapshotVersion && version != snapshotVersionNoCounts {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, version)
+	}
+	d.counts = version >= snapshotVersion
+
+	hasherName := string(d.bytes())
+	config := TreeConfig{
+		Format: TreeFormat(d.Uvarint()),
+		Shape:  TreeShape(d.Uvarint()),
+		Fanout: int(d.Uvarint()),
+	}
+	serializerVersion := d.Uvarint()
+	rowCount := d.Uvarint()
+
+	// Counts are only trusted as far as the data backing them, so grow the
+	// schema as it is read
+	var schema types.Schema
+	for i, n := 0, d.count(); i < n && d.Err() == nil; i++ {
+		schema.Columns = append(schema.Columns, types.Column{Name: string(d.bytes()), Type: types.ColumnType(d.Uvarint())})
+	}
+	for i, n := 0, d.count(); i < n && d.Err() == nil; i++ {
+		schema.KeyColumns = append(schema.KeyColumns, int(d.Uvarint()))
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+
+	if serializerVersion != itree.SerializerVersion {
+		return nil, fmt.Errorf("%w: serializer version %d, this build uses %d",
+			ErrInvalidSnapshot, serializerVersion, itree.SerializerVersion)
+	}
+
+	if h == nil {
+		var err error
+		if h, err = hasher.New(hasherName, nil); err != nil {
+			if errors.Is(err, hasher.ErrKeyRequired) {
+				// The snapshot is fine, but the caller has to supply the key
+				return nil, fmt.Errorf("snapshot uses %s: %w", hasherName, err)
+			}
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+	} else if h.Name() != hasherName {
+		return nil, &MismatchError{Err: ErrHasherMismatch, A: hasherName, B: h.Name()}
+	}
+	config.Hasher = h
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	var root *MerkleNode
+	switch d.Raw(1)[0] {
+	case 0:
+	case 1:
+		root = d.node(config.treeHasher(), 0)
+	default:
+		return nil, fmt.Errorf("%w: bad root marker", ErrInvalidSnapshot)
+	}
+
+	if err := d.VerifyChecksum(); err != nil {
+		return nil, err
+	}
+
+	return &MerkleTree{
+		root:        root,
+		nodeBuilder: itree.NewNodeBuilder(),
+		config:      config,
+		rowCount:    int(rowCount),
+		schema:      schema,
+	}, nil
+}
+
+// snapshotEncoder writes snapshot fields.
+type snapshotEncoder struct {
+	*codec.Encoder
+}
+
+func newSnapshotEncoder(w io.Writer) *snapshotEncoder {
+	return &snapshotEncoder{codec.NewEncoder(w)}
+}
+
+// node writes n and its subtree in pre-order.
+func (e *snapshotEncoder) node(n *MerkleNode) {
+	e.Uvarint(uint64(n.GetLevel()))
+	e.Uvarint(uint64(n.GetCount()))
+	e.Uvarint(uint64(len(n.GetChildren())))
+	e.Bytes(n.GetStartKey())
+	e.Bytes(n.GetEndKey())
+	e.Bytes(n.GetHash())
+	for _, child := range n.GetChildren() {
+		e.node(child)
+	}
+}
+
+// snapshotDecoder reads snapshot fields. After an error every read returns
+// zero values.
+type snapshotDecoder struct {
+	*codec.Decoder
+
+	// counts reports whether nodes carry their row counts
+	counts bool
+}
+
+// newSnapshotDecoder returns a decoder whose integrity failures wrap
+// invalid, so sketches can share it.
+func newSnapshotDecoder(r io.Reader, invalid error) *snapshotDecoder {
+	return &snapshotDecoder{Decoder: codec.NewDecoder(r, invalid)}
+}
+
+// count reads a length and checks it against maxSnapshotField.
+func (d *snapshotDecoder) count() int {
+	return d.Count(maxSnapshotField)
+}
+
+func (d *snapshotDecoder) bytes() []byte {
+	return d.Raw(d.count())
+}
+
+// node reads a subtree in pre-order. Internal node hashes and row counts
+// are recomputed from their children and must match the stored values.
+func (d *snapshotDecoder) node(th treeHasher, depth int) *MerkleNode {
+	if depth > maxSnapshotDepth {
+		d.Fail(fmt.Errorf("%w: tree deeper than %d", ErrInvalidSnapshot, maxSnapshotDepth))
+		return nil
+	}
+
+	level := int(d.Uvarint())
+	count := 1
+	if d.counts {
+		count = int(d.Uvarint())
+	}
+	childCount := d.count()
+	startKey := d.bytes()
+	endKey := d.bytes()
+	hash := d.bytes()
+	if d.Err() != nil {
+		return nil
+	}
+
+	// Leaves and pruned subtrees are taken as stored
+	if childCount == 0 {
+		switch {
+		case level > 0 && !d.counts:
+			d.Fail(fmt.Errorf("%w: version %d snapshot has no row count for pruned subtree %q..%q",
+				ErrInvalidSnapshot, snapshotVersionNoCounts, startKey, endKey))
+			return nil
+		case (level == 0 && count != 1) || count < 1:
+			d.Fail(fmt.Errorf("%w: node %q..%q has row count %d", ErrInvalidSnapshot, startKey, endKey, count))
+			return nil
+		}
+		return &MerkleNode{hash: hash, startKey: startKey, endKey: endKey, level: level, count: count}
+	}
+	if childCount == 1 {
+		d.Fail(fmt.Errorf("%w: node with a single child", ErrInvalidSnapshot))
+		return nil
+	}
+
+	children := make([]*MerkleNode, childCount)
+	for i := range children {
+		if children[i] = d.node(th, depth+1); d.Err() != nil {
+			return nil
+		}
+	}
+
+	n := th.parent(children...)
+	if !bytes.Equal(n.GetHash(), hash) || n.GetLevel() != level || (d.counts && n.GetCount() != count) ||
+		!bytes.Equal(n.GetStartKey(), startKey) || !bytes.Equal(n.GetEndKey(), endKey) {
+		d.Fail(fmt.Errorf("%w: node %q..%q does not match its children", ErrInvalidSnapshot, startKey, endKey))
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,174 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/BryceDouglasJames/merklediff/pkg/hasher"
+	"github.com/BryceDouglasJames/merklediff/pkg/types"
+)
+
+func snapshotRoundTrip(t *testing.T, mt *MerkleTree) *MerkleTree {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := mt.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+	got, err := ReadTree(&buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return got
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	schema := types.Schema{
+		Columns:    []types.Column{{Name: "id", Type: types.ColumnTypeString}, {Name: "n", Type: types.ColumnTypeInt}},
+		KeyColumns: []int{0},
+	}
+
+	for _, config := range []TreeConfig{
+		{},
+		{Fanout: 16, Hasher: &hasher.SHA512_256Hasher{}},
+		{Shape: ShapeContentDefined},
+		{Format: FormatLegacy},
+	} {
+		mt, err := NewMerkleTreeFromRowsWithConfig(makeRows(300), config)
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		mt.SetSchema(schema)
+
+		got := snapshotRoundTrip(t, mt)
+
+		if got.Fingerprint() != mt.Fingerprint() {
+			t.Fatalf("%+v: fingerprint %s, want %s", config, got.Fingerprint(), mt.Fingerprint())
+		}
+		if got.GetRowCount() != 300 {
+			t.Fatalf("expected row count 300, got %d", got.GetRowCount())
+		}
+		if !reflect.DeepEqual(got.GetSchema(), schema) {
+			t.Fatalf("schema not preserved: %+v", got.GetSchema())
+		}
+		if got.GetConfig().Shape != mt.GetConfig().Shape || got.GetConfig().Fanout != mt.GetConfig().Fanout {
+			t.Fatalf("config not preserved: %+v", got.GetConfig())
+		}
+		if got.String() != mt.String() {
+			t.Fatalf("%+v: nodes differ after round trip", config)
+		}
+	}
+}
+
+func TestSnapshot_DiffAgainstLoadedTree(t *testing.T) {
+	rows := makeRows(100)
+	changed := make([]Row, len(rows))
+	copy(changed, rows)
+	changed[7] = Row{Key: rows[7].Key, Values: []any{"changed", int64(-1)}}
+
+	saved := snapshotRoundTrip(t, NewMerkleTreeFromRows(rows))
+	diff := NewDiff(saved, NewMerkleTreeFromRows(changed))
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	ranges := diff.GetRanges()
+	if len(ranges) != 1 || !bytes.Equal(ranges[0].Start, rows[7].Key) {
+		t.Fatalf("expected one change at %q, got %v", rows[7].Key, ranges)
+	}
+}
+
+func TestSnapshot_PrunedAndEmptyTrees(t *testing.T) {
+	b := NewStreamingTreeBuilder(16)
+	b.SetPruneLevel(2)
+	if err := b.Consume(&sliceReader{rows: makeRows(50)}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	pruned, _ := b.Build()
+	if got := snapshotRoundTrip(t, pruned); got.Fingerprint() != pruned.Fingerprint() {
+		t.Fatalf("pruned tree fingerprint changed")
+	}
+
+	empty := snapshotRoundTrip(t, NewMerkleTreeFromRows(nil))
+	if empty.GetRoot() != nil {
+		t.Fatalf("expected nil root")
+	}
+}
+
+func TestSnapshot_RejectsCorruptInput(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewMerkleTreeFromRows(makeRows(20)).WriteTo(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	data := buf.Bytes()
+
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0xff
+
+	for name, input := range map[string][]byte{
+		"truncated": data[:len(data)-10],
+		"flipped":   flipped,
+		"magic":     append([]byte("XXXX"), data[4:]...),
+		"empty":     nil,
+	} {
+		if _, err := ReadTree(bytes.NewReader(input)); !errors.Is(err, ErrInvalidSnapshot) {
+			t.Fatalf("%s: expected ErrInvalidSnapshot, got %v", name, err)
+		}
+	}
+}
+
+func TestSnapshot_HugeSchemaCount(t *testing.T) {
+	// A short header claiming the most columns a field allows
+	header := []byte(SnapshotMagic)
+	header = binary.BigEndian.AppendUint16(header, snapshotVersion)
+	header = binary.AppendUvarint(header, 6)
+	header = append(header, "sha256"...)
+	for _, v := range []uint64{uint64(FormatDomainSeparated), uint64(ShapePositional), 2, 1, 0, maxSnapshotField} {
+		header = binary.AppendUvarint(header, v)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ReadTree(bytes.NewReader(header))
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+	}
+	if grew := after.TotalAlloc - before.TotalAlloc; grew > 1<<20 {
+		t.Fatalf("expected a truncated snapshot to allocate little, allocated %d bytes", grew)
+	}
+}
+
+func TestSnapshot_KeyedHasher(t *testing.T) {
+	h := hasher.NewHMACHasher([]byte("secret"))
+	mt, _ := NewMerkleTreeFromRowsWithConfig(makeRows(10), TreeConfig{Hasher: h})
+
+	var buf bytes.Buffer
+	if _, err := mt.WriteTo(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	data := buf.Bytes()
+
+	if _, err := ReadTree(bytes.NewReader(data)); !errors.Is(err, hasher.ErrKeyRequired) {
+		t.Fatalf("expected ErrKeyRequired reading a keyed snapshot without a key, got %v", err)
+	}
+	if _, err := ReadTreeWithHasher(bytes.NewReader(data), hasher.NewHMACHasher([]byte("wrong"))); !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("expected ErrHasherMismatch with the wrong key, got %v", err)
+	}
+	got, err := ReadTreeWithHasher(bytes.NewReader(data), h)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got.Fingerprint() != mt.Fingerprint() {
+		t.Fatalf("fingerprint changed")
+	}
+}
@@ -0,0 +1,141 @@
+package tree
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// DiffStats describes the work done by the last comparison, to show where
+// a slow diff spent its time and how much of the trees it skipped.
+type DiffStats struct {
+	// NodesVisited counts the nodes examined in either tree.
+	NodesVisited int `json:"nodes_visited"`
+
+	// SubtreesPruned counts identical subtrees, including single leaves,
+	// that were skipped without looking below them.
+	SubtreesPruned int `json:"subtrees_pruned"`
+
+	// MaxDepth is the deepest level reached below the roots.
+	MaxDepth int `json:"max_depth"`
+
+	// LeafComparisons counts pairs of leaves compared with each other.
+	LeafComparisons int `json:"leaf_comparisons"`
+
+	// RangesEmitted counts the differing ranges reported.
+	RangesEmitted int `json:"ranges_emitted"`
+}
+
+// GetStats returns the statistics of the last call to Compare, or of the
+// last iteration over Ranges.
+func (d *Diff) GetStats() DiffStats {
+	return DiffStats{
+		NodesVisited:    int(d.stats.visited.Load()),
+		SubtreesPruned:  int(d.stats.pruned.Load()),
+		MaxDepth:        int(d.stats.depth.Load()),
+		LeafComparisons: int(d.stats.leaves.Load()),
+		RangesEmitted:   int(d.stats.ranges.Load()),
+	}
+}
+
+// diffCounters accumulates DiffStats. The counters are atomic because a
+// concurrent comparison updates them from several goroutines.
+type diffCounters struct {
+	visited, pruned, depth, leaves, ranges atomic.Int64
+}
+
+func (c *diffCounters) reset() {
+	for _, v := range []*atomic.Int64{&c.visited, &c.pruned, &c.depth, &c.leaves, &c.ranges} {
+		v.Store(0)
+	}
+}
+
+// visit records a node from either tree, or a pair of nodes, at depth.
+func (c *diffCounters) visit(depth int, a, b *MerkleNode) {
+	var n int64
+	if a != nil {
+		n++
+	}
+	if b != nil {
+		n++
+	}
+	c.visited.Add(n)
+
+	for d := c.depth.Load(); int64(depth) > d; d = c.depth.Load() {
+		if c.depth.CompareAndSwap(d, int64(depth)) {
+			break
+		}
+	}
+}
+
+// ExplainStep is one level of the path a comparison takes towards a key.
+type ExplainStep struct {
+	// Depth is the level below the roots.
+	Depth int
+
+	// A and B are the nodes covering the key in each tree, or nil if that
+	// tree has no such node, in which case the path ends here.
+	A, B *MerkleNode
+
+	// Identical reports whether the two subtrees match, in which case the
+	// comparison stops here.
+	Identical bool
+}
+
+// Explain returns the path the comparison takes through both trees towards
+// key, from the roots down to where the trees match or the key's leaves.
+// Positional trees are walked in step, pairing children by position as
+// Compare does, along the key's path in whichever tree holds it;
+// content-defined trees are followed by key on each side. The path stops at
+// the first level where either tree has no node, such as where one
+// positional tree has fewer children than the other.
+func (d *Diff) Explain(key []byte) []ExplainStep {
+	ordered := d.usesOrderedCompare()
+	a, b := d.treeA.GetRoot(), d.treeB.GetRoot()
+
+	var path []pathStep
+	if !ordered {
+		if path = d.treeA.leafPath(key); path == nil {
+			path = d.treeB.leafPath(key)
+		}
+	}
+
+	var steps []ExplainStep
+	for depth := 0; a != nil || b != nil; depth++ {
+		step := ExplainStep{Depth: depth, A: a, B: b}
+		if a != nil && b != nil {
+			if ordered {
+				step.Identical = sameSubtree(a, b)
+			} else {
+				step.Identical = bytes.Equal(a.GetHash(), b.GetHash())
+			}
+		}
+		steps = append(steps, step)
+		if step.Identical || a == nil || b == nil {
+			break
+		}
+
+		if ordered {
+			a, b = childCovering(a, key), childCovering(b, key)
+			continue
+		}
+		if depth >= len(path)-1 || a.IsLeaf() || b.IsLeaf() {
+			break
+		}
+		i := path[depth].child
+		a, b = childAt(a.GetChildren(), i), childAt(b.GetChildren(), i)
+	}
+	return steps
+}
+
+// childCovering returns the child of n whose key range holds key, or nil.
+func childCovering(n *MerkleNode, key []byte) *MerkleNode {
+	if n == nil {
+		return nil
+	}
+	for _, child := range n.GetChildren() {
+		if child != nil && bytes.Compare(child.GetStartKey(), key) <= 0 && bytes.Compare(key, child.GetEndKey()) <= 0 {
+			return child
+		}
+	}
+	return nil
+}
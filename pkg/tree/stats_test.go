@@ -0,0 +1,112 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// changeRow returns a copy of rows with the row at i given new values.
+func changeRow(rows []Row, i int) []Row {
+	changed := append([]Row(nil), rows...)
+	changed[i] = Row{Key: rows[i].Key, Values: []any{"changed", int64(-1)}}
+	return changed
+}
+
+func TestDiffStats_IdenticalTrees(t *testing.T) {
+	rows := makeRows(64)
+	diff := NewDiff(NewMerkleTreeFromRows(rows), NewMerkleTreeFromRows(rows))
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	want := DiffStats{NodesVisited: 2, SubtreesPruned: 1}
+	if got := diff.GetStats(); got != want {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestDiffStats_SingleChange(t *testing.T) {
+	rows := makeRows(64) // a perfect binary tree, 6 levels deep
+	treeA := NewMerkleTreeFromRows(rows)
+	treeB := NewMerkleTreeFromRows(changeRow(rows, 20))
+
+	// The root pair, then two child pairs on each level down to the leaves
+	want := DiffStats{NodesVisited: 26, SubtreesPruned: 6, MaxDepth: 6, LeafComparisons: 2, RangesEmitted: 1}
+	for _, concurrency := range []int{1, 4} {
+		diff := NewDiff(treeA, treeB)
+		diff.SetConcurrency(concurrency)
+		if err := diff.Compare(context.Background()); err != nil {
+			t.Fatalf("compare: %v", err)
+		}
+		if got := diff.GetStats(); got != want {
+			t.Fatalf("concurrency %d: expected %+v, got %+v", concurrency, want, got)
+		}
+	}
+}
+
+func TestDiffStats_ContentDefined(t *testing.T) {
+	rows := makeRows(500)
+	diff := NewDiff(contentTree(t, rows), contentTree(t, changeRow(rows, 250)))
+	if err := diff.Compare(context.Background()); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+
+	stats := diff.GetStats()
+	if stats.RangesEmitted != 1 || stats.LeafComparisons == 0 || stats.SubtreesPruned == 0 {
+		t.Fatalf("unexpected stats for a single change: %+v", stats)
+	}
+	if stats.NodesVisited >= 2*len(rows) {
+		t.Fatalf("expected most of the trees to be skipped, visited %d nodes", stats.NodesVisited)
+	}
+}
+
+func TestDiff_Explain(t *testing.T) {
+	rows := makeRows(64)
+	for _, config := range []TreeConfig{{}, {Shape: ShapeContentDefined}} {
+		treeA, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		treeB, _ := NewMerkleTreeFromRowsWithConfig(changeRow(rows, 20), config)
+		diff := NewDiff(treeA, treeB)
+
+		// The changed key's path differs all the way down to its leaves
+		steps := diff.Explain(rows[20].Key)
+		last := steps[len(steps)-1]
+		if last.Identical || !last.A.IsLeaf() || !bytes.Equal(last.A.GetStartKey(), rows[20].Key) {
+			t.Fatalf("%+v: expected the path to end at the changed leaf, got %+v", config, last)
+		}
+		for _, step := range steps {
+			if step.Identical {
+				t.Fatalf("%+v: unexpected identical node on the changed key's path", config)
+			}
+		}
+
+		// An unchanged key's path stops where its subtree matches
+		steps = diff.Explain(rows[50].Key)
+		if last := steps[len(steps)-1]; !last.Identical {
+			t.Fatalf("%+v: expected the path to stop at an identical subtree, got %+v", config, last)
+		}
+	}
+}
+
+func TestDiff_ExplainUnevenTrees(t *testing.T) {
+	// With a fanout of 3 the smaller tree runs out of children first
+	rows := makeRows(27)
+	treeA, _ := NewMerkleTreeFromRowsWithConfig(rows[:4], TreeConfig{Fanout: 3})
+	treeB, _ := NewMerkleTreeFromRowsWithConfig(rows, TreeConfig{Fanout: 3})
+
+	steps := NewDiff(treeA, treeB).Explain(rows[20].Key)
+	last := steps[len(steps)-1]
+	if last.A != nil || last.B == nil {
+		t.Fatalf("expected the path to end where A has no node, got %+v", last)
+	}
+	for _, step := range steps[:len(steps)-1] {
+		if step.A == nil || step.B == nil {
+			t.Fatalf("expected only the last step to be missing a side, got %+v", step)
+		}
+	}
+
+	steps = NewDiff(treeB, treeA).Explain(rows[20].Key)
+	if last := steps[len(steps)-1]; last.A == nil || last.B != nil {
+		t.Fatalf("expected the path to end where B has no node, got %+v", last)
+	}
+}
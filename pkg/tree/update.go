@@ -0,0 +1,284 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	// ErrPrunedSubtree is returned when an update needs the children of a
+	// subtree that was pruned by StreamingTreeBuilder.SetPruneLevel.
+	ErrPrunedSubtree = errors.New("update reaches a pruned subtree")
+
+	// ErrPositionalShift is returned when an update would insert or delete
+	// a row in a positional tree. Every later row would move to a new
+	// position and the whole tree would have to be rebuilt, so incremental
+	// inserts and deletes need ShapeContentDefined.
+	ErrPositionalShift = errors.New("positional trees can only replace existing rows")
+)
+
+// Upsert inserts row, or replaces the row with the same key, and rehashes
+// the nodes above it.
+//
+// In a content-defined tree only the row's root path changes, and the
+// result is identical to rebuilding the tree from all of its rows. A
+// positional tree can only replace a row it already holds, which rehashes
+// the row's root path; inserting a new key returns ErrPositionalShift.
+//
+// Nodes are never modified in place: the tree gets a new root, and nodes
+// still referenced elsewhere keep their old hashes. On error the tree is
+// unchanged.
+func (t *MerkleTree) Upsert(row Row) error {
+	// Copy the key: callers may reuse their buffers between rows
+	key := append([]byte(nil), row.Key...)
+	leaf := t.config.treeHasher().rowLeaf(key, t.nodeBuilder.SerializeRowValues(row.Values))
+
+	if t.config.Shape == ShapeContentDefined {
+		return t.upsertContent(leaf)
+	}
+	return t.upsertPositional(leaf)
+}
+
+// Delete removes the row with the given key and rehashes the nodes above
+// it. It reports whether the row was present. As with Upsert, only
+// content-defined trees support deletes, which change the row's root path;
+// deleting a row from a positional tree returns ErrPositionalShift.
+func (t *MerkleTree) Delete(key []byte) (bool, error) {
+	if t.config.Shape == ShapeContentDefined {
+		return t.deleteContent(key)
+	}
+	return t.deletePositional(key)
+}
+
+// ────────────────────────────────────────────────────────────────────────────
+// Content-defined updates
+// ────────────────────────────────────────────────────────────────────────────
+
+// Content-defined trees are treaps keyed by row key, with each internal
+// node's priority taken from its gap (see shape.go). Split and join keep
+// that invariant, and the invariant fixes the shape, so any sequence of
+// updates yields the same tree as a fresh build.
+
+func (t *MerkleTree) upsertContent(leaf *MerkleNode) error {
+	th := t.config.treeHasher()
+
+	lt, old, gt, err := splitContent(th, t.root, leaf.GetStartKey())
+	if err != nil {
+		return err
+	}
+	root, err := joinContent(th, lt, leaf)
+	if err != nil {
+		return err
+	}
+	if root, err = joinContent(th, root, gt); err != nil {
+		return err
+	}
+
+	t.root = root
+	if old == nil {
+		t.rowCount++
+	}
+	return nil
+}
+
+func (t *MerkleTree) deleteContent(key []byte) (bool, error) {
+	th := t.config.treeHasher()
+
+	lt, old, gt, err := splitContent(th, t.root, key)
+	if err != nil || old == nil {
+		return false, err
+	}
+	root, err := joinContent(th, lt, gt)
+	if err != nil {
+		return false, err
+	}
+
+	t.root = root
+	t.rowCount--
+	return true, nil
+}
+
+// splitContent splits a content-defined tree into the trees holding the
+// keys below and above key, plus the leaf for key itself if there is one.
+// Only nodes on the path to key are rebuilt.
+func splitContent(th treeHasher, n *MerkleNode, key []byte) (lt, eq, gt *MerkleNode, err error) {
+	switch {
+	case n == nil:
+		return nil, nil, nil, nil
+	case bytes.Compare(key, n.GetStartKey()) < 0:
+		return nil, nil, n, nil
+	case bytes.Compare(key, n.GetEndKey()) > 0:
+		return n, nil, nil, nil
+	case isPruned(n):
+		return nil, nil, nil, fmt.Errorf("%w: key %q", ErrPrunedSubtree, key)
+	case n.IsLeaf():
+		return nil, n, nil, nil
+	}
+
+	// Each half keeps n's gap, and with it n's priority, so n's gap can
+	// stay on top of whatever is attached beneath it
+	left, right := n.GetLeft(), n.GetRight()
+	if bytes.Compare(key, left.GetEndKey()) <= 0 {
+		lt, eq, gt, err = splitContent(th, left, key)
+		return lt, eq, attach(th, gt, right), err
+	}
+	lt, eq, gt, err = splitContent(th, right, key)
+	return attach(th, left, lt), eq, gt, err
+}
+
+// joinContent joins two content-defined trees, where every key in a sorts
+// before every key in b. The new gap between them sinks below any gap with
+// a higher priority.
+func joinContent(th treeHasher, a, b *MerkleNode) (*MerkleNode, error) {
+	if a == nil {
+		return b, nil
+	}
+	if b == nil {
+		return a, nil
+	}
+	if isPruned(a) || isPruned(b) {
+		return nil, fmt.Errorf("%w: joining %q and %q", ErrPrunedSubtree, a.GetEndKey(), b.GetStartKey())
+	}
+
+	gap := gapPriority(a.GetEndKey())
+
+	// Gaps are ordered a's, then the new one, then b's; ties go to the
+	// earlier gap, matching contentBuilder
+	switch {
+	case !a.IsLeaf() && rootPriority(a) >= gap && (b.IsLeaf() || rootPriority(a) >= rootPriority(b)):
+		right, err := joinContent(th, a.GetRight(), b)
+		if err != nil {
+			return nil, err
+		}
+		return th.parent(a.GetLeft(), right), nil
+
+	case b.IsLeaf() || gap >= rootPriority(b):
+		return th.parent(a, b), nil
+
+	default:
+		left, err := joinContent(th, a, b.GetLeft())
+		if err != nil {
+			return nil, err
+		}
+		return th.parent(left, b.GetRight()), nil
+	}
+}
+
+// rootPriority returns the priority of the gap at an internal node.
+func rootPriority(n *MerkleNode) uint64 {
+	return gapPriority(n.GetLeft().GetEndKey())
+}
+
+// attach joins two subtrees under a new parent, or returns whichever one
+// is non-nil.
+func attach(th treeHasher, a, b *MerkleNode) *MerkleNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	default:
+		return th.parent(a, b)
+	}
+}
+
+// isPruned reports whether n is a subtree whose children were dropped.
+func isPruned(n *MerkleNode) bool {
+	return n.IsLeaf() && n.GetLevel() > 0
+}
+
+// ────────────────────────────────────────────────────────────────────────────
+// Positional updates
+// ────────────────────────────────────────────────────────────────────────────
+
+// pathStep is one node on a root path, with the index of the child the
+// path continues through.
+type pathStep struct {
+	node  *MerkleNode
+	child int
+}
+
+func (t *MerkleTree) upsertPositional(leaf *MerkleNode) error {
+	// Replacing a row keeps every position, so only its root path changes
+	path := t.leafPath(leaf.GetStartKey())
+	if path == nil {
+		return fmt.Errorf("%w: inserting %q", ErrPositionalShift, leaf.GetStartKey())
+	}
+	t.root = rehashPath(t.config.treeHasher(), path, leaf)
+	return nil
+}
+
+func (t *MerkleTree) deletePositional(key []byte) (bool, error) {
+	if t.leafPath(key) == nil {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: deleting %q", ErrPositionalShift, key)
+}
+
+// leafPath returns the path from the root down to the leaf holding key, or
+// nil if there is none.
+func (t *MerkleTree) leafPath(key []byte) []pathStep {
+	return findLeafPath(t.root, key, t.isKeyOrdered(), nil)
+}
+
+// findLeafPath returns the path from n down to the leaf holding key, ending
+// with the leaf, or nil if there is none. In a key-ordered tree, subtrees
+// whose key range excludes key are skipped; a tree built from unsorted rows
+// has no usable ranges, so all of its children are searched.
+func findLeafPath(n *MerkleNode, key []byte, ordered bool, path []pathStep) []pathStep {
+	if n == nil {
+		return nil
+	}
+	if ordered && (bytes.Compare(key, n.GetStartKey()) < 0 || bytes.Compare(key, n.GetEndKey()) > 0) {
+		return nil
+	}
+	if n.IsLeaf() {
+		if n.GetLevel() == 0 && bytes.Equal(n.GetStartKey(), key) {
+			return append(path, pathStep{node: n})
+		}
+		return nil
+	}
+	for i, child := range n.GetChildren() {
+		if found := findLeafPath(child, key, ordered, append(path, pathStep{node: n, child: i})); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// rehashPath replaces the leaf at the end of path and rebuilds each node
+// above it, returning the new root.
+func rehashPath(th treeHasher, path []pathStep, leaf *MerkleNode) *MerkleNode {
+	node := leaf
+	for i := len(path) - 2; i >= 0; i-- {
+		children := slices.Clone(path[i].node.GetChildren())
+		children[path[i].child] = node
+		node = th.parent(children...)
+	}
+	return node
+}
+
+// collectLeaves returns the leaves under n in order.
+func collectLeaves(n *MerkleNode) ([]*MerkleNode, error) {
+	var leaves []*MerkleNode
+	var walk func(n *MerkleNode) error
+	walk = func(n *MerkleNode) error {
+		switch {
+		case n == nil:
+		case isPruned(n):
+			return fmt.Errorf("%w: %q..%q", ErrPrunedSubtree, n.GetStartKey(), n.GetEndKey())
+		case n.IsLeaf():
+			leaves = append(leaves, n)
+		default:
+			for _, child := range n.GetChildren() {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return leaves, walk(n)
+}
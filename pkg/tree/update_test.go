@@ -0,0 +1,178 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// applyOps applies random upserts and deletes to both tree and a map of
+// rows, so the tree can be checked against a fresh build of the map.
+func applyOps(t *testing.T, mt *MerkleTree, rows map[string]Row, rng *rand.Rand, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("k%05d", rng.Intn(3000))
+		if rng.Intn(3) == 0 {
+			_, had := rows[key]
+			found, err := mt.Delete([]byte(key))
+			if err != nil {
+				t.Fatalf("delete %s: %v", key, err)
+			}
+			if found != had {
+				t.Fatalf("delete %s: found=%v, want %v", key, found, had)
+			}
+			delete(rows, key)
+			continue
+		}
+		row := Row{Key: []byte(key), Values: []any{key, int64(rng.Intn(100))}}
+		if err := mt.Upsert(row); err != nil {
+			t.Fatalf("upsert %s: %v", key, err)
+		}
+		rows[key] = row
+	}
+}
+
+func sortedRows(rows map[string]Row) []Row {
+	out := make([]Row, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return bytes.Compare(out[i].Key, out[j].Key) < 0 })
+	return out
+}
+
+func TestUpsertDelete_MatchesRebuild(t *testing.T) {
+	config := TreeConfig{Shape: ShapeContentDefined}
+	rng := rand.New(rand.NewSource(1))
+	rows := make(map[string]Row)
+	for _, r := range makeRows(200) {
+		rows[string(r.Key)] = r
+	}
+
+	mt, err := NewMerkleTreeFromRowsWithConfig(sortedRows(rows), config)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	for round := 0; round < 10; round++ {
+		applyOps(t, mt, rows, rng, 50)
+
+		want, _ := NewMerkleTreeFromRowsWithConfig(sortedRows(rows), config)
+		if mt.Fingerprint() != want.Fingerprint() {
+			t.Fatalf("round %d: root differs from rebuild", round)
+		}
+		if mt.GetRowCount() != len(rows) {
+			t.Fatalf("expected row count %d, got %d", len(rows), mt.GetRowCount())
+		}
+	}
+}
+
+func TestUpsert_PositionalReplacesOnly(t *testing.T) {
+	for _, fanout := range []int{2, 5} {
+		config := TreeConfig{Fanout: fanout}
+		rows := makeRows(200)
+		mt, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+
+		// Replacing rows in place gives the same root as a rebuild
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 50; i++ {
+			j := rng.Intn(len(rows))
+			rows[j] = Row{Key: rows[j].Key, Values: []any{"changed", int64(i)}}
+			if err := mt.Upsert(rows[j]); err != nil {
+				t.Fatalf("fanout %d: upsert %s: %v", fanout, rows[j].Key, err)
+			}
+		}
+		want, _ := NewMerkleTreeFromRowsWithConfig(rows, config)
+		if mt.Fingerprint() != want.Fingerprint() {
+			t.Fatalf("fanout %d: root differs from rebuild", fanout)
+		}
+
+		// Inserts and deletes would shift rows, so they are refused
+		before := mt.Fingerprint()
+		if err := mt.Upsert(Row{Key: []byte("k00050a"), Values: []any{"new", int64(0)}}); !errors.Is(err, ErrPositionalShift) {
+			t.Fatalf("fanout %d: expected ErrPositionalShift for an insert, got %v", fanout, err)
+		}
+		if found, err := mt.Delete(rows[50].Key); found || !errors.Is(err, ErrPositionalShift) {
+			t.Fatalf("fanout %d: expected ErrPositionalShift for a delete, got found=%v, err=%v", fanout, found, err)
+		}
+		if found, err := mt.Delete([]byte("missing")); found || err != nil {
+			t.Fatalf("fanout %d: expected a missing key to be reported absent, got found=%v, err=%v", fanout, found, err)
+		}
+		if mt.Fingerprint() != before || mt.GetRowCount() != len(rows) {
+			t.Fatalf("fanout %d: refused updates changed the tree", fanout)
+		}
+	}
+}
+
+func TestUpsert_ContentDefinedChangesOnlyRootPath(t *testing.T) {
+	mt := contentTree(t, makeRows(1000))
+	before := make(map[string]bool)
+	collectHashes(mt.GetRoot(), before)
+
+	key := []byte("k00015")
+	if err := mt.Upsert(Row{Key: key, Values: []any{"new", int64(1)}}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	newNodes := 0
+	countNew(mt.GetRoot(), before, &newNodes)
+	if depth := depthOf(mt.GetRoot(), key); newNodes > depth+1 {
+		t.Fatalf("expected at most %d new nodes, got %d", depth+1, newNodes)
+	}
+}
+
+func TestUpsert_DoesNotModifyOldNodes(t *testing.T) {
+	mt := NewMerkleTreeFromRows(makeRows(16))
+	oldRoot := mt.GetRoot()
+	oldHash := append([]byte(nil), oldRoot.GetHash()...)
+
+	if err := mt.Upsert(Row{Key: []byte("k00050"), Values: []any{"changed", int64(-1)}}); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if !bytes.Equal(oldRoot.GetHash(), oldHash) {
+		t.Fatal("upsert modified the old root in place")
+	}
+	if bytes.Equal(mt.GetRoot().GetHash(), oldHash) {
+		t.Fatal("expected a new root hash")
+	}
+}
+
+func TestUpsertDelete_EmptyTree(t *testing.T) {
+	config := TreeConfig{Shape: ShapeContentDefined}
+	mt, _ := NewMerkleTreeFromRowsWithConfig(nil, config)
+	row := makeRows(1)[0]
+	if err := mt.Upsert(row); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	want, _ := NewMerkleTreeFromRowsWithConfig([]Row{row}, config)
+	if mt.Fingerprint() != want.Fingerprint() {
+		t.Fatal("unexpected root after first insert")
+	}
+	if found, err := mt.Delete(row.Key); !found || err != nil {
+		t.Fatalf("delete: found=%v, err=%v", found, err)
+	}
+	if mt.GetRoot() != nil || mt.GetRowCount() != 0 {
+		t.Fatal("expected empty tree")
+	}
+}
+
+func TestUpsert_PrunedSubtree(t *testing.T) {
+	b, _ := NewStreamingTreeBuilderWithConfig(16, TreeConfig{Shape: ShapeContentDefined})
+	b.SetPruneLevel(2)
+	if err := b.Consume(&sliceReader{rows: makeRows(100)}); err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+	mt, _ := b.Build()
+	before := mt.Fingerprint()
+
+	err := mt.Upsert(Row{Key: []byte("k00500"), Values: []any{"changed", int64(-1)}})
+	if !errors.Is(err, ErrPrunedSubtree) {
+		t.Fatalf("expected ErrPrunedSubtree, got %v", err)
+	}
+	if mt.Fingerprint() != before {
+		t.Fatal("failed upsert changed the tree")
+	}
+}